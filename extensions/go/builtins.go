@@ -0,0 +1,991 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func registerBuiltins(r *BaseRegistry) {
+	r.RegisterAssertionWithSchema("regex_match", "actual matches the regular expression pattern",
+		[]string{"actual:string", "pattern:string", "flags?:string"}, assertRegexMatch)
+	r.RegisterAssertionWithSchema("regex_capture", "pattern matches actual and the named or numbered groups equal expected",
+		[]string{"actual:string", "pattern:string", "expected:object", "flags?:string"}, assertRegexCapture)
+	r.RegisterAssertionWithSchema("in_range", "actual lies within [min, max]",
+		[]string{"actual:number", "min:number", "max:number"}, assertInRange)
+	r.RegisterAssertionWithSchema("contains_all", "actual contains every member of expected",
+		[]string{"actual:array", "expected:array"}, assertContainsAll)
+	r.RegisterAssertionWithSchema("contains_any", "actual contains at least one member of expected",
+		[]string{"actual:array", "expected:array"}, assertContainsAny)
+	r.RegisterAssertionWithSchema("is_before", "timestamp actual is before expected",
+		[]string{"actual", "expected"}, assertTimestampOrder("is_before"))
+	r.RegisterAssertionWithSchema("is_after", "timestamp actual is after expected",
+		[]string{"actual", "expected"}, assertTimestampOrder("is_after"))
+	r.RegisterAssertionWithSchema("is_recent", "timestamp actual is within withinMs of ctx.Now(), in either direction",
+		[]string{"actual", "withinMs:number"}, assertIsRecent)
+	r.RegisterAssertionWithSchema("is_true", "actual is truthy", []string{"actual"}, assertTruthiness(true))
+	r.RegisterAssertionWithSchema("is_false", "actual is falsy", []string{"actual"}, assertTruthiness(false))
+	r.RegisterAssertionWithSchema("is_empty", "actual is null, an empty string or an empty collection", []string{"actual"}, assertEmptiness(true))
+	r.RegisterAssertionWithSchema("is_not_empty", "actual is not empty", []string{"actual"}, assertEmptiness(false))
+	r.RegisterAssertionWithSchema("key_absent", "the context has no value at key, not even null", []string{"key:string"}, assertKeyAbsent)
+	r.RegisterAssertionWithSchema("contains_subset", "every key in expected is present in actual with a deep-equal value; nested objects match as subsets",
+		[]string{"actual:object", "expected:object"}, assertContainsSubset)
+	r.RegisterAssertionWithSchema("json_equals_ignoring", "actual deep-equals expected once the ignore key paths are dropped",
+		[]string{"actual", "expected", "ignore?:array"}, assertJSONEqualsIgnoring)
+	r.RegisterAssertionWithSchema("delta_equals", "right - left equals expected within tolerance",
+		[]string{"left", "right", "expected:number", "tolerance?:number"}, assertDeltaEquals)
+	r.RegisterAssertionWithSchema("matches_schema", "actual satisfies a JSON Schema subset (type, required, properties)",
+		[]string{"actual", "schema:object"}, assertMatchesSchema)
+	r.RegisterAssertionWithSchema("all_match", "every element of actual (or its value at path) passes the nested assertion",
+		[]string{"actual:array", "assertion:object", "path?:string"}, assertQuantified(r, true))
+	r.RegisterAssertionWithSchema("any_match", "at least one element of actual (or its value at path) passes the nested assertion",
+		[]string{"actual:array", "assertion:object", "path?:string"}, assertQuantified(r, false))
+
+	r.RegisterFunctionWithTags("transform", []string{builtinTag}, builtinTransform)
+	r.RegisterFunctionWithTags("sleep", []string{builtinTag}, builtinSleep)
+	r.RegisterFunctionWithTags("steps_table", []string{builtinTag}, builtinStepsTable)
+	r.RegisterFunctionWithTags("fake", []string{builtinTag}, builtinFake)
+}
+
+// builtinTag marks functions every BaseRegistry provides, so a
+// CompositeRegistry does not treat them as collisions between plugins.
+const builtinTag = "builtin"
+
+// withRequiredParams wraps an assertion so that it fails with an explicit
+// "invalid params" result when a required param is missing or has the wrong
+// type, instead of silently comparing against nil. Each spec is a param name,
+// optionally followed by ":string", ":number", ":boolean", ":array" or
+// ":object"; a name ending in "?" marks the param optional, so only its type
+// is checked when it is set. A present null satisfies an untyped spec.
+func withRequiredParams(fn func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult, specs ...string) func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	parsed := parseParamSpecs(specs)
+	return func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+		for _, param := range parsed {
+			value, present := params[param.Name]
+			if !present && param.Required {
+				return AssertionResult{
+					Success: false,
+					Message: fmt.Sprintf("invalid params: missing required param %q", param.Name),
+				}
+			}
+			if !present || (value == nil && !param.Required) {
+				continue
+			}
+			if param.Type != "" && !hasKind(value, param.Type) {
+				return AssertionResult{
+					Success: false,
+					Message: fmt.Sprintf("invalid params: %s must be a %s, got %T", param.Name, param.Type, value),
+					Actual:  params["actual"],
+				}
+			}
+		}
+		return fn(params, ctx)
+	}
+}
+
+func parseParamSpecs(specs []string) []AssertionParam {
+	params := make([]AssertionParam, 0, len(specs))
+	for _, spec := range specs {
+		name, kind, _ := strings.Cut(spec, ":")
+		optional := strings.HasSuffix(name, "?")
+		params = append(params, AssertionParam{
+			Name:     strings.TrimSuffix(name, "?"),
+			Type:     kind,
+			Required: !optional,
+		})
+	}
+	return params
+}
+
+func hasKind(v interface{}, kind string) bool {
+	switch kind {
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := toFloat(v)
+		return ok
+	case "array":
+		_, ok := toSlice(v)
+		return ok
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	}
+	return true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// looseEqual compares the %v renderings of a and b, so "2" equals 2. It is
+// the comparison equals used before deepEqual and stays available through
+// the loose param.
+func looseEqual(a, b interface{}) bool {
+	return fmt.Sprintf("%v", a) == fmt.Sprintf("%v", b)
+}
+
+func deepEqual(a, b interface{}) bool {
+	if af, ok := toFloat(a); ok {
+		bf, ok := toFloat(b)
+		return ok && af == bf
+	}
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	av, bv := reflect.ValueOf(a), reflect.ValueOf(b)
+	switch av.Kind() {
+	case reflect.Slice, reflect.Array:
+		if bv.Kind() != reflect.Slice && bv.Kind() != reflect.Array {
+			return false
+		}
+		if av.Len() != bv.Len() {
+			return false
+		}
+		for i := 0; i < av.Len(); i++ {
+			if !deepEqual(av.Index(i).Interface(), bv.Index(i).Interface()) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if bv.Kind() != reflect.Map || av.Len() != bv.Len() {
+			return false
+		}
+		if av.Type().Key().Kind() != reflect.String || bv.Type().Key().Kind() != reflect.String {
+			return reflect.DeepEqual(a, b)
+		}
+		for _, key := range av.MapKeys() {
+			other := bv.MapIndex(reflect.ValueOf(key.String()).Convert(bv.Type().Key()))
+			if !other.IsValid() || !deepEqual(av.MapIndex(key).Interface(), other.Interface()) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toSlice(v interface{}) ([]interface{}, bool) {
+	if items, ok := v.([]interface{}); ok {
+		return items, true
+	}
+	if v == nil {
+		return nil, false
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	items := make([]interface{}, rv.Len())
+	for i := range items {
+		items[i] = rv.Index(i).Interface()
+	}
+	return items, true
+}
+
+func containsMember(items []interface{}, member interface{}) bool {
+	for _, item := range items {
+		if deepEqual(item, member) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTruthy reports whether v counts as true:
+//
+//	nil                    false
+//	bool                   its value
+//	string                 non-empty
+//	number                 non-zero
+//	slice, array, map      non-empty
+//	nil pointer/interface  false
+//	anything else          true
+func isTruthy(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	if s, ok := v.(string); ok {
+		return s != ""
+	}
+	if n, ok := toFloat(v); ok {
+		return n != 0
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return rv.Len() > 0
+	case reflect.Ptr, reflect.Interface:
+		return !rv.IsNil()
+	}
+	return true
+}
+
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+func parseTimestamp(v interface{}) (time.Time, error) {
+	if ms, ok := toFloat(v); ok {
+		return time.UnixMilli(int64(ms)), nil
+	}
+	str, ok := v.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("expected an ISO timestamp or epoch milliseconds, got %T", v)
+	}
+	str = strings.TrimSpace(str)
+	if ms, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, str); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unparseable timestamp: %q", str)
+}
+
+// isEmpty reports whether v is nil, an empty string, or an empty slice,
+// array or map. Numbers and booleans are never empty, including 0 and false.
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	if s, ok := v.(string); ok {
+		return s == ""
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return rv.Len() == 0
+	}
+	return false
+}
+
+func compileRegex(pattern, flags string) (*regexp.Regexp, error) {
+	for _, f := range flags {
+		if !strings.ContainsRune("imsU", f) {
+			return nil, fmt.Errorf("unsupported regex flag: %c", f)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+func assertRegexMatch(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	actual, ok := params["actual"].(string)
+	if !ok {
+		return AssertionResult{
+			Success: false,
+			Message: fmt.Sprintf("invalid params: actual must be a string, got %T", params["actual"]),
+			Actual:  params["actual"],
+		}
+	}
+	pattern, _ := params["pattern"].(string)
+	flags, _ := params["flags"].(string)
+
+	re, err := compileRegex(pattern, flags)
+	if err != nil {
+		return AssertionResult{
+			Success:  false,
+			Message:  fmt.Sprintf("invalid params: invalid pattern: %v", err),
+			Actual:   actual,
+			Expected: pattern,
+		}
+	}
+
+	if !re.MatchString(actual) {
+		return AssertionResult{
+			Success:  false,
+			Message:  fmt.Sprintf("%q does not match pattern %q", actual, pattern),
+			Actual:   actual,
+			Expected: pattern,
+		}
+	}
+
+	return AssertionResult{
+		Success:  true,
+		Actual:   actual,
+		Expected: pattern,
+	}
+}
+
+func assertRegexCapture(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	actual, ok := params["actual"].(string)
+	if !ok {
+		return AssertionResult{
+			Success: false,
+			Message: fmt.Sprintf("invalid params: actual must be a string, got %T", params["actual"]),
+			Actual:  params["actual"],
+		}
+	}
+	expected, ok := params["expected"].(map[string]interface{})
+	if !ok {
+		return AssertionResult{
+			Success: false,
+			Message: fmt.Sprintf("invalid params: expected must be an object of group to value, got %T", params["expected"]),
+			Actual:  actual,
+		}
+	}
+	pattern, _ := params["pattern"].(string)
+	flags, _ := params["flags"].(string)
+
+	re, err := compileRegex(pattern, flags)
+	if err != nil {
+		return AssertionResult{
+			Success:  false,
+			Message:  fmt.Sprintf("invalid params: invalid pattern: %v", err),
+			Actual:   actual,
+			Expected: expected,
+		}
+	}
+
+	match := re.FindStringSubmatch(actual)
+	if match == nil {
+		return AssertionResult{
+			Success:  false,
+			Message:  fmt.Sprintf("%q does not match pattern %q", actual, pattern),
+			Actual:   actual,
+			Expected: expected,
+		}
+	}
+
+	captured := make(map[string]interface{}, len(expected))
+	var mismatches []string
+	for group, want := range expected {
+		index, err := strconv.Atoi(group)
+		if err != nil {
+			index = re.SubexpIndex(group)
+		}
+		if index < 0 || index >= len(match) {
+			mismatches = append(mismatches, fmt.Sprintf("group %s does not exist", group))
+			continue
+		}
+		captured[group] = match[index]
+		if match[index] != fmt.Sprintf("%v", want) {
+			mismatches = append(mismatches, fmt.Sprintf("group %s: expected %v but got %q", group, want, match[index]))
+		}
+	}
+
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return AssertionResult{
+			Success:  false,
+			Message:  strings.Join(mismatches, "; "),
+			Actual:   captured,
+			Expected: expected,
+		}
+	}
+
+	return AssertionResult{
+		Success:  true,
+		Actual:   captured,
+		Expected: expected,
+	}
+}
+
+func assertInRange(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	actual, ok := toFloat(params["actual"])
+	if !ok {
+		return AssertionResult{
+			Success: false,
+			Message: fmt.Sprintf("invalid params: actual must be a number, got %T", params["actual"]),
+			Actual:  params["actual"],
+		}
+	}
+	min, ok := toFloat(params["min"])
+	if !ok {
+		return AssertionResult{
+			Success: false,
+			Message: fmt.Sprintf("invalid params: min must be a number, got %T", params["min"]),
+		}
+	}
+	max, ok := toFloat(params["max"])
+	if !ok {
+		return AssertionResult{
+			Success: false,
+			Message: fmt.Sprintf("invalid params: max must be a number, got %T", params["max"]),
+		}
+	}
+
+	expected := fmt.Sprintf("[%v, %v]", min, max)
+	if actual < min || actual > max {
+		return AssertionResult{
+			Success:  false,
+			Message:  fmt.Sprintf("%v is outside the range %s", actual, expected),
+			Actual:   actual,
+			Expected: expected,
+		}
+	}
+
+	return AssertionResult{
+		Success:  true,
+		Actual:   actual,
+		Expected: expected,
+	}
+}
+
+func membershipParams(params map[string]interface{}) ([]interface{}, []interface{}, *AssertionResult) {
+	actual, ok := toSlice(params["actual"])
+	if !ok {
+		return nil, nil, &AssertionResult{
+			Success: false,
+			Message: fmt.Sprintf("invalid params: actual must be an array, got %T", params["actual"]),
+			Actual:  params["actual"],
+		}
+	}
+	expected, ok := toSlice(params["expected"])
+	if !ok {
+		return nil, nil, &AssertionResult{
+			Success: false,
+			Message: fmt.Sprintf("invalid params: expected must be an array, got %T", params["expected"]),
+			Actual:  params["actual"],
+		}
+	}
+	return actual, expected, nil
+}
+
+func assertContainsAll(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	actual, expected, invalid := membershipParams(params)
+	if invalid != nil {
+		return *invalid
+	}
+
+	missing := make([]interface{}, 0)
+	for _, member := range expected {
+		if !containsMember(actual, member) {
+			missing = append(missing, member)
+		}
+	}
+	if len(missing) > 0 {
+		return AssertionResult{
+			Success:  false,
+			Message:  fmt.Sprintf("missing members: %v", missing),
+			Actual:   actual,
+			Expected: expected,
+		}
+	}
+
+	return AssertionResult{
+		Success:  true,
+		Actual:   actual,
+		Expected: expected,
+	}
+}
+
+func assertContainsSubset(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	actual := params["actual"].(map[string]interface{})
+	expected := params["expected"].(map[string]interface{})
+
+	mismatches := subsetMismatches("$", actual, expected)
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return AssertionResult{
+			Success:  false,
+			Message:  strings.Join(mismatches, "; "),
+			Actual:   actual,
+			Expected: expected,
+		}
+	}
+	return AssertionResult{Success: true, Actual: actual, Expected: expected}
+}
+
+// subsetMismatches describes each key of expected that actual lacks or
+// holds a different value for. Where both values are objects it recurses,
+// so extra keys are ignored at every level; other values must deep-equal.
+func subsetMismatches(path string, actual, expected map[string]interface{}) []string {
+	var mismatches []string
+	for key, want := range expected {
+		keyPath := path + "." + key
+		got, present := actual[key]
+		if !present {
+			mismatches = append(mismatches, fmt.Sprintf("%s: missing", keyPath))
+			continue
+		}
+		wantMap, wantIsMap := want.(map[string]interface{})
+		gotMap, gotIsMap := got.(map[string]interface{})
+		if wantIsMap && gotIsMap {
+			mismatches = append(mismatches, subsetMismatches(keyPath, gotMap, wantMap)...)
+			continue
+		}
+		if !deepEqual(got, want) {
+			mismatches = append(mismatches, fmt.Sprintf("%s: expected %v but got %v", keyPath, want, got))
+		}
+	}
+	return mismatches
+}
+
+func assertContainsAny(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	actual, expected, invalid := membershipParams(params)
+	if invalid != nil {
+		return *invalid
+	}
+
+	for _, member := range expected {
+		if containsMember(actual, member) {
+			return AssertionResult{
+				Success:  true,
+				Actual:   actual,
+				Expected: expected,
+			}
+		}
+	}
+
+	return AssertionResult{
+		Success:  false,
+		Message:  fmt.Sprintf("none of the expected members are present, missing: %v", expected),
+		Actual:   actual,
+		Expected: expected,
+	}
+}
+
+func assertTimestampOrder(name string) func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	return func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+		resolved, err := resolveRefs(params, ctx)
+		if err != nil {
+			return AssertionResult{Success: false, Message: err.Error()}
+		}
+		params, ok := resolved.(map[string]interface{})
+		if !ok {
+			return AssertionResult{Success: false, Message: fmt.Sprintf("invalid params: params must resolve to an object, got %T", resolved)}
+		}
+
+		actual, err := parseTimestamp(params["actual"])
+		if err != nil {
+			return AssertionResult{Success: false, Message: fmt.Sprintf("invalid params: actual: %v", err), Actual: params["actual"]}
+		}
+		expected, err := parseTimestamp(params["expected"])
+		if err != nil {
+			return AssertionResult{Success: false, Message: fmt.Sprintf("invalid params: expected: %v", err), Expected: params["expected"]}
+		}
+
+		success := actual.Before(expected)
+		relation := "before"
+		if name == "is_after" {
+			success = actual.After(expected)
+			relation = "after"
+		}
+
+		result := AssertionResult{
+			Success:  success,
+			Actual:   actual.Format(time.RFC3339Nano),
+			Expected: expected.Format(time.RFC3339Nano),
+		}
+		if !success {
+			result.Message = fmt.Sprintf("expected %s to be %s %s", result.Actual, relation, result.Expected)
+		}
+		return result
+	}
+}
+
+func assertIsRecent(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	actual, err := parseTimestamp(params["actual"])
+	if err != nil {
+		return AssertionResult{Success: false, Message: fmt.Sprintf("invalid params: actual: %v", err), Actual: params["actual"]}
+	}
+	withinMs, _ := toFloat(params["withinMs"])
+	if withinMs < 0 {
+		return AssertionResult{Success: false, Message: "invalid params: withinMs must not be negative"}
+	}
+
+	now := ctx.Now()
+	delta := now.Sub(actual)
+	if delta < 0 {
+		delta = -delta
+	}
+	result := AssertionResult{
+		Success:  delta <= time.Duration(withinMs*float64(time.Millisecond)),
+		Actual:   actual.Format(time.RFC3339Nano),
+		Expected: now.Format(time.RFC3339Nano),
+	}
+	if !result.Success {
+		result.Message = fmt.Sprintf("expected %s to be within %vms of %s, but it is %dms away", result.Actual, withinMs, result.Expected, delta.Milliseconds())
+	}
+	return result
+}
+
+func assertTruthiness(want bool) func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	return func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+		actual := params["actual"]
+		if isTruthy(actual) == want {
+			return AssertionResult{Success: true, Actual: actual, Expected: want}
+		}
+		expected := "truthy"
+		if !want {
+			expected = "falsy"
+		}
+		return AssertionResult{
+			Success:  false,
+			Message:  fmt.Sprintf("expected %v to be %s", actual, expected),
+			Actual:   actual,
+			Expected: want,
+		}
+	}
+}
+
+func assertEmptiness(wantEmpty bool) func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	return func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+		actual := params["actual"]
+		if isEmpty(actual) == wantEmpty {
+			return AssertionResult{Success: true, Actual: actual}
+		}
+		message := fmt.Sprintf("expected %v to be empty", actual)
+		if !wantEmpty {
+			message = "expected a non-empty value"
+		}
+		return AssertionResult{Success: false, Message: message, Actual: actual}
+	}
+}
+
+func assertKeyAbsent(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	key := params["key"].(string)
+	if !ctx.Has(key) {
+		return AssertionResult{Success: true}
+	}
+	actual := ctx.Get(key)
+	return AssertionResult{
+		Success: false,
+		Message: fmt.Sprintf("expected context key %q to be absent, but it is set to %v", key, actual),
+		Actual:  actual,
+	}
+}
+
+func assertJSONEqualsIgnoring(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	var ignore []string
+	if raw, present := params["ignore"]; present && raw != nil {
+		paths, ok := toSlice(raw)
+		if !ok {
+			return AssertionResult{
+				Success: false,
+				Message: fmt.Sprintf("invalid params: ignore must be an array of key paths, got %T", raw),
+			}
+		}
+		for _, path := range paths {
+			str, ok := path.(string)
+			if !ok {
+				return AssertionResult{
+					Success: false,
+					Message: fmt.Sprintf("invalid params: ignore entries must be strings, got %T", path),
+				}
+			}
+			ignore = append(ignore, str)
+		}
+	}
+
+	actual := deepCopy(params["actual"])
+	expected := deepCopy(params["expected"])
+	for _, path := range ignore {
+		parts := strings.Split(path, ".")
+		actual = deletePath(actual, parts)
+		expected = deletePath(expected, parts)
+	}
+
+	if deepEqual(actual, expected) {
+		return AssertionResult{Success: true, Actual: actual, Expected: expected}
+	}
+	return AssertionResult{
+		Success:  false,
+		Message:  fmt.Sprintf("expected %v to equal %v (ignoring %v)", actual, expected, ignore),
+		Actual:   actual,
+		Expected: expected,
+	}
+}
+
+// deletePath removes the key at the dotted path from v. Arrays along the path
+// are traversed element-wise, so "items.id" drops id from every item.
+func deletePath(v interface{}, parts []string) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if len(parts) == 1 {
+			delete(val, parts[0])
+		} else if child, ok := val[parts[0]]; ok {
+			val[parts[0]] = deletePath(child, parts[1:])
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = deletePath(item, parts)
+		}
+	}
+	return v
+}
+
+// deltaOperand resolves a delta_equals operand: strings name a context key
+// or ref, {"$ctx": ...} objects are resolved as usual, and numeric strings
+// (as step outputs usually are) are parsed.
+func deltaOperand(name string, raw interface{}, ctx *ReadOnlyContext) (float64, error) {
+	value, err := resolveRefs(raw, ctx)
+	if err != nil {
+		return 0, err
+	}
+	if ref, ok := value.(string); ok {
+		resolved, found := ctx.Resolve(ref)
+		if !found {
+			return 0, fmt.Errorf("invalid params: %s: unresolvable context reference: %s", name, ref)
+		}
+		value = resolved
+	}
+	if n, ok := toFloat(value); ok {
+		return n, nil
+	}
+	if str, ok := value.(string); ok {
+		if n, err := strconv.ParseFloat(strings.TrimSpace(str), 64); err == nil {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid params: %s must resolve to a number, got %v", name, value)
+}
+
+func assertDeltaEquals(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	left, err := deltaOperand("left", params["left"], ctx)
+	if err != nil {
+		return AssertionResult{Success: false, Message: err.Error()}
+	}
+	right, err := deltaOperand("right", params["right"], ctx)
+	if err != nil {
+		return AssertionResult{Success: false, Message: err.Error()}
+	}
+	expected, ok := toFloat(params["expected"])
+	if !ok {
+		return AssertionResult{
+			Success: false,
+			Message: fmt.Sprintf("invalid params: expected must be a number, got %T", params["expected"]),
+		}
+	}
+	tolerance := 0.0
+	if raw, present := params["tolerance"]; present && raw != nil {
+		tolerance, ok = toFloat(raw)
+		if !ok || tolerance < 0 {
+			return AssertionResult{
+				Success: false,
+				Message: fmt.Sprintf("invalid params: tolerance must be a non-negative number, got %v", raw),
+			}
+		}
+	}
+
+	delta := right - left
+	if math.Abs(delta-expected) > tolerance {
+		return AssertionResult{
+			Success:  false,
+			Message:  fmt.Sprintf("expected delta %v (±%v), got %v (%v -> %v)", expected, tolerance, delta, left, right),
+			Actual:   delta,
+			Expected: expected,
+		}
+	}
+	return AssertionResult{Success: true, Actual: delta, Expected: expected}
+}
+
+func builtinTransform(args map[string]interface{}, ctx *Context) (interface{}, error) {
+	op, ok := args["op"].(string)
+	if !ok {
+		return nil, fmt.Errorf("transform: op must be a string, got %T", args["op"])
+	}
+	value := args["value"]
+
+	if op == "json_stringify" {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("transform: json_stringify: %v", err)
+		}
+		return string(data), nil
+	}
+
+	str, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("transform: %s requires a string value, got %T", op, value)
+	}
+	switch op {
+	case "upper":
+		return strings.ToUpper(str), nil
+	case "lower":
+		return strings.ToLower(str), nil
+	case "trim":
+		return strings.TrimSpace(str), nil
+	case "json_parse":
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(str), &parsed); err != nil {
+			return nil, fmt.Errorf("transform: json_parse: %v", err)
+		}
+		return parsed, nil
+	case "base64_encode":
+		return base64.StdEncoding.EncodeToString([]byte(str)), nil
+	case "base64_decode":
+		decoded, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return nil, fmt.Errorf("transform: base64_decode: %v", err)
+		}
+		return string(decoded), nil
+	}
+	return nil, fmt.Errorf("transform: unknown op %q (want upper, lower, trim, json_parse, json_stringify, base64_encode or base64_decode)", op)
+}
+
+// maxRealSleep bounds a sleep on the real clock, which holds up every
+// request queued behind the fn.call.
+const maxRealSleep = 5 * time.Minute
+
+// builtinSleep waits for args["ms"]. Under a mocked clock it returns at once
+// and advances virtual time instead, so time-dependent tests stay instant. A
+// real sleep longer than maxRealSleep, or one that would run past the run
+// deadline, fails straight away instead of stalling the bridge.
+func builtinSleep(args map[string]interface{}, ctx *Context) (interface{}, error) {
+	ms, ok := toFloat(args["ms"])
+	if !ok || ms < 0 {
+		return nil, fmt.Errorf("sleep: ms must be a non-negative number, got %v", args["ms"])
+	}
+	d := time.Duration(ms * float64(time.Millisecond))
+
+	if now, advanced := ctx.AdvanceClock(d); advanced {
+		return map[string]interface{}{"now_ms": now.UnixMilli(), "virtual": true}, nil
+	}
+	if ms > float64(maxRealSleep.Milliseconds()) {
+		return nil, fmt.Errorf("sleep: ms must be at most %d on a real clock, got %v", maxRealSleep.Milliseconds(), ms)
+	}
+	if remaining, ok := ctx.TimeRemaining(); ok && d > remaining {
+		return nil, newBridgeError(CodeDeadlineExceeded, "sleep: %v would run past the run deadline (%v left)", d, remaining.Round(time.Millisecond))
+	}
+	time.Sleep(d)
+	return map[string]interface{}{"now_ms": ctx.Now().UnixMilli(), "virtual": false}, nil
+}
+
+func builtinStepsTable(args map[string]interface{}, ctx *Context) (interface{}, error) {
+	pattern := "*"
+	if raw, present := args["pattern"]; present && raw != nil {
+		str, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("steps_table: pattern must be a string, got %T", raw)
+		}
+		pattern = str
+	}
+	return ctx.StepsTable(pattern), nil
+}
+
+func assertMatchesSchema(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	actual := params["actual"]
+	schema := params["schema"].(map[string]interface{})
+
+	violations := validateSchema(actual, schema)
+	if len(violations) > 0 {
+		return AssertionResult{
+			Success:  false,
+			Message:  fmt.Sprintf("schema violations: %s", strings.Join(violations, "; ")),
+			Actual:   violations,
+			Expected: schema,
+		}
+	}
+	return AssertionResult{Success: true, Actual: actual, Expected: schema}
+}
+
+// assertQuantified runs the nested assertion {"name": ..., "params": {...}}
+// once per element of actual, passing the element (or its value at the
+// dotted path, nil when absent) as the nested "actual". With all set it fails
+// at the first element that does not pass; otherwise it passes at the first
+// one that does. The nested assertion goes through the server when there is
+// one, so it may name an assertion from any loaded plugin; r is only the
+// fallback for a Context used on its own.
+func assertQuantified(r *BaseRegistry, all bool) func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+	return func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+		items, _ := toSlice(params["actual"])
+		spec := params["assertion"].(map[string]interface{})
+		name, ok := spec["name"].(string)
+		if !ok {
+			return AssertionResult{Success: false, Message: fmt.Sprintf("invalid params: assertion.name must be a string, got %T", spec["name"])}
+		}
+		nested, ok := spec["params"].(map[string]interface{})
+		if !ok && spec["params"] != nil {
+			return AssertionResult{Success: false, Message: fmt.Sprintf("invalid params: assertion.params must be an object, got %T", spec["params"])}
+		}
+		path, _ := params["path"].(string)
+
+		for i, item := range items {
+			value := item
+			if path != "" {
+				value, _ = valueAtPath(item, path)
+			}
+			elementParams := make(map[string]interface{}, len(nested)+1)
+			for k, v := range nested {
+				elementParams[k] = deepCopy(v)
+			}
+			elementParams["actual"] = value
+
+			result := ctx.callAssertion(r, name, elementParams)
+			if all && !result.Success {
+				return AssertionResult{
+					Success: false,
+					Message: fmt.Sprintf("element %d failed %s: %s", i, name, result.Message),
+					Actual:  item,
+				}
+			}
+			if !all && result.Success {
+				return AssertionResult{Success: true, Message: fmt.Sprintf("element %d passed %s", i, name), Actual: item}
+			}
+		}
+		if all {
+			return AssertionResult{Success: true}
+		}
+		return AssertionResult{
+			Success: false,
+			Message: fmt.Sprintf("none of the %d elements passed %s", len(items), name),
+			Actual:  params["actual"],
+		}
+	}
+}
+
+// valueAtPath follows a dotted path of map keys into value.
+func valueAtPath(value interface{}, path string) (interface{}, bool) {
+	for _, segment := range strings.Split(path, ".") {
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = nested[segment]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSleepAdvancesFrozenClockInstantly(t *testing.T) {
+	r := NewBaseRegistry()
+	ctx := NewContext()
+	ms := int64(1000)
+	ctx.Clock = &ClockState{VirtualTimeMs: &ms, Frozen: true}
+
+	start := time.Now()
+	result, err := r.Call("sleep", map[string]interface{}{"ms": 60000.0}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("frozen-clock sleep took %v", elapsed)
+	}
+	got := result.(map[string]interface{})
+	if got["now_ms"] != int64(61000) || got["virtual"] != true {
+		t.Fatalf("sleep = %v, want now_ms 61000 and virtual", got)
+	}
+	if now := ctx.Now().UnixMilli(); now != 61000 {
+		t.Fatalf("virtual time = %d, want 61000", now)
+	}
+}
+
+func TestSleepWaitsOnRealClock(t *testing.T) {
+	r := NewBaseRegistry()
+	start := time.Now()
+	result, err := r.Call("sleep", map[string]interface{}{"ms": 30.0}, NewContext())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("sleep returned after %v, want at least 30ms", elapsed)
+	}
+	if result.(map[string]interface{})["virtual"] != false {
+		t.Fatalf("sleep = %v, want virtual false", result)
+	}
+}
+
+func TestSleepRejectsUnboundedRealSleeps(t *testing.T) {
+	r := NewBaseRegistry()
+	start := time.Now()
+	if _, err := r.Call("sleep", map[string]interface{}{"ms": float64(maxRealSleep.Milliseconds() + 1)}, NewContext()); err == nil {
+		t.Fatal("expected an error for a sleep over maxRealSleep")
+	}
+
+	ctx := NewContext()
+	ctx.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := r.Call("sleep", map[string]interface{}{"ms": 10000.0}, ctx)
+	if errorCode(err) != CodeDeadlineExceeded {
+		t.Fatalf("err = %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("rejected sleeps took %v", elapsed)
+	}
+}
+
+func TestAllMatchResolvesNestedAssertionFromAnotherPlugin(t *testing.T) {
+	first := NewBaseRegistry()
+	second := NewBaseRegistry()
+	second.RegisterAssertionWithSchema("is_even", "actual is even", []string{"actual:number"},
+		func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+			return AssertionResult{Success: int(params["actual"].(float64))%2 == 0}
+		})
+	composite, err := NewCompositeRegistry(OverrideError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := composite.Add("first", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := composite.Add("second", second); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(composite)
+
+	for _, tc := range []struct {
+		actual []interface{}
+		want   bool
+	}{
+		{[]interface{}{2.0, 4.0}, true},
+		{[]interface{}{2.0, 3.0}, false},
+	} {
+		result, err := s.handleAssertCustom(map[string]interface{}{
+			"name": "all_match",
+			"params": map[string]interface{}{
+				"actual":    tc.actual,
+				"assertion": map[string]interface{}{"name": "is_even"},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := result.(AssertionResult); got.Success != tc.want {
+			t.Fatalf("all_match is_even over %v = %+v, want success %v", tc.actual, got, tc.want)
+		}
+	}
+}
+
+func TestAnyMatchAppliesLooseEqualsToNestedAssertion(t *testing.T) {
+	r := NewBaseRegistry()
+	var sawLoose bool
+	r.RegisterAssertionWithSchema("loose_equal", "actual equals expected", []string{"actual", "expected", "loose?:boolean"},
+		func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+			sawLoose, _ = params["loose"].(bool)
+			return AssertionResult{Success: sawLoose}
+		})
+	s := NewServer(r)
+	s.looseEquals = true
+
+	result, err := s.handleAssertCustom(map[string]interface{}{
+		"name": "any_match",
+		"params": map[string]interface{}{
+			"actual": []interface{}{"1"},
+			"assertion": map[string]interface{}{
+				"name":   "loose_equal",
+				"params": map[string]interface{}{"expected": 1.0},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sawLoose || !result.(AssertionResult).Success {
+		t.Fatalf("nested assertion did not see --loose-equals: %+v", result)
+	}
+}
+
+// assertBuiltin runs a builtin assertion against a fresh context.
+func assertBuiltin(name string, params map[string]interface{}) AssertionResult {
+	return NewBaseRegistry().CallAssertion(name, params, NewContext())
+}
+
+func TestBuiltinAssertionsRejectMissingParams(t *testing.T) {
+	r := NewBaseRegistry()
+	for _, name := range []string{
+		"regex_match", "regex_capture", "in_range", "contains_all", "contains_any",
+		"is_before", "is_after", "is_true", "is_false", "is_empty", "is_not_empty",
+		"key_absent", "contains_subset", "json_equals_ignoring", "delta_equals",
+	} {
+		result := r.CallAssertion(name, map[string]interface{}{}, NewContext())
+		if result.Success || !strings.HasPrefix(result.Message, "invalid params: missing required param") {
+			t.Errorf("%s with no params = %+v, want a missing param failure", name, result)
+		}
+	}
+	result := assertBuiltin("regex_match", map[string]interface{}{"actual": "a", "pattern": 1.0})
+	if result.Message != "invalid params: pattern must be a string, got float64" {
+		t.Fatalf("wrong-typed pattern: %q", result.Message)
+	}
+	if result := assertBuiltin("is_empty", map[string]interface{}{"actual": nil}); !result.Success {
+		t.Fatalf("a present null should satisfy an untyped param: %s", result.Message)
+	}
+}
+
+func TestRegexMatch(t *testing.T) {
+	tests := []struct {
+		actual, pattern, flags string
+		want                   bool
+	}{
+		{"Hello 42", `\d+`, "", true},
+		{"Hello", `^h`, "", false},
+		{"Hello", `^h`, "i", true},
+		{"Hello", `(`, "", false},
+	}
+	for _, tt := range tests {
+		params := map[string]interface{}{"actual": tt.actual, "pattern": tt.pattern}
+		if tt.flags != "" {
+			params["flags"] = tt.flags
+		}
+		if got := assertBuiltin("regex_match", params); got.Success != tt.want {
+			t.Errorf("regex_match %q against %q (flags %q) = %+v, want %v", tt.pattern, tt.actual, tt.flags, got, tt.want)
+		}
+	}
+}
+
+func TestRegexCapture(t *testing.T) {
+	capture := func(actual string, expected map[string]interface{}) AssertionResult {
+		return assertBuiltin("regex_capture", map[string]interface{}{
+			"actual": actual, "pattern": `v(?P<major>\d+)\.(\d+)`, "expected": expected,
+		})
+	}
+	if result := capture("app v1.2.3", map[string]interface{}{"major": 1.0, "2": "2"}); !result.Success {
+		t.Fatalf("named and numbered groups: %s", result.Message)
+	}
+	if result := capture("app v1.2.3", map[string]interface{}{"major": "2"}); result.Success {
+		t.Fatal("a wrong group value passed")
+	}
+	if result := capture("app v1.2.3", map[string]interface{}{"9": "x"}); result.Success {
+		t.Fatal("a group the pattern does not have passed")
+	}
+	if result := capture("nothing", map[string]interface{}{"major": "1"}); result.Success {
+		t.Fatal("a pattern that does not match passed")
+	}
+}
+
+func TestDeepEqualComparesStructurally(t *testing.T) {
+	a := map[string]interface{}{"x": 1, "y": []interface{}{1.0, map[string]interface{}{"a": "b", "c": 2}}}
+	b := map[string]interface{}{"y": []interface{}{int64(1), map[string]interface{}{"c": 2.0, "a": "b"}}, "x": 1.0}
+	tests := []struct {
+		a, b interface{}
+		want bool
+	}{
+		{a, b, true},
+		{a, map[string]interface{}{"x": 1}, false},
+		{[]interface{}{1, 2}, []interface{}{2, 1}, false},
+		{[]string{"a"}, []interface{}{"a"}, true},
+		{map[string]string{"a": "b"}, map[string]interface{}{"a": "b"}, true},
+		{nil, nil, true},
+		{nil, 0, false},
+		{"1", 1, false},
+	}
+	for _, tt := range tests {
+		if got := deepEqual(tt.a, tt.b); got != tt.want {
+			t.Errorf("deepEqual(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestInRange(t *testing.T) {
+	for _, tt := range []struct {
+		actual interface{}
+		want   bool
+	}{
+		{200.0, true}, {299, true}, {250.5, true}, {199, false}, {300.0, false}, {"200", false},
+	} {
+		got := assertBuiltin("in_range", map[string]interface{}{"actual": tt.actual, "min": 200.0, "max": 299})
+		if got.Success != tt.want {
+			t.Errorf("in_range(%v, 200, 299) = %+v, want %v", tt.actual, got, tt.want)
+		}
+	}
+}
+
+func TestContainsAllAndAny(t *testing.T) {
+	actual := []interface{}{1.0, "b", map[string]interface{}{"id": 3}}
+	tests := []struct {
+		name     string
+		expected []interface{}
+		want     bool
+	}{
+		{"contains_all", []interface{}{"b", 1, map[string]interface{}{"id": 3.0}}, true},
+		{"contains_all", []interface{}{"b", "z"}, false},
+		{"contains_all", []interface{}{}, true},
+		{"contains_any", []interface{}{"z", "b"}, true},
+		{"contains_any", []interface{}{"z"}, false},
+		{"contains_any", []interface{}{}, false},
+	}
+	for _, tt := range tests {
+		got := assertBuiltin(tt.name, map[string]interface{}{"actual": actual, "expected": tt.expected})
+		if got.Success != tt.want {
+			t.Errorf("%s %v = %+v, want %v", tt.name, tt.expected, got, tt.want)
+		}
+	}
+}
+
+func TestTimestampOrder(t *testing.T) {
+	r := NewBaseRegistry()
+	ctx := NewContext()
+	ctx.Set("u", map[string]interface{}{"created_at": "2024-01-01T00:00:00Z", "updated_at": 1704067201000.0})
+	created := map[string]interface{}{"$ctx": "u.created_at"}
+	updated := map[string]interface{}{"$ctx": "u.updated_at"}
+	tests := []struct {
+		name             string
+		actual, expected interface{}
+		want             bool
+	}{
+		{"is_before", created, updated, true},
+		{"is_before", updated, created, false},
+		{"is_after", updated, created, true},
+		{"is_before", created, created, false},
+		{"is_after", created, created, false},
+		{"is_before", "1704067200000", "2024-01-02", true},
+		{"is_before", "garbage", created, false},
+	}
+	for _, tt := range tests {
+		got := r.CallAssertion(tt.name, map[string]interface{}{"actual": tt.actual, "expected": tt.expected}, ctx)
+		if got.Success != tt.want {
+			t.Errorf("%s(%v, %v) = %+v, want %v", tt.name, tt.actual, tt.expected, got, tt.want)
+		}
+	}
+}
+
+func TestTimestampOrderRejectsParamsRefToNonObject(t *testing.T) {
+	ctx := NewContext()
+	ctx.Set("ts", "2024-01-01T00:00:00Z")
+	got := assertTimestampOrder("is_before")(map[string]interface{}{"$ctx": "ts"}, ctx.ReadOnly())
+	if got.Success || !strings.Contains(got.Message, "must resolve to an object") {
+		t.Fatalf("is_before with params resolving to a string = %+v", got)
+	}
+}
+
+func TestTruthiness(t *testing.T) {
+	truthy := []interface{}{true, "x", 1.0, -1, []interface{}{1}, map[string]interface{}{"a": 1}}
+	falsy := []interface{}{false, "", 0.0, nil, []interface{}{}, map[string]interface{}{}}
+	for _, v := range truthy {
+		if !assertBuiltin("is_true", map[string]interface{}{"actual": v}).Success || assertBuiltin("is_false", map[string]interface{}{"actual": v}).Success {
+			t.Errorf("%#v should be truthy", v)
+		}
+	}
+	for _, v := range falsy {
+		if assertBuiltin("is_true", map[string]interface{}{"actual": v}).Success || !assertBuiltin("is_false", map[string]interface{}{"actual": v}).Success {
+			t.Errorf("%#v should be falsy", v)
+		}
+	}
+}
+
+func TestEmptiness(t *testing.T) {
+	empty := []interface{}{nil, "", []interface{}{}, map[string]interface{}{}}
+	notEmpty := []interface{}{"a", []interface{}{1}, map[string]interface{}{"a": 1}, 0.0, false}
+	for _, v := range empty {
+		if !assertBuiltin("is_empty", map[string]interface{}{"actual": v}).Success || assertBuiltin("is_not_empty", map[string]interface{}{"actual": v}).Success {
+			t.Errorf("%#v should be empty", v)
+		}
+	}
+	for _, v := range notEmpty {
+		if assertBuiltin("is_empty", map[string]interface{}{"actual": v}).Success || !assertBuiltin("is_not_empty", map[string]interface{}{"actual": v}).Success {
+			t.Errorf("%#v should not be empty", v)
+		}
+	}
+}
+
+func TestJSONEqualsIgnoring(t *testing.T) {
+	var params map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"actual": {"id": 1, "name": "a", "meta": {"created_at": "x", "v": 1}, "items": [{"id": 3, "n": 1}]},
+		"expected": {"id": 2, "name": "a", "meta": {"created_at": "y", "v": 1}, "items": [{"id": 4, "n": 1}]},
+		"ignore": ["id", "meta.created_at", "items.id"]
+	}`), &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := assertBuiltin("json_equals_ignoring", params); !result.Success {
+		t.Fatalf("differences only in ignored keys: %s", result.Message)
+	}
+	params["ignore"] = []interface{}{"id"}
+	if result := assertBuiltin("json_equals_ignoring", params); result.Success {
+		t.Fatal("a difference outside the ignored keys passed")
+	}
+}
+
+func TestDeltaEquals(t *testing.T) {
+	r := NewBaseRegistry()
+	ctx := NewContext()
+	ctx.Set("before", 500)
+	ctx.Set("after", "400")
+	delta := func(params map[string]interface{}) AssertionResult {
+		return r.CallAssertion("delta_equals", params, ctx)
+	}
+	if result := delta(map[string]interface{}{"left": "before", "right": "after", "expected": -100.0}); !result.Success {
+		t.Fatalf("exact delta: %s", result.Message)
+	}
+	if result := delta(map[string]interface{}{"left": "before", "right": "after", "expected": -90.0}); result.Success || result.Actual != -100.0 {
+		t.Fatalf("wrong delta = %+v, want a failure reporting -100", result)
+	}
+	if result := delta(map[string]interface{}{"left": "before", "right": "after", "expected": -90.0, "tolerance": 10.0}); !result.Success {
+		t.Fatalf("delta within tolerance: %s", result.Message)
+	}
+	if result := delta(map[string]interface{}{"left": "nope", "right": "after", "expected": 1.0}); result.Success {
+		t.Fatal("a missing key passed")
+	}
+}
+
+func TestKeyAbsent(t *testing.T) {
+	r := NewBaseRegistry()
+	ctx := NewContext()
+	params := map[string]interface{}{"key": "token"}
+	if result := r.CallAssertion("key_absent", params, ctx); !result.Success {
+		t.Fatalf("unset key: %s", result.Message)
+	}
+	ctx.Set("token", nil)
+	if result := r.CallAssertion("key_absent", params, ctx); result.Success {
+		t.Fatal("a key set to null counted as absent")
+	}
+	ctx.Set("token", "x")
+	if result := r.CallAssertion("key_absent", params, ctx); result.Success || result.Actual != "x" {
+		t.Fatalf("present key = %+v, want a failure reporting the value", result)
+	}
+}
+
+func TestContainsSubset(t *testing.T) {
+	actual := map[string]interface{}{
+		"id":    1.0,
+		"user":  map[string]interface{}{"name": "a", "role": "admin", "tags": []interface{}{"x"}},
+		"extra": true,
+	}
+	subset := func(expected interface{}) AssertionResult {
+		return assertBuiltin("contains_subset", map[string]interface{}{"actual": actual, "expected": expected})
+	}
+	if result := subset(map[string]interface{}{"id": 1, "user": map[string]interface{}{"role": "admin", "tags": []interface{}{"x"}}}); !result.Success {
+		t.Fatalf("nested subset: %s", result.Message)
+	}
+	if result := subset(map[string]interface{}{"user": map[string]interface{}{"email": "e"}}); result.Success || result.Message != "$.user.email: missing" {
+		t.Fatalf("missing key = %+v", result)
+	}
+	result := subset(map[string]interface{}{"id": 2.0, "user": map[string]interface{}{"name": "b"}})
+	if want := "$.id: expected 2 but got 1; $.user.name: expected b but got a"; result.Success || result.Message != want {
+		t.Fatalf("mismatches = %q, want %q", result.Message, want)
+	}
+	if result := subset(map[string]interface{}{"user": "a"}); result.Success {
+		t.Fatal("an object matched a string")
+	}
+}
+
+func TestIsRecent(t *testing.T) {
+	r := NewBaseRegistry()
+	ctx := NewContext()
+	recent := func(actual interface{}, withinMs float64) bool {
+		return r.CallAssertion("is_recent", map[string]interface{}{"actual": actual, "withinMs": withinMs}, ctx).Success
+	}
+	if !recent(time.Now().Add(-time.Second).Format(time.RFC3339Nano), 5000) {
+		t.Fatal("a timestamp a second ago is not within 5s of the real clock")
+	}
+	if recent(time.Now().Add(-time.Minute).Format(time.RFC3339), 5000) {
+		t.Fatal("a timestamp a minute ago is within 5s of the real clock")
+	}
+
+	ms := int64(1700000000000)
+	ctx.Clock = &ClockState{VirtualTimeMs: &ms, Frozen: true}
+	for _, tt := range []struct {
+		actual   interface{}
+		withinMs float64
+		want     bool
+	}{
+		{float64(ms - 1000), 1000, true},
+		{float64(ms - 1001), 1000, false},
+		{float64(ms + 1000), 1000, true},
+		{time.UnixMilli(ms - 500).UTC().Format(time.RFC3339Nano), 500, true},
+		{"1700000000000", 0, true},
+		{"garbage", 1, false},
+	} {
+		if got := recent(tt.actual, tt.withinMs); got != tt.want {
+			t.Errorf("is_recent(%v, %v) under a mocked clock = %v, want %v", tt.actual, tt.withinMs, got, tt.want)
+		}
+	}
+}
+
+func TestAllMatchAndAnyMatch(t *testing.T) {
+	items := []interface{}{
+		map[string]interface{}{"id": "a"},
+		map[string]interface{}{"id": ""},
+		map[string]interface{}{"id": "c"},
+	}
+	notEmpty := map[string]interface{}{"name": "is_not_empty"}
+	result := assertBuiltin("all_match", map[string]interface{}{"actual": items, "assertion": notEmpty, "path": "id"})
+	if result.Success || !strings.HasPrefix(result.Message, "element 1 ") {
+		t.Fatalf("all_match = %+v, want a failure at element 1", result)
+	}
+	if result := assertBuiltin("any_match", map[string]interface{}{"actual": items, "assertion": notEmpty, "path": "id"}); !result.Success {
+		t.Fatalf("any_match: %s", result.Message)
+	}
+	inRange := map[string]interface{}{"name": "in_range", "params": map[string]interface{}{"min": 0.0, "max": 10.0}}
+	if result := assertBuiltin("all_match", map[string]interface{}{"actual": []interface{}{1.0, 5.0}, "assertion": inRange}); !result.Success {
+		t.Fatalf("nested params: %s", result.Message)
+	}
+	outOfRange := assertBuiltin("any_match", map[string]interface{}{"actual": []interface{}{11.0, 12.0, 13.0}, "assertion": inRange})
+	if outOfRange.Success || !strings.Contains(outOfRange.Message, "none of the 3") {
+		t.Fatalf("any_match with no passing element = %+v", outOfRange)
+	}
+	if result := assertBuiltin("all_match", map[string]interface{}{"actual": items, "assertion": map[string]interface{}{}}); result.Success {
+		t.Fatal("an assertion spec without a name passed")
+	}
+}
+
+func TestTransform(t *testing.T) {
+	r := NewBaseRegistry()
+	tests := []struct {
+		op          string
+		value, want interface{}
+	}{
+		{"upper", "ab", "AB"},
+		{"lower", "AB", "ab"},
+		{"trim", " a ", "a"},
+		{"base64_encode", "hi", "aGk="},
+		{"base64_decode", "aGk=", "hi"},
+		{"json_stringify", []interface{}{1.0}, "[1]"},
+		{"json_parse", `{"a":1}`, map[string]interface{}{"a": 1}},
+	}
+	for _, tt := range tests {
+		got, err := r.Call("transform", map[string]interface{}{"op": tt.op, "value": tt.value}, NewContext())
+		if err != nil {
+			t.Errorf("transform %s: %v", tt.op, err)
+			continue
+		}
+		if !deepEqual(got, tt.want) {
+			t.Errorf("transform %s(%v) = %v, want %v", tt.op, tt.value, got, tt.want)
+		}
+	}
+	for _, args := range []map[string]interface{}{
+		{"op": "json_parse", "value": `{`},
+		{"op": "nope", "value": ""},
+	} {
+		if _, err := r.Call("transform", args, NewContext()); err == nil {
+			t.Errorf("transform %v should fail", args)
+		}
+	}
+}
+
+func TestStepsTable(t *testing.T) {
+	r := NewBaseRegistry()
+	ctx := NewContext()
+	for _, id := range []string{"test_b", "build", "test_a"} {
+		ctx.SetStepOutputs(id, map[string]interface{}{"id": id})
+	}
+	rows, err := r.Call("steps_table", map[string]interface{}{"pattern": "test_*"}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(rows)
+	if want := `[{"stepId":"test_a","outputs":{"id":"test_a"}},{"stepId":"test_b","outputs":{"id":"test_b"}}]`; string(data) != want {
+		t.Fatalf("steps_table test_* = %s, want %s", data, want)
+	}
+	all, err := r.Call("steps_table", nil, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.([]StepRow)) != 3 {
+		t.Fatalf("steps_table without a pattern = %v, want all three steps", all)
+	}
+}
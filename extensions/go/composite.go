@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	OverrideError     = "error"
+	OverrideLastWins  = "last-wins"
+	OverrideFirstWins = "first-wins"
+)
+
+type AssertionLister interface {
+	ListAssertions() []string
+}
+
+type pluginEntry struct {
+	name     string
+	registry Registry
+}
+
+// CompositeRegistry serves several plugin registries as one. Function and
+// assertion names that appear in more than one plugin are resolved by the
+// override policy when the plugin is added; hooks run in every plugin, in
+// the order the plugins were added.
+type CompositeRegistry struct {
+	policy         string
+	plugins        []pluginEntry
+	functionOwner  map[string]int
+	assertionOwner map[string]int
+}
+
+func NewCompositeRegistry(policy string) (*CompositeRegistry, error) {
+	switch policy {
+	case OverrideError, OverrideLastWins, OverrideFirstWins:
+	default:
+		return nil, fmt.Errorf("unknown override policy %q (want %s, %s or %s)", policy, OverrideError, OverrideLastWins, OverrideFirstWins)
+	}
+	return &CompositeRegistry{
+		policy:         policy,
+		functionOwner:  make(map[string]int),
+		assertionOwner: make(map[string]int),
+	}, nil
+}
+
+func (c *CompositeRegistry) Add(name string, registry Registry) error {
+	index := len(c.plugins)
+
+	var functions []string
+	builtin := make(map[string]bool)
+	for _, info := range registry.ListFunctions() {
+		functions = append(functions, info.Name)
+		builtin[info.Name] = hasTag(info, builtinTag)
+	}
+	var assertions []string
+	if lister, ok := registry.(AssertionLister); ok {
+		assertions = lister.ListAssertions()
+	}
+
+	if c.policy == OverrideError {
+		for _, fn := range functions {
+			if owner, ok := c.functionOwner[fn]; ok && !builtin[fn] {
+				return fmt.Errorf("function %s from %s is already provided by %s", fn, name, c.plugins[owner].name)
+			}
+		}
+	}
+
+	c.plugins = append(c.plugins, pluginEntry{name: name, registry: registry})
+	for _, fn := range functions {
+		c.claim(c.functionOwner, fn, index)
+	}
+	// Every BaseRegistry carries the same builtin assertions, so colliding
+	// assertion names are never an error; they follow last/first-wins and
+	// default to the first plugin.
+	for _, assertion := range assertions {
+		c.claim(c.assertionOwner, assertion, index)
+	}
+	return nil
+}
+
+func (c *CompositeRegistry) claim(owners map[string]int, name string, index int) {
+	if _, taken := owners[name]; taken && c.policy != OverrideLastWins {
+		return
+	}
+	owners[name] = index
+}
+
+func (c *CompositeRegistry) Call(name string, args map[string]interface{}, ctx *Context) (interface{}, error) {
+	owner, ok := c.functionOwner[name]
+	if !ok {
+		available := make([]string, 0, len(c.functionOwner))
+		for k := range c.functionOwner {
+			available = append(available, k)
+		}
+		sort.Strings(available)
+		return nil, functionNotFound(name, available)
+	}
+	return c.plugins[owner].registry.Call(name, args, ctx)
+}
+
+func (c *CompositeRegistry) ListFunctions() []FunctionInfo {
+	return c.FindFunctions("*")
+}
+
+func (c *CompositeRegistry) FindFunctions(pattern string) []FunctionInfo {
+	functions := make([]FunctionInfo, 0)
+	for name := range c.functionOwner {
+		if !matchPattern(pattern, name) {
+			continue
+		}
+		if info, ok := c.Describe(name); ok {
+			functions = append(functions, info)
+		}
+	}
+	sort.Slice(functions, func(i, j int) bool { return functions[i].Name < functions[j].Name })
+	return functions
+}
+
+func (c *CompositeRegistry) Describe(name string) (FunctionInfo, bool) {
+	owner, ok := c.functionOwner[name]
+	if !ok {
+		return FunctionInfo{}, false
+	}
+	plugin := c.plugins[owner]
+	info := FunctionInfo{Name: name}
+	if describer, ok := plugin.registry.(FunctionDescriber); ok {
+		if found, ok := describer.Describe(name); ok {
+			info = found
+		}
+	} else {
+		for _, candidate := range plugin.registry.ListFunctions() {
+			if candidate.Name == name {
+				info = candidate
+				break
+			}
+		}
+	}
+	info.Plugin = plugin.name
+	return info, true
+}
+
+func (c *CompositeRegistry) ListAssertions() []string {
+	assertions := make([]string, 0, len(c.assertionOwner))
+	for name := range c.assertionOwner {
+		assertions = append(assertions, name)
+	}
+	sort.Strings(assertions)
+	return assertions
+}
+
+func (c *CompositeRegistry) DescribeAssertion(name string) (AssertionInfo, bool) {
+	owner, ok := c.assertionOwner[name]
+	if !ok {
+		if len(c.plugins) == 0 {
+			return AssertionInfo{}, false
+		}
+		// Mirror CallAssertion: a first plugin that cannot list its
+		// assertions may still provide this one.
+		if _, lists := c.plugins[0].registry.(AssertionLister); lists {
+			return AssertionInfo{}, false
+		}
+	}
+	plugin := c.plugins[owner]
+	info := AssertionInfo{Name: name, Params: []AssertionParam{}}
+	if describer, ok := plugin.registry.(AssertionDescriber); ok {
+		if found, ok := describer.DescribeAssertion(name); ok {
+			info = found
+		}
+	}
+	info.Plugin = plugin.name
+	return info, true
+}
+
+func (c *CompositeRegistry) CallAssertion(name string, params map[string]interface{}, ctx *Context) AssertionResult {
+	if owner, ok := c.assertionOwner[name]; ok {
+		return c.plugins[owner].registry.CallAssertion(name, params, ctx)
+	}
+	if len(c.plugins) == 0 {
+		return AssertionResult{Success: false, Message: fmt.Sprintf("assertion not found: %s", name)}
+	}
+	// Plugins that cannot list their assertions get the call in plugin order.
+	return c.plugins[0].registry.CallAssertion(name, params, ctx)
+}
+
+func (c *CompositeRegistry) ListHooks() []string {
+	seen := make(map[string]bool)
+	hooks := make([]string, 0)
+	for _, plugin := range c.plugins {
+		for _, hook := range plugin.registry.ListHooks() {
+			if !seen[hook] {
+				seen[hook] = true
+				hooks = append(hooks, hook)
+			}
+		}
+	}
+	sort.Strings(hooks)
+	return hooks
+}
+
+func (c *CompositeRegistry) CallHook(hook string, ctx *Context) error {
+	values, err := c.CallContextHook(hook, ctx)
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		ctx.Set(k, v)
+	}
+	return nil
+}
+
+func (c *CompositeRegistry) CallContextHook(hook string, ctx *Context) (map[string]interface{}, error) {
+	return c.CallHookWithParams(hook, nil, ctx)
+}
+
+func (c *CompositeRegistry) CallHookWithParams(hook string, params map[string]interface{}, ctx *Context) (map[string]interface{}, error) {
+	merged := make(map[string]interface{})
+	for _, plugin := range c.plugins {
+		if caller, ok := plugin.registry.(ParamHookCaller); ok {
+			values, err := caller.CallHookWithParams(hook, params, ctx)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", plugin.name, err)
+			}
+			for k, v := range values {
+				merged[k] = v
+			}
+			continue
+		}
+		caller, ok := plugin.registry.(ContextHookCaller)
+		if !ok {
+			if err := plugin.registry.CallHook(hook, ctx); err != nil {
+				return nil, fmt.Errorf("%s: %w", plugin.name, err)
+			}
+			continue
+		}
+		values, err := caller.CallContextHook(hook, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", plugin.name, err)
+		}
+		for k, v := range values {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
+
+// HandleMethod offers method to each plugin that serves methods of its own,
+// in the order they were added, until one knows it.
+func (c *CompositeRegistry) HandleMethod(method string, params map[string]interface{}, ctx *Context) (interface{}, error) {
+	for _, plugin := range c.plugins {
+		handler, ok := plugin.registry.(MethodHandler)
+		if !ok {
+			continue
+		}
+		result, err := handler.HandleMethod(method, params, ctx)
+		if errorCode(err) == CodeMethodNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", plugin.name, err)
+		}
+		return result, nil
+	}
+	return nil, methodNotFound(method)
+}
+
+func (c *CompositeRegistry) Warmup(ctx *Context) error {
+	for _, plugin := range c.plugins {
+		if warmer, ok := plugin.registry.(Warmer); ok {
+			if err := warmer.Warmup(ctx); err != nil {
+				return fmt.Errorf("%s: %w", plugin.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+type pluginList []string
+
+func (p *pluginList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pluginList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
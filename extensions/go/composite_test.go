@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// pluginPair returns two registries that both provide f, each returning
+// its own name.
+func pluginPair() (*BaseRegistry, *BaseRegistry) {
+	a, b := NewBaseRegistry(), NewBaseRegistry()
+	a.RegisterFunction("f", func(args map[string]interface{}, ctx *Context) (interface{}, error) { return "a", nil })
+	b.RegisterFunction("f", func(args map[string]interface{}, ctx *Context) (interface{}, error) { return "b", nil })
+	return a, b
+}
+
+func TestCompositeOverridePolicies(t *testing.T) {
+	for policy, want := range map[string]string{OverrideLastWins: "b", OverrideFirstWins: "a"} {
+		c, err := NewCompositeRegistry(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, b := pluginPair()
+		if err := c.Add("a.so", a); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Add("b.so", b); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := c.Call("f", nil, NewContext()); got != want {
+			t.Errorf("%s: f = %v, want %v", policy, got, want)
+		}
+		if info, _ := c.Describe("f"); info.Plugin != want+".so" {
+			t.Errorf("%s: f is described as coming from %q", policy, info.Plugin)
+		}
+		if result := c.CallAssertion("is_true", map[string]interface{}{"actual": true}, NewContext()); !result.Success {
+			t.Errorf("%s: builtin assertion: %s", policy, result.Message)
+		}
+	}
+}
+
+func TestCompositeErrorPolicyRejectsCollisions(t *testing.T) {
+	c, _ := NewCompositeRegistry(OverrideError)
+	a, b := pluginPair()
+	if err := c.Add("a.so", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("b.so", b); err == nil {
+		t.Fatal("two plugins providing f were accepted")
+	}
+	if _, err := NewCompositeRegistry("bogus"); err == nil {
+		t.Fatal("an unknown policy was accepted")
+	}
+}
+
+func TestCompositeBuiltinsAreNotCollisions(t *testing.T) {
+	c, _ := NewCompositeRegistry(OverrideError)
+	if err := c.Add("a.so", NewBaseRegistry()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("b.so", NewBaseRegistry()); err != nil {
+		t.Fatalf("the builtins every registry carries collided: %v", err)
+	}
+	if _, err := c.Call("transform", map[string]interface{}{"op": "upper", "value": "a"}, NewContext()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompositeRunsHooksInEveryPlugin(t *testing.T) {
+	var order []string
+	a, b := NewBaseRegistry(), NewBaseRegistry()
+	a.RegisterContextHook("before_all", func(ctx *Context) (map[string]interface{}, error) {
+		order = append(order, "a")
+		return map[string]interface{}{"from_a": true}, nil
+	})
+	b.RegisterHook("before_all", func(ctx *Context) error {
+		order = append(order, "b")
+		return nil
+	})
+	c, _ := NewCompositeRegistry(OverrideError)
+	c.Add("a.so", a)
+	c.Add("b.so", b)
+
+	ctx := NewContext()
+	if err := c.CallHook("before_all", ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("hooks ran as %v, want %v", order, want)
+	}
+	if ctx.Get("from_a") != true {
+		t.Fatal("values from a context hook in the first plugin were dropped")
+	}
+	if got := c.ListHooks(); !reflect.DeepEqual(got, []string{"before_all"}) {
+		t.Fatalf("ListHooks = %v, want one before_all", got)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// compressionThreshold is the smallest encoded message, in bytes, that a
+// connection with gzip negotiated sends compressed. Smaller messages go out
+// as plain lines, since gzip and base64 would only make them longer.
+const compressionThreshold = 1024
+
+// gzipFrame is how a compressed message travels on the line protocol: the
+// message's JSON, gzipped and base64-encoded, as a single line
+// {"gzip": "..."}. Either side may send one once server.capabilities has
+// negotiated gzip; plain lines remain valid alongside them.
+type gzipFrame struct {
+	Gzip string `json:"gzip"`
+}
+
+// handleServerCapabilities reports the transport features the server
+// supports and negotiates compression for the current --listen connection.
+// Sending {"compression": "gzip"} turns on gzip frames for every message
+// after this response, in both directions, and "none" turns them off again.
+// On stdin/stdout, where there is no connection to negotiate for, the
+// request is accepted but compression stays "none".
+func (s *Server) handleServerCapabilities(params map[string]interface{}) (interface{}, error) {
+	requested, err := optionalString(params, "compression")
+	if err != nil {
+		return nil, err
+	}
+	switch requested {
+	case "":
+	case "none":
+		s.setCompression(false)
+	case "gzip":
+		s.setCompression(s.session.conn != nil)
+	default:
+		return nil, invalidParams("unsupported compression %q (supported: gzip, none)", requested)
+	}
+
+	compression := "none"
+	if s.session.compressFrames {
+		compression = "gzip"
+	}
+	return map[string]interface{}{
+		"compression":          compression,
+		"supportedCompression": []string{"gzip"},
+	}, nil
+}
+
+// setCompression swaps the connection's writer for a gzipWriter, or back.
+// The swap happens before the capabilities response is written, which
+// stays a plain line because it is far below compressionThreshold.
+func (s *Server) setCompression(enabled bool) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.session.compressFrames = enabled
+	if enabled {
+		s.out = &gzipWriter{w: s.session.conn}
+	} else if s.session.conn != nil {
+		s.out = s.session.conn
+	}
+}
+
+// gzipWriter sends every line at least compressionThreshold long as a
+// gzipFrame. Each Write must be one complete line, which is how
+// writeMessageTo writes.
+type gzipWriter struct {
+	w io.Writer
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	line := bytes.TrimSuffix(p, []byte("\n"))
+	if len(line) < compressionThreshold {
+		return g.w.Write(p)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(line); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	frame, err := json.Marshal(gzipFrame{Gzip: base64.StdEncoding.EncodeToString(buf.Bytes())})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := g.w.Write(append(frame, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// decompressLine returns the message carried by a gzipFrame line, or the
+// line unchanged when it is not one.
+func decompressLine(line string) (string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(line), `{"gzip"`) {
+		return line, nil
+	}
+	var frame gzipFrame
+	if err := json.Unmarshal([]byte(line), &frame); err != nil || frame.Gzip == "" {
+		return line, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(frame.Gzip)
+	if err != nil {
+		return "", fmt.Errorf("gzip frame is not valid base64: %w", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("gzip frame is not valid gzip: %w", err)
+	}
+	defer zr.Close()
+	decoded, err := io.ReadAll(zr)
+	if err != nil {
+		return "", fmt.Errorf("gzip frame is not valid gzip: %w", err)
+	}
+	return string(decoded), nil
+}
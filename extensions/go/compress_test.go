@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func gzipLine(t *testing.T, line string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(strings.TrimSuffix(line, "\n")))
+	zw.Close()
+	frame, err := json.Marshal(gzipFrame{Gzip: base64.StdEncoding.EncodeToString(buf.Bytes())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(frame) + "\n"
+}
+
+func TestCompressionRoundTripsLargePayloads(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "bridge.sock"))
+	if err != nil {
+		t.Skip(err)
+	}
+	go s.serveListener(listener)
+	defer listener.Close()
+	conn, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	conn.Write([]byte(requestLine(1, "server.capabilities", map[string]interface{}{"compression": "gzip"})))
+	if line, _ := reader.ReadString('\n'); !strings.Contains(line, `"compression":"gzip"`) {
+		t.Fatalf("server.capabilities = %s", line)
+	}
+
+	large := strings.Repeat("payload ", 10000)
+	conn.Write([]byte(gzipLine(t, requestLine(2, "ctx.set", map[string]interface{}{"key": "big", "value": large}))))
+	if line, _ := reader.ReadString('\n'); !strings.Contains(line, `"id":2`) || strings.Contains(line, "error") {
+		t.Fatalf("compressed ctx.set = %s", line)
+	}
+	conn.Write([]byte(requestLine(3, "ctx.get", map[string]interface{}{"key": "big"})))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, `{"gzip":`) || len(line) > len(large)/10 {
+		t.Fatalf("large response was not compressed (%d bytes)", len(line))
+	}
+	decoded, err := decompressLine(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response struct {
+		ID     float64
+		Result struct{ Value string }
+	}
+	if err := json.Unmarshal([]byte(decoded), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.ID != 3 || response.Result.Value != large {
+		t.Fatalf("decoded response has id %v and a %d-byte value", response.ID, len(response.Result.Value))
+	}
+}
+
+func TestCompressionIsANoOpOnStdio(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	result := call(t, s, "server.capabilities", map[string]interface{}{"compression": "gzip"}).(map[string]interface{})
+	if result["compression"] != "none" {
+		t.Fatalf("stdio negotiated %v", result["compression"])
+	}
+	large := strings.Repeat("x", 4*compressionThreshold)
+	lines := runLines(s, requestLine(1, "ctx.set", map[string]interface{}{"key": "big", "value": large})+
+		requestLine(2, "ctx.get", map[string]interface{}{"key": "big"}))
+	if !strings.Contains(lines[1], large) {
+		t.Fatalf("stdio response was not sent as a plain line (%d bytes)", len(lines[1]))
+	}
+	if code := callError(s, "server.capabilities", map[string]interface{}{"compression": "br"}); code != CodeInvalidParams {
+		t.Fatalf("unknown compression = %d, want %d", code, CodeInvalidParams)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "fmt"
+
+// drainBlocked lists the methods refused while draining: everything that
+// runs plugin code, including custom assertions (and so all_match and
+// any_match) and server.warmup. Methods left to the passthrough fallback
+// are refused too; see handleRequest. Context access and introspection
+// keep working.
+var drainBlocked = map[string]bool{
+	"fn.call":            true,
+	"fn.pipe":            true,
+	"hook.call":          true,
+	"hook.callAll":       true,
+	"assert.custom":      true,
+	"assert.chain":       true,
+	"assert.conditional": true,
+	"assert.noError":     true,
+	"assert.errors":      true,
+	"server.warmup":      true,
+	"server.replayRun":   true,
+}
+
+func drainingError(request JSONRPCRequest) JSONRPCResponse {
+	return jsonRPCError(request.ID, CodeServerError, fmt.Sprintf("server is draining, %s is not accepted (see server.resume)", request.Method))
+}
+
+// handleServerDrain stops the server from accepting new function, hook and
+// assertion calls, so an orchestrator can quiesce it before shutting it down.
+// Without --allow-admin, server.drain and server.resume are answered like a
+// method outside the allowlist, with CodeMethodNotFound.
+func (s *Server) handleServerDrain(params map[string]interface{}) (interface{}, error) {
+	if !s.allowAdmin {
+		return nil, newBridgeError(CodeMethodNotFound, "Method not allowed: server.drain (start the server with --allow-admin)")
+	}
+	wasDraining := s.draining
+	s.draining = true
+	return map[string]interface{}{"draining": true, "changed": !wasDraining}, nil
+}
+
+func (s *Server) handleServerResume(params map[string]interface{}) (interface{}, error) {
+	if !s.allowAdmin {
+		return nil, newBridgeError(CodeMethodNotFound, "Method not allowed: server.resume (start the server with --allow-admin)")
+	}
+	wasDraining := s.draining
+	s.draining = false
+	return map[string]interface{}{"draining": false, "changed": wasDraining}, nil
+}
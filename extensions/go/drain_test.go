@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestDrainRefusesEveryMethodThatRunsPluginCode(t *testing.T) {
+	r := NewBaseRegistry()
+	var ran []string
+	r.RegisterAssertion("always", func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+		ran = append(ran, "always")
+		return AssertionResult{Success: true}
+	})
+	s := NewServer(r)
+	s.allowAdmin = true
+	s.fallback = func(method string, params map[string]interface{}) (interface{}, error) {
+		ran = append(ran, method)
+		return "forwarded", nil
+	}
+	always := map[string]interface{}{"name": "always"}
+	requests := []JSONRPCRequest{
+		{ID: 1, Method: "assert.custom", Params: always},
+		{ID: 2, Method: "assert.custom", Params: map[string]interface{}{
+			"name":   "all_match",
+			"params": map[string]interface{}{"actual": []interface{}{1.0}, "assertion": always},
+		}},
+		{ID: 3, Method: "assert.chain", Params: map[string]interface{}{"assertions": []interface{}{always}}},
+		{ID: 4, Method: "assert.conditional", Params: map[string]interface{}{"when": "enabled", "name": "always"}},
+		{ID: 5, Method: "server.warmup"},
+		{ID: 6, Method: "plugin.custom"},
+	}
+
+	if response := s.handleRequest(JSONRPCRequest{ID: 0, Method: "server.drain"}); response.Error != nil {
+		t.Fatal(response.Error.Message)
+	}
+	for _, request := range requests {
+		response := s.handleRequest(request)
+		if response.Error == nil || response.Error.Code != CodeServerError {
+			t.Fatalf("%s while draining = %+v, want a draining error", request.Method, response)
+		}
+	}
+	if len(ran) != 0 {
+		t.Fatalf("plugin code ran while draining: %v", ran)
+	}
+	if response := s.handleRequest(JSONRPCRequest{ID: 7, Method: "ctx.set", Params: map[string]interface{}{"key": "a", "value": 1.0}}); response.Error != nil {
+		t.Fatalf("ctx.set while draining: %s", response.Error.Message)
+	}
+
+	s.handleRequest(JSONRPCRequest{ID: 8, Method: "server.resume"})
+	for _, request := range []JSONRPCRequest{requests[0], requests[5]} {
+		if response := s.handleRequest(request); response.Error != nil {
+			t.Fatalf("%s after resume: %s", request.Method, response.Error.Message)
+		}
+	}
+	if len(ran) != 2 {
+		t.Fatalf("after resume ran %v, want always and plugin.custom", ran)
+	}
+}
+
+func TestDrainAndResumeNeedAllowAdmin(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	for _, method := range []string{"server.drain", "server.resume"} {
+		if code := callError(s, method, nil); code != CodeMethodNotFound {
+			t.Errorf("%s without --allow-admin = %d, want %d", method, code, CodeMethodNotFound)
+		}
+	}
+	if s.draining {
+		t.Fatal("a rejected server.drain started draining")
+	}
+}
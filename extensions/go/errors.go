@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// JSON-RPC error codes. The -32000 to -32099 range is reserved by JSON-RPC
+// for implementation-defined server errors.
+const (
+	CodeInvalidRequest    = -32600
+	CodeMethodNotFound    = -32601
+	CodeInvalidParams     = -32602
+	CodeInternalError     = -32603
+	CodeServerError       = -32000
+	CodeDeadlineExceeded  = -32001
+	CodeFunctionNotFound  = -32004
+	CodeAssertionNotFound = -32005
+)
+
+// BridgeError is an error with the JSON-RPC code it is reported under.
+// jsonRPCResult finds it with errors.As, so it keeps its code when wrapped;
+// any other error is reported as CodeServerError.
+type BridgeError struct {
+	Code    int
+	Message string
+	Cause   error
+}
+
+func (e *BridgeError) Error() string {
+	if e.Cause != nil {
+		return e.Message + ": " + e.Cause.Error()
+	}
+	return e.Message
+}
+
+func (e *BridgeError) Unwrap() error {
+	return e.Cause
+}
+
+func newBridgeError(code int, format string, args ...interface{}) *BridgeError {
+	return &BridgeError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// errorCode returns the code err is reported under.
+func errorCode(err error) int {
+	var be *BridgeError
+	if errors.As(err, &be) {
+		return be.Code
+	}
+	return CodeServerError
+}
+
+func invalidParams(format string, args ...interface{}) error {
+	return newBridgeError(CodeInvalidParams, "Invalid params: "+format, args...)
+}
+
+func methodNotFound(method string) error {
+	return newBridgeError(CodeMethodNotFound, "Method not found: %s", method)
+}
+
+func functionNotFound(name string, available []string) error {
+	return newBridgeError(CodeFunctionNotFound, "function not found: %s. Available: %v", name, available)
+}
+
+func assertionNotFound(name string, available []string) error {
+	return newBridgeError(CodeAssertionNotFound, "assertion not found: %s. Available: %v", name, available)
+}
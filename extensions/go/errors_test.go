@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBridgeErrorKeepsCodeWhenWrapped(t *testing.T) {
+	_, err := NewBaseRegistry().Call("nope", nil, NewContext())
+	wrapped := fmt.Errorf("calling plugin: %w", err)
+	var be *BridgeError
+	if !errors.As(wrapped, &be) || be.Code != CodeFunctionNotFound {
+		t.Fatalf("wrapped error %v lost its code", wrapped)
+	}
+	if errorCode(wrapped) != CodeFunctionNotFound {
+		t.Fatalf("errorCode = %d, want %d", errorCode(wrapped), CodeFunctionNotFound)
+	}
+	if errorCode(errors.New("plain")) != CodeServerError {
+		t.Fatal("a plain error should be a server error")
+	}
+}
+
+func TestResponsesCarryBridgeErrorCodes(t *testing.T) {
+	s := NewServer(newTestRegistry())
+	tests := []struct {
+		method string
+		params map[string]interface{}
+		code   int
+	}{
+		{"fn.call", map[string]interface{}{"name": "nope"}, CodeFunctionNotFound},
+		{"assert.custom", map[string]interface{}{"name": "nope"}, CodeAssertionNotFound},
+		{"assert.custom", map[string]interface{}{}, CodeInvalidParams},
+		{"no.such.method", nil, CodeMethodNotFound},
+	}
+	for _, tt := range tests {
+		response := s.handleRequest(JSONRPCRequest{JSONRPC: "2.0", ID: 1, Method: tt.method, Params: tt.params})
+		if response.Error == nil || response.Error.Code != tt.code {
+			t.Errorf("%s %v = %+v, want code %d", tt.method, tt.params, response.Error, tt.code)
+		}
+	}
+}
@@ -9,26 +9,33 @@
 // Or embed directly in a custom main:
 //   package main
 //   func main() { Serve(createRegistry()) }
+//
+// Functions, assertions and hooks should read the time through ctx.Now(),
+// or hold on to ctx.TimeSource(), instead of the wall clock so they follow
+// the runner's mocked clock. Ids that must stay unique use a counter, since
+// a frozen clock returns the same instant on every call.
 
 package main
 
 import (
 	"fmt"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
 func createExampleRegistry() *BaseRegistry {
 	r := NewBaseRegistry()
 
-	r.RegisterFunction("greet", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+	r.RegisterFunctionWithDefaults("greet", map[string]interface{}{"name": "World"}, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
 		name, _ := args["name"].(string)
 		if name == "" {
 			name = "World"
 		}
+		clock := ctx.TimeSource()
 		return map[string]interface{}{
 			"message": fmt.Sprintf("Hello, %s!", name),
-			"time":    time.Now().Format(time.RFC3339),
+			"time":    clock.Now().Format(time.RFC3339),
 		}, nil
 	})
 
@@ -38,15 +45,17 @@ func createExampleRegistry() *BaseRegistry {
 		return a + b, nil
 	})
 
+	var userSeq uint64
 	r.RegisterFunction("create_user", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
 		email, _ := args["email"].(string)
 		name, _ := args["name"].(string)
+		clock := ctx.TimeSource()
 
 		user := map[string]interface{}{
-			"id":         fmt.Sprintf("user_%d", time.Now().UnixNano()),
+			"id":         fmt.Sprintf("user_%d", atomic.AddUint64(&userSeq, 1)),
 			"email":      email,
 			"name":       name,
-			"created_at": time.Now().Format(time.RFC3339),
+			"created_at": clock.Now().Format(time.RFC3339),
 		}
 
 		ctx.Set("last_user", user)
@@ -58,11 +67,14 @@ func createExampleRegistry() *BaseRegistry {
 		return ctx.Get(key), nil
 	})
 
-	r.RegisterAssertion("equals", func(params map[string]interface{}, ctx *Context) AssertionResult {
+	r.RegisterAssertionWithSchema("equals", "actual deep-equals expected (compared as strings when loose is set)", []string{"actual", "expected", "loose?:boolean"}, func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
 		actual := params["actual"]
 		expected := params["expected"]
 
-		success := fmt.Sprintf("%v", actual) == fmt.Sprintf("%v", expected)
+		success := deepEqual(actual, expected)
+		if loose, _ := params["loose"].(bool); loose {
+			success = looseEqual(actual, expected)
+		}
 		var message string
 		if !success {
 			message = fmt.Sprintf("expected %v but got %v", expected, actual)
@@ -76,7 +88,7 @@ func createExampleRegistry() *BaseRegistry {
 		}
 	})
 
-	r.RegisterAssertion("user_exists", func(params map[string]interface{}, ctx *Context) AssertionResult {
+	r.RegisterAssertionWithSchema("user_exists", "the last created user has the given email", []string{"email:string"}, func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
 		email, _ := params["email"].(string)
 		user := ctx.Get("last_user")
 
@@ -84,6 +96,7 @@ func createExampleRegistry() *BaseRegistry {
 			return AssertionResult{
 				Success: false,
 				Message: "no user in context",
+				Hint:    "did you forget to call create_user first?",
 			}
 		}
 
@@ -96,6 +109,7 @@ func createExampleRegistry() *BaseRegistry {
 				Message:  fmt.Sprintf("user email mismatch: expected %s, got %s", email, userEmail),
 				Actual:   userEmail,
 				Expected: email,
+				Hint:     "last_user holds the most recently created user; check the create_user call that ran last",
 			}
 		}
 
@@ -105,10 +119,11 @@ func createExampleRegistry() *BaseRegistry {
 		}
 	})
 
-	r.RegisterHook("before_all", func(ctx *Context) error {
+	r.RegisterContextHook("before_all", func(ctx *Context) (map[string]interface{}, error) {
 		fmt.Fprintln(os.Stderr, "Setting up test environment...")
-		ctx.Set("test_started", time.Now().Format(time.RFC3339))
-		return nil
+		return map[string]interface{}{
+			"test_started": ctx.Now().Format(time.RFC3339),
+		}, nil
 	})
 
 	r.RegisterHook("after_all", func(ctx *Context) error {
@@ -117,7 +132,7 @@ func createExampleRegistry() *BaseRegistry {
 	})
 
 	r.RegisterHook("before_each", func(ctx *Context) error {
-		ctx.Set("step_started", time.Now().Format(time.RFC3339))
+		ctx.Set("step_started", ctx.Now().Format(time.RFC3339))
 		return nil
 	})
 
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"testing"
+)
+
+// TestExampleRegistryUsesContextClock fails when an example function reads
+// the wall clock directly instead of going through ctx.Now() or
+// ctx.TimeSource(), which would ignore clock.sync.
+func TestExampleRegistryUsesContextClock(t *testing.T) {
+	const path = "example_registry.go"
+	if _, err := os.Stat(path); err != nil {
+		t.Skipf("%s not present: %v", path, err)
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	literals := 0
+	ast.Inspect(file, func(n ast.Node) bool {
+		lit, ok := n.(*ast.FuncLit)
+		if !ok {
+			return true
+		}
+		literals++
+		ast.Inspect(lit.Body, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "time" && sel.Sel.Name == "Now" {
+				t.Errorf("%s: registered code calls time.Now(); use ctx.Now() or ctx.TimeSource()", fset.Position(call.Pos()))
+			}
+			return true
+		})
+		return false
+	})
+	if literals == 0 {
+		t.Fatalf("no function literals found in %s", path)
+	}
+}
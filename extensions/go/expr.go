@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The ctx.eval expression language is deliberately small:
+//
+//	expr       = or
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | comparison
+//	comparison = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) operand ]
+//	operand    = number | string | "true" | "false" | "null" | ref | "(" expr ")"
+//
+// A ref is a context path such as user.age (or one of the special refs
+// understood by Context.Resolve); refs that do not resolve evaluate to null.
+
+type exprNode interface {
+	eval(ctx *Context) interface{}
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n literalNode) eval(ctx *Context) interface{} {
+	return n.value
+}
+
+type refNode struct {
+	ref string
+}
+
+func (n refNode) eval(ctx *Context) interface{} {
+	value, _ := ctx.Resolve(n.ref)
+	return value
+}
+
+type notNode struct {
+	operand exprNode
+}
+
+func (n notNode) eval(ctx *Context) interface{} {
+	return !isTruthy(n.operand.eval(ctx))
+}
+
+type logicalNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n logicalNode) eval(ctx *Context) interface{} {
+	left := isTruthy(n.left.eval(ctx))
+	if n.op == "&&" {
+		return left && isTruthy(n.right.eval(ctx))
+	}
+	return left || isTruthy(n.right.eval(ctx))
+}
+
+type comparisonNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n comparisonNode) eval(ctx *Context) interface{} {
+	left, right := n.left.eval(ctx), n.right.eval(ctx)
+	switch n.op {
+	case "==":
+		return deepEqual(left, right)
+	case "!=":
+		return !deepEqual(left, right)
+	}
+
+	if lf, ok := toFloat(left); ok {
+		rf, ok := toFloat(right)
+		if !ok {
+			return false
+		}
+		return compareOrdered(n.op, lf < rf, lf == rf)
+	}
+	if ls, ok := left.(string); ok {
+		rs, ok := right.(string)
+		if !ok {
+			return false
+		}
+		return compareOrdered(n.op, ls < rs, ls == rs)
+	}
+	return false
+}
+
+func compareOrdered(op string, less, equal bool) bool {
+	switch op {
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	case ">=":
+		return !less
+	}
+	return false
+}
+
+// exprRefs lists the context refs node reads, in source order.
+func exprRefs(node exprNode) []string {
+	switch n := node.(type) {
+	case refNode:
+		return []string{n.ref}
+	case notNode:
+		return exprRefs(n.operand)
+	case logicalNode:
+		return append(exprRefs(n.left), exprRefs(n.right)...)
+	case comparisonNode:
+		return append(exprRefs(n.left), exprRefs(n.right)...)
+	}
+	return nil
+}
+
+type exprToken struct {
+	kind  string // "op", "num", "str", "ident", "eof"
+	text  string
+	value interface{}
+	pos   int
+}
+
+func tokenizeExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "&&") || strings.HasPrefix(src[i:], "||") ||
+			strings.HasPrefix(src[i:], "==") || strings.HasPrefix(src[i:], "!=") ||
+			strings.HasPrefix(src[i:], "<=") || strings.HasPrefix(src[i:], ">="):
+			tokens = append(tokens, exprToken{kind: "op", text: src[i : i+2], pos: i})
+			i += 2
+		case strings.ContainsRune("<>!()", rune(c)):
+			tokens = append(tokens, exprToken{kind: "op", text: string(c), pos: i})
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			var b strings.Builder
+			for end < len(src) && src[end] != c {
+				if src[end] == '\\' && end+1 < len(src) {
+					end++
+				}
+				b.WriteByte(src[end])
+				end++
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, exprToken{kind: "str", text: src[i : end+1], value: b.String(), pos: i})
+			i = end + 1
+		case c == '-' || unicode.IsDigit(rune(c)):
+			end := i + 1
+			for end < len(src) && (unicode.IsDigit(rune(src[end])) || src[end] == '.') {
+				end++
+			}
+			n, err := strconv.ParseFloat(src[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", src[i:end], i)
+			}
+			tokens = append(tokens, exprToken{kind: "num", text: src[i:end], value: n, pos: i})
+			i = end
+		case c == '_' || unicode.IsLetter(rune(c)):
+			end := i + 1
+			for end < len(src) && (src[end] == '_' || src[end] == '.' || src[end] == ':' || src[end] == '-' ||
+				unicode.IsLetter(rune(src[end])) || unicode.IsDigit(rune(src[end]))) {
+				end++
+			}
+			tokens = append(tokens, exprToken{kind: "ident", text: src[i:end], pos: i})
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+	return append(tokens, exprToken{kind: "eof", pos: len(src)}), nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func parseExpr(src string) (exprNode, error) {
+	tokens, err := tokenizeExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return node, nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != "eof" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) acceptOp(ops ...string) (string, bool) {
+	tok := p.peek()
+	if tok.kind != "op" {
+		return "", false
+	}
+	for _, op := range ops {
+		if tok.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOp("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{op: "||", left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOp("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{op: "&&", left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if _, ok := p.acceptOp("!"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.acceptOp("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return comparisonNode{op: op, left: left, right: right}, nil
+}
+
+func (p *exprParser) parseOperand() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case "num", "str":
+		return literalNode{value: tok.value}, nil
+	case "ident":
+		switch tok.text {
+		case "true":
+			return literalNode{value: true}, nil
+		case "false":
+			return literalNode{value: false}, nil
+		case "null":
+			return literalNode{value: nil}, nil
+		}
+		return refNode{ref: tok.text}, nil
+	case "op":
+		if tok.text == "(" {
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.acceptOp(")"); !ok {
+				return nil, fmt.Errorf("expected ) at position %d", p.peek().pos)
+			}
+			return node, nil
+		}
+	case "eof":
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestEvalExpressions(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	s.ctx.Set("user", map[string]interface{}{"age": 20.0, "verified": true, "name": "bob", "tier": "gold"})
+	s.ctx.RunID = "r-1"
+	tests := map[string]bool{
+		"user.age >= 18 && user.verified":                true,
+		"user.age < 18 || !user.verified":                false,
+		"user.name == 'bob'":                             true,
+		`user.name != "bob"`:                             false,
+		"(user.age > 30 || user.tier == 'gold') && true": true,
+		"missing.key == null":                            true,
+		"missing.key":                                    false,
+		"user.age == 20":                                 true,
+		"user.age > -5":                                  true,
+		"run:id == 'r-1'":                                true,
+		"'a' < 'b'":                                      true,
+		"user.name > 3":                                  false,
+	}
+	for expr, want := range tests {
+		result, err := s.handleCtxEval(map[string]interface{}{"expr": expr})
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+			continue
+		}
+		if got := result.(map[string]interface{})["result"]; got != want {
+			t.Errorf("%s = %v, want %v", expr, got, want)
+		}
+	}
+}
+
+func TestEvalRejectsMalformedExpressions(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	for _, expr := range []string{"user.age >=", "(a", "a && ", "'x", "a == b c", "#"} {
+		response := s.handleRequest(JSONRPCRequest{ID: 1, Method: "ctx.eval", Params: map[string]interface{}{"expr": expr}})
+		if response.Error == nil || response.Error.Code != CodeInvalidParams {
+			t.Errorf("%q = %+v, want invalid params", expr, response)
+		}
+	}
+}
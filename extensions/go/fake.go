@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+var (
+	fakeFirstNames = []string{"Ada", "Alan", "Barbara", "Dennis", "Edsger", "Frances", "Grace", "John", "Ken", "Leslie", "Linus", "Margaret", "Radia", "Rob", "Tim", "Yukihiro"}
+	fakeLastNames  = []string{"Allen", "Hamilton", "Hopper", "Kernighan", "Knuth", "Lamport", "Liskov", "Lovelace", "McCarthy", "Perlman", "Pike", "Ritchie", "Thompson", "Torvalds", "Turing", "Wirth"}
+)
+
+// fakeTimestampWindow bounds how far before ctx.Now() a fake timestamp falls.
+const fakeTimestampWindow = 30 * 24 * time.Hour
+
+// builtinFake generates fixture data of args["type"]. With a numeric
+// args["seed"] the same seed always yields the same value (for timestamps,
+// as long as ctx.Now() is the same, e.g. under a mocked clock); without one
+// the value is random.
+func builtinFake(args map[string]interface{}, ctx *Context) (interface{}, error) {
+	kind, ok := args["type"].(string)
+	if !ok {
+		return nil, fmt.Errorf("fake: type must be a string, got %T", args["type"])
+	}
+
+	seed := time.Now().UnixNano()
+	if raw, present := args["seed"]; present && raw != nil {
+		value, ok := raw.(float64)
+		if !ok {
+			return nil, fmt.Errorf("fake: seed must be a number, got %T", raw)
+		}
+		seed = int64(value)
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	switch kind {
+	case "uuid":
+		var b [16]byte
+		rng.Read(b[:])
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+	case "name":
+		return fakeName(rng), nil
+	case "email":
+		first, last, _ := strings.Cut(strings.ToLower(fakeName(rng)), " ")
+		return fmt.Sprintf("%s.%s%d@example.com", first, last, rng.Intn(1000)), nil
+	case "int":
+		min, max := 0.0, 1000.0
+		if v, ok := toFloat(args["min"]); ok {
+			min = v
+		}
+		if v, ok := toFloat(args["max"]); ok {
+			max = v
+		}
+		if max < min {
+			return nil, fmt.Errorf("fake: max %v is less than min %v", max, min)
+		}
+		if min < math.MinInt64 || max >= math.MaxInt64 {
+			return nil, fmt.Errorf("fake: min and max must fit in a 64-bit integer, got %v and %v", min, max)
+		}
+		return fakeInt(rng, int64(min), int64(max)), nil
+	case "timestamp":
+		offset := time.Duration(rng.Int63n(int64(fakeTimestampWindow)))
+		return ctx.Now().Add(-offset).Truncate(time.Second).UTC().Format(time.RFC3339), nil
+	default:
+		return nil, fmt.Errorf("fake: unknown type %q (want uuid, email, name, int or timestamp)", kind)
+	}
+}
+
+// fakeInt returns a uniform integer in [lo, hi]. The span is computed in
+// uint64, so ranges wider than math.MaxInt64 do not overflow.
+func fakeInt(rng *rand.Rand, lo, hi int64) int64 {
+	span := uint64(hi) - uint64(lo)
+	if span < math.MaxInt64 {
+		return lo + rng.Int63n(int64(span)+1)
+	}
+	// At least half of all uint64 values are in range, so this ends quickly.
+	for {
+		if offset := rng.Uint64(); offset <= span {
+			return int64(uint64(lo) + offset)
+		}
+	}
+}
+
+func fakeName(rng *rand.Rand) string {
+	return fakeFirstNames[rng.Intn(len(fakeFirstNames))] + " " + fakeLastNames[rng.Intn(len(fakeLastNames))]
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestFakeIsDeterministicForASeed(t *testing.T) {
+	r := NewBaseRegistry()
+	ctx := NewContext()
+	ms := int64(1700000000000)
+	ctx.Clock = &ClockState{VirtualTimeMs: &ms}
+
+	for _, kind := range []string{"uuid", "email", "name", "int", "timestamp"} {
+		a, err := r.Call("fake", map[string]interface{}{"type": kind, "seed": 42.0}, ctx)
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		b, _ := r.Call("fake", map[string]interface{}{"type": kind, "seed": 42.0}, ctx)
+		other, _ := r.Call("fake", map[string]interface{}{"type": kind, "seed": 43.0}, ctx)
+		if a != b {
+			t.Fatalf("%s: seed 42 gave %v then %v", kind, a, b)
+		}
+		if a == other {
+			t.Fatalf("%s: seeds 42 and 43 both gave %v", kind, a)
+		}
+	}
+}
+
+func TestFakeFormats(t *testing.T) {
+	r := NewBaseRegistry()
+	ctx := NewContext()
+
+	uuid, err := r.Call("fake", map[string]interface{}{"type": "uuid"}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(uuid.(string)) {
+		t.Fatalf("uuid = %q, want a version 4 UUID", uuid)
+	}
+	email, _ := r.Call("fake", map[string]interface{}{"type": "email", "seed": 1.0}, ctx)
+	if !regexp.MustCompile(`^[a-z]+\.[a-z]+\d+@example\.com$`).MatchString(email.(string)) {
+		t.Fatalf("email = %q", email)
+	}
+	if _, err := r.Call("fake", map[string]interface{}{"type": "zzz"}, ctx); err == nil {
+		t.Fatal("expected an error for an unknown type")
+	}
+}
+
+func TestFakeIntRanges(t *testing.T) {
+	r := NewBaseRegistry()
+	ctx := NewContext()
+	call := func(min, max float64, seed float64) (interface{}, error) {
+		return r.Call("fake", map[string]interface{}{"type": "int", "min": min, "max": max, "seed": seed}, ctx)
+	}
+
+	if n, err := call(5, 5, 1); err != nil || n != int64(5) {
+		t.Fatalf("fake int 5..5 = %v, %v", n, err)
+	}
+	for seed := 0.0; seed < 50; seed++ {
+		n, err := call(-9e18, 9e18, seed)
+		if err != nil {
+			t.Fatalf("wide range: %v", err)
+		}
+		if v := n.(int64); v < -9e18 || v > 9e18 {
+			t.Fatalf("fake int %d outside -9e18..9e18", v)
+		}
+	}
+	if _, err := call(-1e19, 0, 1); err == nil {
+		t.Fatal("expected an error for a min below the int64 range")
+	}
+	if _, err := call(0, 1e19, 1); err == nil {
+		t.Fatal("expected an error for a max above the int64 range")
+	}
+	if _, err := call(10, 1, 1); err == nil {
+		t.Fatal("expected an error for max < min")
+	}
+}
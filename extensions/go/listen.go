@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Listen serves JSON-RPC on addr, which must currently be of the form
+// unix:///path/to.sock, using the same line protocol as stdin/stdout.
+// Connections are served one at a time against the shared context, and each
+// starts a fresh session for session.hello and server.capabilities
+// negotiation; a connection that calls server.tap is handed over to the tap
+// and the next one is accepted.
+// Requests on a connection that are still waiting (ctx.waitFor and the like)
+// are answered before the next connection is accepted. Listen returns,
+// removing the socket file, once Shutdown is called; main does that on
+// SIGINT or SIGTERM.
+func (s *Server) Listen(addr string) error {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok || path == "" {
+		return fmt.Errorf("unsupported listen address %q (want unix:///path/to.sock)", addr)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-s.shutdown:
+			listener.Close()
+		case <-stopped:
+		}
+	}()
+
+	fmt.Fprintf(os.Stderr, "Go bridge server listening on %s\n", addr)
+	return s.serveListener(listener)
+}
+
+func (s *Server) serveListener(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.writeMu.Lock()
+		s.out = conn
+		s.writeMu.Unlock()
+		s.serveSession(conn, &session{conn: conn})
+		if s.detachConn {
+			s.detachConn = false
+			s.startTap(conn)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous run that
+// did not shut down cleanly, but refuses to touch anything else at path.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenReturnsOnShutdownAndRemovesSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bridge.sock")
+	s := NewServer(NewBaseRegistry())
+
+	errs := make(chan error, 1)
+	go func() { errs <- s.Listen("unix://" + path) }()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("socket was never created")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	s.Shutdown()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Listen did not return after Shutdown")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left behind: %v", err)
+	}
+}
+
+func TestListenServesEachConnection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bridge.sock")
+	s := NewServer(NewBaseRegistry())
+	go s.Listen("unix://" + path)
+	defer s.Shutdown()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte(requestLine(1, "ctx.set", map[string]interface{}{"key": "a", "value": 5}) +
+		requestLine(2, "ctx.get", map[string]interface{}{"key": "a"})))
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.Contains(line, `"id":2`) || !strings.Contains(line, `5`) {
+		t.Fatalf("ctx.get over the socket = %q, %v", line, err)
+	}
+	conn.Close()
+
+	second, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	second.Write([]byte(requestLine(3, "ctx.get", map[string]interface{}{"key": "a"})))
+	if line, _ := bufio.NewReader(second).ReadString('\n'); !strings.Contains(line, `5`) {
+		t.Fatalf("a later connection does not share the context: %q", line)
+	}
+}
+
+func TestListenRejectsOtherSchemes(t *testing.T) {
+	if err := NewServer(NewBaseRegistry()).Listen("tcp://127.0.0.1:0"); err == nil {
+		t.Fatal("a tcp address was accepted")
+	}
+}
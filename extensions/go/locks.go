@@ -0,0 +1,114 @@
+package main
+
+import "time"
+
+type namedLock struct {
+	held    chan struct{}
+	waiters int
+}
+
+// Lock acquires the lock called name, waiting up to timeout for it to be
+// released, and reports whether it was acquired. Locks are not owned: any
+// caller may Unlock a held lock. The timeout runs on the wall clock.
+func (c *Context) Lock(name string, timeout time.Duration) bool {
+	acquired, wait := c.prepareLock(name)
+	if acquired {
+		return true
+	}
+	return wait(timeout)
+}
+
+// prepareLock takes the lock straight away if it is free. Otherwise it
+// registers the caller as a waiter, so an Unlock in the meantime hands the
+// lock on instead of forgetting it, and returns the wait.
+func (c *Context) prepareLock(name string) (bool, func(timeout time.Duration) bool) {
+	c.lockMu.Lock()
+	defer c.lockMu.Unlock()
+	if c.locks == nil {
+		c.locks = make(map[string]*namedLock)
+	}
+	l, ok := c.locks[name]
+	if !ok {
+		l = &namedLock{held: make(chan struct{}, 1)}
+		c.locks[name] = l
+	}
+	select {
+	case l.held <- struct{}{}:
+		return true, nil
+	default:
+	}
+	l.waiters++
+
+	return false, func(timeout time.Duration) bool {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		acquired := false
+		select {
+		case l.held <- struct{}{}:
+			acquired = true
+		case <-timer.C:
+		}
+
+		c.lockMu.Lock()
+		l.waiters--
+		if !acquired && l.waiters == 0 && len(l.held) == 0 {
+			delete(c.locks, name)
+		}
+		c.lockMu.Unlock()
+		return acquired
+	}
+}
+
+// Unlock releases the lock called name, reporting false if it was not held.
+// A lock nobody is waiting for is forgotten once released.
+func (c *Context) Unlock(name string) bool {
+	c.lockMu.Lock()
+	defer c.lockMu.Unlock()
+	l, ok := c.locks[name]
+	if !ok || len(l.held) == 0 {
+		return false
+	}
+	<-l.held
+	if l.waiters == 0 {
+		delete(c.locks, name)
+	}
+	return true
+}
+
+// handleCtxLock answers at once when the lock is free. When it is held it
+// returns a pendingResult, so the ctx.unlock that frees it can arrive as a
+// later request.
+func (s *Server) handleCtxLock(params map[string]interface{}) (interface{}, error) {
+	name, err := requireString(params, "name")
+	if err != nil {
+		return nil, err
+	}
+	timeoutMs, err := optionalNumber(params, "timeout_ms")
+	if err != nil {
+		return nil, err
+	}
+	if timeoutMs <= 0 {
+		return nil, invalidParams("timeout_ms must be a positive number")
+	}
+
+	start := time.Now()
+	acquired, wait := s.ctx.prepareLock(name)
+	if acquired {
+		return map[string]interface{}{"acquired": true, "waitedMs": int64(0)}, nil
+	}
+	return pendingResult(func() (interface{}, error) {
+		acquired := wait(time.Duration(timeoutMs * float64(time.Millisecond)))
+		return map[string]interface{}{
+			"acquired": acquired,
+			"waitedMs": time.Since(start).Milliseconds(),
+		}, nil
+	}), nil
+}
+
+func (s *Server) handleCtxUnlock(params map[string]interface{}) (interface{}, error) {
+	name, err := requireString(params, "name")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"released": s.ctx.Unlock(name)}, nil
+}
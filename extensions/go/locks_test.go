@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockIsReleasedByLaterUnlockRequest(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	c := newPipeClient(t, s)
+
+	c.send(1, "ctx.lock", map[string]interface{}{"name": "db", "timeout_ms": 2000})
+	if result := c.nextResult(1); result["acquired"] != true {
+		t.Fatalf("first ctx.lock = %v, want acquired", result)
+	}
+	c.send(2, "ctx.lock", map[string]interface{}{"name": "db", "timeout_ms": 2000})
+	c.send(3, "ctx.unlock", map[string]interface{}{"name": "db"})
+
+	results := c.nextResults(2)
+	if results[3]["released"] != true {
+		t.Fatalf("ctx.unlock = %v, want released", results[3])
+	}
+	if results[2]["acquired"] != true {
+		t.Fatalf("contended ctx.lock = %v, want acquired after the unlock", results[2])
+	}
+}
+
+func TestLockTimesOutWhileHeld(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	c := newPipeClient(t, s)
+
+	c.send(1, "ctx.lock", map[string]interface{}{"name": "db", "timeout_ms": 1000})
+	c.nextResult(1)
+	c.send(2, "ctx.lock", map[string]interface{}{"name": "db", "timeout_ms": 30})
+	result := c.nextResult(2)
+	if result["acquired"] != false || result["waitedMs"].(float64) < 30 {
+		t.Fatalf("ctx.lock = %v, want a timeout after at least 30ms", result)
+	}
+
+	c.send(3, "ctx.unlock", map[string]interface{}{"name": "db"})
+	if result := c.nextResult(3); result["released"] != true {
+		t.Fatalf("ctx.unlock = %v", result)
+	}
+	c.send(4, "ctx.unlock", map[string]interface{}{"name": "db"})
+	if result := c.nextResult(4); result["released"] != false {
+		t.Fatalf("second ctx.unlock = %v, want released false", result)
+	}
+}
+
+func TestLockIsMutuallyExclusive(t *testing.T) {
+	ctx := NewContext()
+	var inside, overlaps int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !ctx.Lock("x", 2*time.Second) {
+				t.Error("Lock timed out")
+				return
+			}
+			if atomic.AddInt32(&inside, 1) > 1 {
+				atomic.AddInt32(&overlaps, 1)
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&inside, -1)
+			ctx.Unlock("x")
+		}()
+	}
+	wg.Wait()
+	if overlaps != 0 {
+		t.Fatalf("%d goroutines held the lock at the same time", overlaps)
+	}
+	ctx.lockMu.Lock()
+	defer ctx.lockMu.Unlock()
+	if len(ctx.locks) != 0 {
+		t.Fatalf("%d locks left after every holder unlocked", len(ctx.locks))
+	}
+}
+
+func TestLockRequiresTimeout(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	if _, err := s.handleCtxLock(map[string]interface{}{"name": "db"}); errorCode(err) != CodeInvalidParams {
+		t.Fatalf("err = %v, want Invalid params", err)
+	}
+}
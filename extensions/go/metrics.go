@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the function latency
+// histogram.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type functionStats struct {
+	calls   uint64
+	errors  uint64
+	buckets []uint64
+	sum     float64
+}
+
+// functionMetrics accumulates per-function call counts and latencies for
+// server.metricsText.
+type functionMetrics struct {
+	mu     sync.Mutex
+	byName map[string]*functionStats
+}
+
+func (m *functionMetrics) record(name string, elapsed time.Duration, failed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.byName == nil {
+		m.byName = make(map[string]*functionStats)
+	}
+	stats, ok := m.byName[name]
+	if !ok {
+		stats = &functionStats{buckets: make([]uint64, len(latencyBuckets))}
+		m.byName[name] = stats
+	}
+	seconds := elapsed.Seconds()
+	stats.calls++
+	if failed {
+		stats.errors++
+	}
+	stats.sum += seconds
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			stats.buckets[i]++
+		}
+	}
+}
+
+// prometheusText renders function and assertion metrics in the Prometheus
+// text exposition format (version 0.0.4), with series sorted by label.
+func (s *Server) prometheusText() string {
+	var b strings.Builder
+
+	s.metrics.mu.Lock()
+	names := make([]string, 0, len(s.metrics.byName))
+	for name := range s.metrics.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b.WriteString("# HELP bridge_function_calls_total Function calls made through the registry.\n")
+	b.WriteString("# TYPE bridge_function_calls_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "bridge_function_calls_total{function=%s} %d\n", promLabel(name), s.metrics.byName[name].calls)
+	}
+	b.WriteString("# HELP bridge_function_errors_total Function calls that returned an error.\n")
+	b.WriteString("# TYPE bridge_function_errors_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "bridge_function_errors_total{function=%s} %d\n", promLabel(name), s.metrics.byName[name].errors)
+	}
+	b.WriteString("# HELP bridge_function_duration_seconds Function call latency.\n")
+	b.WriteString("# TYPE bridge_function_duration_seconds histogram\n")
+	for _, name := range names {
+		stats := s.metrics.byName[name]
+		label := promLabel(name)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(&b, "bridge_function_duration_seconds_bucket{function=%s,le=\"%s\"} %d\n", label, strconv.FormatFloat(bound, 'g', -1, 64), stats.buckets[i])
+		}
+		fmt.Fprintf(&b, "bridge_function_duration_seconds_bucket{function=%s,le=\"+Inf\"} %d\n", label, stats.calls)
+		fmt.Fprintf(&b, "bridge_function_duration_seconds_sum{function=%s} %s\n", label, strconv.FormatFloat(stats.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "bridge_function_duration_seconds_count{function=%s} %d\n", label, stats.calls)
+	}
+	s.metrics.mu.Unlock()
+
+	assertions := s.assertions.snapshot()
+	names = names[:0]
+	for name := range assertions.ByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b.WriteString("# HELP bridge_assertions_total Assertions run through assert.custom, by result.\n")
+	b.WriteString("# TYPE bridge_assertions_total counter\n")
+	for _, name := range names {
+		counts := assertions.ByName[name]
+		fmt.Fprintf(&b, "bridge_assertions_total{assertion=%s,result=\"passed\"} %d\n", promLabel(name), counts.Passed)
+		fmt.Fprintf(&b, "bridge_assertions_total{assertion=%s,result=\"failed\"} %d\n", promLabel(name), counts.Failed)
+	}
+	return b.String()
+}
+
+// promLabel quotes a label value, escaping backslashes, quotes and newlines.
+func promLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func (s *Server) handleServerMetricsText(params map[string]interface{}) (interface{}, error) {
+	return map[string]interface{}{
+		"contentType": "text/plain; version=0.0.4",
+		"text":        s.prometheusText(),
+	}, nil
+}
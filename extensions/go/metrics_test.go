@@ -0,0 +1,46 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMetricsTextIsValidExposition(t *testing.T) {
+	s := NewServer(newTestRegistry())
+	s.handleRequest(JSONRPCRequest{ID: 1, Method: "fn.call", Params: map[string]interface{}{"name": "greet"}})
+	s.handleRequest(JSONRPCRequest{ID: 2, Method: "fn.call", Params: map[string]interface{}{"name": "transform", "args": map[string]interface{}{"op": 1}}})
+	s.handleRequest(JSONRPCRequest{ID: 3, Method: "assert.custom", Params: map[string]interface{}{"name": "is_true", "params": map[string]interface{}{"actual": true}}})
+
+	response := s.handleRequest(JSONRPCRequest{ID: 4, Method: "server.metricsText"})
+	if response.Error != nil {
+		t.Fatal(response.Error.Message)
+	}
+	text := response.Result.(map[string]interface{})["text"].(string)
+	sample := regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{[a-zA-Z_][a-zA-Z0-9_]*="(\\.|[^"\\])*"(,[a-zA-Z_][a-zA-Z0-9_]*="(\\.|[^"\\])*")*\})? [-+0-9.eE]+$`)
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+			continue
+		}
+		if !sample.MatchString(line) {
+			t.Errorf("malformed sample line %q", line)
+		}
+	}
+	for _, want := range []string{
+		`bridge_function_calls_total{function="greet"} 1`,
+		`bridge_function_errors_total{function="transform"} 1`,
+		`bridge_function_duration_seconds_count{function="greet"} 1`,
+		`bridge_function_duration_seconds_bucket{function="greet",le="+Inf"} 1`,
+		`bridge_assertions_total{assertion="is_true",result="passed"} 1`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics text is missing %q", want)
+		}
+	}
+}
+
+func TestPromLabelEscapes(t *testing.T) {
+	if got, want := promLabel("a\"b\\c\nd"), `"a\"b\\c\nd"`; got != want {
+		t.Fatalf("promLabel = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func saveContext(path string, ctx *Context) error {
+	data, err := json.Marshal(ctx.Export())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func loadContext(path string, ctx *Context) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var export ContextExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return fmt.Errorf("corrupt context file %s: %w", path, err)
+	}
+	ctx.Import(export)
+	return nil
+}
+
+// EnablePersistence loads any previously saved context from path, then saves
+// it every interval and once more from StopPersistence. main defers
+// StopPersistence, so a SIGINT or SIGTERM, which makes Run or Listen return
+// through Shutdown, still writes the final state. A file that cannot be
+// parsed is reported and ignored so the server still starts.
+func (s *Server) EnablePersistence(path string, interval time.Duration) {
+	if err := loadContext(path, s.ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring persisted context: %v\n", err)
+	}
+
+	s.persistPath = path
+	s.persistStop = make(chan struct{})
+	s.persistDone = make(chan struct{})
+
+	go func() {
+		defer close(s.persistDone)
+
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-tick:
+				s.persistContext()
+			case <-s.persistStop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *Server) StopPersistence() {
+	if s.persistStop == nil {
+		return
+	}
+	close(s.persistStop)
+	<-s.persistDone
+	s.persistStop = nil
+	s.persistContext()
+}
+
+func (s *Server) persistContext() {
+	if err := saveContext(s.persistPath, s.ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to persist context: %v\n", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownReturnsFromRunAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctx.json")
+	in, w := io.Pipe()
+	defer w.Close()
+
+	s := NewServer(NewBaseRegistry())
+	s.in = in
+	s.out = io.Discard
+	s.EnablePersistence(path, 0)
+	s.ctx.Set("token", "abc")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run()
+	}()
+	s.Shutdown()
+	s.Shutdown()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Shutdown")
+	}
+
+	s.StopPersistence()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"token":"abc"`) {
+		t.Fatalf("persisted context = %s", data)
+	}
+}
+
+func TestPersistenceSavesPeriodicallyAndReloads(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ctx.json")
+	s := NewServer(NewBaseRegistry())
+	s.EnablePersistence(path, 10*time.Millisecond)
+	s.ctx.Set("a", map[string]interface{}{"b": 1.0})
+	s.ctx.SetStepOutputs("s1", map[string]interface{}{"o": "v"})
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("context was never saved")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.ctx.Set("late", true)
+	s.StopPersistence()
+
+	restored := NewServer(NewBaseRegistry())
+	restored.EnablePersistence(path, 0)
+	defer restored.StopPersistence()
+	if restored.ctx.Get("late") != true || restored.ctx.GetStepOutput("s1", "o") != "v" {
+		t.Fatalf("reloaded context = %v", restored.ctx.Export())
+	}
+}
+
+func TestPersistenceIgnoresCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ctx.json")
+	if err := os.WriteFile(path, []byte("{garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(NewBaseRegistry())
+	s.EnablePersistence(path, 0)
+	s.StopPersistence()
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("saving left %d files behind, want the context file only", len(entries))
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), `"data"`) {
+		t.Fatalf("corrupt file was not replaced on save: %s", data)
+	}
+}
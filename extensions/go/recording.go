@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+type RecordedExchange struct {
+	Request  JSONRPCRequest  `json:"request"`
+	Response JSONRPCResponse `json:"response"`
+}
+
+type recorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (r *recorder) record(request JSONRPCRequest, response JSONRPCResponse) error {
+	line, err := json.Marshal(RecordedExchange{Request: request, Response: response})
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = fmt.Fprintln(r.w, string(line))
+	return err
+}
+
+type replayer struct {
+	mu        sync.Mutex
+	exchanges []RecordedExchange
+	served    []bool
+}
+
+func loadRecording(r io.Reader) ([]RecordedExchange, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+
+	var exchanges []RecordedExchange
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var exchange RecordedExchange
+		if err := json.Unmarshal(line, &exchange); err != nil {
+			return nil, fmt.Errorf("invalid recording line %d: %w", len(exchanges)+1, err)
+		}
+		exchanges = append(exchanges, exchange)
+	}
+	return exchanges, scanner.Err()
+}
+
+// lookup returns the first unserved exchange matching the request's method
+// and params. Once every match has been served, the last match is repeated.
+func (r *replayer) lookup(request JSONRPCRequest) (JSONRPCResponse, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	last := -1
+	for i, exchange := range r.exchanges {
+		if exchange.Request.Method != request.Method || !deepEqual(paramsOrEmpty(exchange.Request.Params), paramsOrEmpty(request.Params)) {
+			continue
+		}
+		if !r.served[i] {
+			r.served[i] = true
+			return r.exchanges[i].Response, true
+		}
+		last = i
+	}
+	if last < 0 {
+		return JSONRPCResponse{}, false
+	}
+	return r.exchanges[last].Response, true
+}
+
+func paramsOrEmpty(params map[string]interface{}) map[string]interface{} {
+	if params == nil {
+		return map[string]interface{}{}
+	}
+	return params
+}
+
+func (s *Server) RecordTo(w io.Writer) {
+	s.recorder = &recorder{w: w}
+}
+
+func (s *Server) ReplayFrom(r io.Reader) error {
+	exchanges, err := loadRecording(r)
+	if err != nil {
+		return err
+	}
+	s.replayer = &replayer{exchanges: exchanges, served: make([]bool, len(exchanges))}
+	return nil
+}
+
+func (s *Server) replay(request JSONRPCRequest) JSONRPCResponse {
+	response, ok := s.replayer.lookup(request)
+	if !ok {
+		return jsonRPCError(request.ID, CodeServerError, fmt.Sprintf("No recorded response for %s", request.Method))
+	}
+	response.ID = request.ID
+	return response
+}
+
+type ReplayedExchange struct {
+	Request  JSONRPCRequest  `json:"request"`
+	Recorded JSONRPCResponse `json:"recorded"`
+	Response JSONRPCResponse `json:"response"`
+	Changed  bool            `json:"changed"`
+}
+
+// handleServerReplayRun re-executes the requests of a recording (the
+// --record format, inline as "recording" or read from "path") against the
+// live registry, unlike --replay which serves the recorded responses. Each
+// new response is returned next to the recorded one; changed ignores the
+// request id and durationMs, which differ between runs anyway.
+func (s *Server) handleServerReplayRun(params map[string]interface{}) (interface{}, error) {
+	recording, err := optionalString(params, "recording")
+	if err != nil {
+		return nil, err
+	}
+	path, err := optionalString(params, "path")
+	if err != nil {
+		return nil, err
+	}
+	var source io.Reader
+	switch {
+	case recording != "" && path != "":
+		return nil, invalidParams("only one of %q or %q may be set", "recording", "path")
+	case recording != "":
+		source = strings.NewReader(recording)
+	case path != "":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		source = f
+	default:
+		return nil, invalidParams("one of %q or %q is required", "recording", "path")
+	}
+	exchanges, err := loadRecording(source)
+	if err != nil {
+		return nil, invalidParams("%v", err)
+	}
+
+	replayed := make([]ReplayedExchange, 0, len(exchanges))
+	changed := 0
+	for _, exchange := range exchanges {
+		if exchange.Request.Method == "server.replayRun" {
+			continue
+		}
+		response := encodeResult(exchange.Request, resolvePending(exchange.Request, s.handleRequest(exchange.Request)))
+		entry := ReplayedExchange{
+			Request:  exchange.Request,
+			Recorded: exchange.Response,
+			Response: response,
+			Changed:  !deepEqual(comparableResponse(exchange.Response), comparableResponse(response)),
+		}
+		if entry.Changed {
+			changed++
+		}
+		replayed = append(replayed, entry)
+	}
+	return map[string]interface{}{"exchanges": replayed, "changed": changed}, nil
+}
+
+// comparableResponse decodes a response into plain JSON values without its
+// id and without the durationMs of a fn.call result.
+func comparableResponse(response JSONRPCResponse) interface{} {
+	data, err := json.Marshal(JSONRPCResponse{Result: response.Result, Error: response.Error})
+	if err != nil {
+		return nil
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil
+	}
+	if result, ok := decoded["result"].(map[string]interface{}); ok {
+		delete(result, "durationMs")
+	}
+	return decoded
+}
+
+func openRecording(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+}
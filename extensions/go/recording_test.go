@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplayServesRecordedResponses(t *testing.T) {
+	input := requestLine(1, "fn.call", map[string]interface{}{"name": "add", "args": map[string]interface{}{"a": 1, "b": 2}}) +
+		requestLine(2, "ctx.set", map[string]interface{}{"key": "k", "value": 1}) +
+		requestLine(3, "ctx.get", map[string]interface{}{"key": "k"})
+
+	live := NewServer(newTestRegistry())
+	var recording bytes.Buffer
+	live.RecordTo(&recording)
+	recorded := runLines(live, input)
+
+	replaying := NewServer(NewBaseRegistry())
+	if err := replaying.ReplayFrom(&recording); err != nil {
+		t.Fatal(err)
+	}
+	if replayed := runLines(replaying, input); !reflect.DeepEqual(replayed, recorded) {
+		t.Fatalf("replayed %q, want %q", replayed, recorded)
+	}
+	response := replaying.handleRequest(JSONRPCRequest{ID: 9, Method: "ctx.get", Params: map[string]interface{}{"key": "unrecorded"}})
+	if response.Error == nil || response.Error.Code != CodeServerError {
+		t.Fatalf("unrecorded request = %+v, want a server error", response)
+	}
+}
+
+func TestReplayRunReExecutesAgainstLiveRegistry(t *testing.T) {
+	r := NewBaseRegistry()
+	factor := 1.0
+	r.RegisterFunction("scale", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return args["x"].(float64) * factor, nil
+	})
+	live := NewServer(r)
+	var recording bytes.Buffer
+	live.RecordTo(&recording)
+	runLines(live, requestLine(1, "fn.call", map[string]interface{}{"name": "scale", "args": map[string]interface{}{"x": 2}})+
+		requestLine(2, "ctx.set", map[string]interface{}{"key": "k", "value": 1}))
+
+	factor = 3
+	s := NewServer(r)
+	response := s.handleRequest(JSONRPCRequest{ID: 9, Method: "server.replayRun", Params: map[string]interface{}{"recording": recording.String()}})
+	if response.Error != nil {
+		t.Fatal(response.Error.Message)
+	}
+	result := response.Result.(map[string]interface{})
+	exchanges := result["exchanges"].([]ReplayedExchange)
+	if result["changed"] != 1 || len(exchanges) != 2 {
+		t.Fatalf("replayRun = %+v, want one of two exchanges changed", result)
+	}
+	if !exchanges[0].Changed || exchanges[1].Changed {
+		t.Fatalf("changed flags = %v, %v; want the scale call changed", exchanges[0].Changed, exchanges[1].Changed)
+	}
+	if got := string(exchanges[0].Response.Result.(json.RawMessage)); !strings.Contains(got, `"result":6`) {
+		t.Fatalf("re-executed scale = %s, want 6", got)
+	}
+	if s.ctx.Get("k") != 1.0 {
+		t.Fatal("replayRun did not apply the recorded ctx.set")
+	}
+}
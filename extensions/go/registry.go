@@ -1,33 +1,273 @@
 package main
 
-import "fmt"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
 
 type BaseRegistry struct {
 	functions  map[string]func(args map[string]interface{}, ctx *Context) (interface{}, error)
 	assertions map[string]func(params map[string]interface{}, ctx *Context) AssertionResult
 	hooks      map[string]func(ctx *Context) error
+	ctxHooks   map[string]func(ctx *Context) (map[string]interface{}, error)
+	paramHooks map[string]func(ctx *Context, params map[string]interface{}) error
+	info       map[string]FunctionInfo
+	assertInfo map[string]AssertionInfo
 }
 
 func NewBaseRegistry() *BaseRegistry {
-	return &BaseRegistry{
+	r := &BaseRegistry{
 		functions:  make(map[string]func(args map[string]interface{}, ctx *Context) (interface{}, error)),
 		assertions: make(map[string]func(params map[string]interface{}, ctx *Context) AssertionResult),
 		hooks:      make(map[string]func(ctx *Context) error),
+		ctxHooks:   make(map[string]func(ctx *Context) (map[string]interface{}, error)),
+		paramHooks: make(map[string]func(ctx *Context, params map[string]interface{}) error),
+		info:       make(map[string]FunctionInfo),
+		assertInfo: make(map[string]AssertionInfo),
 	}
+	registerBuiltins(r)
+	return r
 }
 
 func (r *BaseRegistry) RegisterFunction(name string, fn func(args map[string]interface{}, ctx *Context) (interface{}, error)) {
 	r.functions[name] = fn
+	r.info[name] = FunctionInfo{Name: name}
 }
 
-func (r *BaseRegistry) RegisterAssertion(name string, fn func(params map[string]interface{}, ctx *Context) AssertionResult) {
+func (r *BaseRegistry) RegisterFunctionWithTags(name string, tags []string, fn func(args map[string]interface{}, ctx *Context) (interface{}, error)) {
+	r.RegisterFunction(name, fn)
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+	info := r.info[name]
+	info.Tags = sorted
+	r.info[name] = info
+}
+
+// RegisterFunctionWithDefaults registers fn with default values for its
+// args. Call fills in a default for every arg the caller left out; args that
+// are present, even as null, are passed through unchanged. The defaults are
+// reported by list_functions.
+func (r *BaseRegistry) RegisterFunctionWithDefaults(name string, defaults map[string]interface{}, fn func(args map[string]interface{}, ctx *Context) (interface{}, error)) {
+	r.RegisterFunction(name, fn)
+	info := r.info[name]
+	info.Defaults = defaults
+	r.info[name] = info
+}
+
+// RegisterFunctionWithExamples registers fn with sample calls, typically
+// {"args": {...}, "result": ...} pairs, which list_functions and
+// registry.describe report for docs and autocomplete. They are not checked
+// against fn.
+func (r *BaseRegistry) RegisterFunctionWithExamples(name string, examples []map[string]interface{}, fn func(args map[string]interface{}, ctx *Context) (interface{}, error)) {
+	r.RegisterFunction(name, fn)
+	info := r.info[name]
+	info.Examples = examples
+	r.info[name] = info
+}
+
+// RegisterFunctionWithLimit registers fn so that at most maxConcurrent calls
+// run at once; further callers block until a slot frees up. Use it for
+// functions that wrap a scarce resource such as a single connection.
+func (r *BaseRegistry) RegisterFunctionWithLimit(name string, maxConcurrent int, fn func(args map[string]interface{}, ctx *Context) (interface{}, error)) {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	slots := make(chan struct{}, maxConcurrent)
+
+	r.RegisterFunction(name, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		slots <- struct{}{}
+		defer func() { <-slots }()
+		return fn(args, ctx)
+	})
+}
+
+type cachedResult struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// maxCachedResults bounds each cached function's cache; once full, expired
+// entries are pruned and then the entry closest to expiry is evicted.
+const maxCachedResults = 1024
+
+// RegisterCachedFunction memoizes fn by its args for ttl, measured with
+// ctx.Now so frozen clocks keep entries alive. Callers get their own copy of
+// a cached result, so mutating it does not change what later calls see.
+func (r *BaseRegistry) RegisterCachedFunction(name string, ttl time.Duration, fn func(args map[string]interface{}, ctx *Context) (interface{}, error)) {
+	var mu sync.Mutex
+	cache := make(map[string]cachedResult)
+
+	r.RegisterFunction(name, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		key, err := argsKey(args)
+		if err != nil {
+			return fn(args, ctx)
+		}
+
+		now := ctx.Now()
+		mu.Lock()
+		entry, ok := cache[key]
+		mu.Unlock()
+		if ok && now.Before(entry.expiresAt) {
+			return deepCopy(entry.value), nil
+		}
+
+		result, err := fn(args, ctx)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		if len(cache) >= maxCachedResults {
+			evictCachedResults(cache, now)
+		}
+		cache[key] = cachedResult{value: deepCopy(result), expiresAt: now.Add(ttl)}
+		mu.Unlock()
+		return result, nil
+	})
+}
+
+func evictCachedResults(cache map[string]cachedResult, now time.Time) {
+	oldestKey := ""
+	var oldest time.Time
+	for key, entry := range cache {
+		if !now.Before(entry.expiresAt) {
+			delete(cache, key)
+			continue
+		}
+		if oldestKey == "" || entry.expiresAt.Before(oldest) {
+			oldestKey, oldest = key, entry.expiresAt
+		}
+	}
+	if len(cache) >= maxCachedResults {
+		delete(cache, oldestKey)
+	}
+}
+
+// maxRetryBackoff caps the doubling backoff between retries, since a real
+// sleep holds up every request queued behind the fn.call.
+const maxRetryBackoff = 30 * time.Second
+
+// RegisterRetryableFunction retries fn up to attempts times, doubling backoff
+// (up to maxRetryBackoff) between attempts. With a mocked clock the backoff
+// advances virtual time instead of sleeping, so retries stay instant and
+// deterministic and ctx.Now() still shows the time they took. A backoff that
+// would run past the run deadline gives up with CodeDeadlineExceeded.
+// Successful results are wrapped as {"result": ..., "attempts": n}.
+func (r *BaseRegistry) RegisterRetryableFunction(name string, attempts int, backoff time.Duration, fn func(args map[string]interface{}, ctx *Context) (interface{}, error)) {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	r.RegisterFunction(name, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		delay := backoff
+		var err error
+		for attempt := 1; attempt <= attempts; attempt++ {
+			var result interface{}
+			result, err = fn(args, ctx)
+			if err == nil {
+				return map[string]interface{}{"result": result, "attempts": attempt}, nil
+			}
+			if attempt == attempts {
+				break
+			}
+			if delay > maxRetryBackoff {
+				delay = maxRetryBackoff
+			}
+			if delay > 0 {
+				if remaining, ok := ctx.TimeRemaining(); ok && delay > remaining {
+					deadlineErr := newBridgeError(CodeDeadlineExceeded, "%s failed after %d attempts and the next retry in %v would run past the run deadline", name, attempt, delay)
+					deadlineErr.Cause = err
+					return nil, deadlineErr
+				}
+				if _, advanced := ctx.AdvanceClock(delay); !advanced {
+					time.Sleep(delay)
+				}
+			}
+			delay *= 2
+		}
+		return nil, fmt.Errorf("%s failed after %d attempts: %w", name, attempts, err)
+	})
+}
+
+func argsKey(args map[string]interface{}) (string, error) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (r *BaseRegistry) RegisterAssertion(name string, fn func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult) {
+	r.assertions[name] = func(params map[string]interface{}, ctx *Context) AssertionResult {
+		return fn(params, ctx.ReadOnly())
+	}
+	r.assertInfo[name] = AssertionInfo{Name: name, Params: []AssertionParam{}}
+}
+
+// RegisterAssertionWithSchema registers an assertion together with the
+// params it expects (in the spec format of withRequiredParams) and a short
+// description, both reported by registry.describeAssertion. Missing or
+// mistyped params fail the assertion before fn runs.
+func (r *BaseRegistry) RegisterAssertionWithSchema(name, description string, params []string, fn func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult) {
+	r.RegisterAssertion(name, withRequiredParams(fn, params...))
+	r.assertInfo[name] = AssertionInfo{Name: name, Description: description, Params: parseParamSpecs(params)}
+}
+
+// RegisterLegacyAssertion registers an assertion that receives the mutable
+// context, so plugins written before RegisterAssertion took a
+// ReadOnlyContext keep compiling.
+//
+// Deprecated: assertions that only read the context should use
+// RegisterAssertion; ones that write to it should move those writes into a
+// function or hook.
+func (r *BaseRegistry) RegisterLegacyAssertion(name string, fn func(params map[string]interface{}, ctx *Context) AssertionResult) {
 	r.assertions[name] = fn
+	r.assertInfo[name] = AssertionInfo{Name: name, Params: []AssertionParam{}}
+}
+
+func (r *BaseRegistry) DescribeAssertion(name string) (AssertionInfo, bool) {
+	info, ok := r.assertInfo[name]
+	return info, ok
 }
 
 func (r *BaseRegistry) RegisterHook(name string, fn func(ctx *Context) error) {
+	delete(r.ctxHooks, name)
+	delete(r.paramHooks, name)
 	r.hooks[name] = fn
 }
 
+// RegisterConditionalHook registers a hook that only runs when when reports
+// true for the context it is called with, e.g. a before_each limited to the
+// steps of one job. A skipped hook counts as a successful call.
+func (r *BaseRegistry) RegisterConditionalHook(name string, when func(ctx *Context) bool, fn func(ctx *Context) error) {
+	r.RegisterHook(name, func(ctx *Context) error {
+		if !when(ctx) {
+			return nil
+		}
+		return fn(ctx)
+	})
+}
+
+func (r *BaseRegistry) RegisterContextHook(name string, fn func(ctx *Context) (map[string]interface{}, error)) {
+	delete(r.hooks, name)
+	delete(r.paramHooks, name)
+	r.ctxHooks[name] = fn
+}
+
+// RegisterHookWithParams registers a hook that also receives the hookParams
+// sent with hook.call (an empty map when none were sent), so one hook can
+// behave differently per invocation.
+func (r *BaseRegistry) RegisterHookWithParams(name string, fn func(ctx *Context, params map[string]interface{}) error) {
+	delete(r.hooks, name)
+	delete(r.ctxHooks, name)
+	r.paramHooks[name] = fn
+}
+
 func (r *BaseRegistry) Call(name string, args map[string]interface{}, ctx *Context) (interface{}, error) {
 	fn, ok := r.functions[name]
 	if !ok {
@@ -35,19 +275,49 @@ func (r *BaseRegistry) Call(name string, args map[string]interface{}, ctx *Conte
 		for k := range r.functions {
 			available = append(available, k)
 		}
-		return nil, fmt.Errorf("function not found: %s. Available: %v", name, available)
+		return nil, functionNotFound(name, available)
+	}
+	if defaults := r.info[name].Defaults; len(defaults) > 0 {
+		args = applyDefaults(args, defaults)
 	}
 	return fn(args, ctx)
 }
 
+// applyDefaults returns a copy of args with a copy of each default whose key
+// is absent, leaving the caller's map and the registered defaults untouched.
+func applyDefaults(args, defaults map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(args)+len(defaults))
+	for k, v := range args {
+		merged[k] = v
+	}
+	for k, v := range defaults {
+		if _, ok := merged[k]; !ok {
+			merged[k] = deepCopy(v)
+		}
+	}
+	return merged
+}
+
 func (r *BaseRegistry) ListFunctions() []FunctionInfo {
-	functions := make([]FunctionInfo, 0, len(r.functions))
-	for name := range r.functions {
-		functions = append(functions, FunctionInfo{Name: name})
+	return r.FindFunctions("*")
+}
+
+func (r *BaseRegistry) FindFunctions(pattern string) []FunctionInfo {
+	functions := make([]FunctionInfo, 0)
+	for name, info := range r.info {
+		if matchPattern(pattern, name) {
+			functions = append(functions, info)
+		}
 	}
+	sort.Slice(functions, func(i, j int) bool { return functions[i].Name < functions[j].Name })
 	return functions
 }
 
+func (r *BaseRegistry) Describe(name string) (FunctionInfo, bool) {
+	info, ok := r.info[name]
+	return info, ok
+}
+
 func (r *BaseRegistry) CallAssertion(name string, params map[string]interface{}, ctx *Context) AssertionResult {
 	fn, ok := r.assertions[name]
 	if !ok {
@@ -57,16 +327,64 @@ func (r *BaseRegistry) CallAssertion(name string, params map[string]interface{},
 		}
 		return AssertionResult{
 			Success: false,
-			Message: fmt.Sprintf("assertion not found: %s. Available: %v", name, available),
+			Message: assertionNotFound(name, available).Error(),
 		}
 	}
 	return fn(params, ctx)
 }
 
+func (r *BaseRegistry) ListAssertions() []string {
+	assertions := make([]string, 0, len(r.assertions))
+	for name := range r.assertions {
+		assertions = append(assertions, name)
+	}
+	sort.Strings(assertions)
+	return assertions
+}
+
+func (r *BaseRegistry) ListHooks() []string {
+	hooks := make([]string, 0, len(r.hooks)+len(r.ctxHooks)+len(r.paramHooks))
+	for name := range r.hooks {
+		hooks = append(hooks, name)
+	}
+	for name := range r.ctxHooks {
+		hooks = append(hooks, name)
+	}
+	for name := range r.paramHooks {
+		hooks = append(hooks, name)
+	}
+	sort.Strings(hooks)
+	return hooks
+}
+
 func (r *BaseRegistry) CallHook(hook string, ctx *Context) error {
+	values, err := r.CallContextHook(hook, ctx)
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		ctx.Set(k, v)
+	}
+	return nil
+}
+
+func (r *BaseRegistry) CallContextHook(hook string, ctx *Context) (map[string]interface{}, error) {
+	return r.CallHookWithParams(hook, nil, ctx)
+}
+
+func (r *BaseRegistry) CallHookWithParams(hook string, params map[string]interface{}, ctx *Context) (map[string]interface{}, error) {
+	if fn, ok := r.ctxHooks[hook]; ok {
+		return fn(ctx)
+	}
+	if fn, ok := r.paramHooks[hook]; ok {
+		if params == nil {
+			params = map[string]interface{}{}
+		}
+		return nil, fn(ctx, params)
+	}
 	fn, ok := r.hooks[hook]
 	if !ok {
-		return nil
+		return nil, nil
 	}
-	return fn(ctx)
+	return nil, fn(ctx)
 }
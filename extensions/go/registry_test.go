@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func noop(args map[string]interface{}, ctx *Context) (interface{}, error) {
+	return nil, nil
+}
+
+func functionNames(functions []FunctionInfo) []string {
+	names := make([]string, 0, len(functions))
+	for _, info := range functions {
+		names = append(names, info.Name)
+	}
+	return names
+}
+
+func TestFindFunctionsByPattern(t *testing.T) {
+	r := NewBaseRegistry()
+	for _, name := range []string{"create_user", "create_order", "get_user"} {
+		r.RegisterFunction(name, noop)
+	}
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"create_*", []string{"create_order", "create_user"}},
+		{"*_user", []string{"create_user", "get_user"}},
+		{"get_user", []string{"get_user"}},
+		{"zzz*", []string{}},
+	}
+	for _, tt := range tests {
+		if got := functionNames(r.FindFunctions(tt.pattern)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FindFunctions(%q) = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+	if got, all := len(r.FindFunctions("*")), len(r.ListFunctions()); got != all {
+		t.Fatalf("FindFunctions(*) found %d, ListFunctions %d", got, all)
+	}
+}
+
+func TestRegisterFunctionWithTags(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterFunctionWithTags("db_write", []string{"mutation", "db"}, noop)
+	info, ok := r.Describe("db_write")
+	if !ok {
+		t.Fatal("db_write not registered")
+	}
+	if want := []string{"db", "mutation"}; !reflect.DeepEqual(info.Tags, want) {
+		t.Fatalf("tags = %v, want them sorted as %v", info.Tags, want)
+	}
+}
+
+func TestRegisterFunctionWithDefaults(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterFunctionWithDefaults("greet", map[string]interface{}{"name": "World"}, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return "Hello, " + args["name"].(string) + "!", nil
+	})
+	for _, tt := range []struct {
+		args map[string]interface{}
+		want string
+	}{
+		{nil, "Hello, World!"},
+		{map[string]interface{}{"name": "Bob"}, "Hello, Bob!"},
+	} {
+		got, err := r.Call("greet", tt.args, NewContext())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("greet(%v) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+	if info, _ := r.Describe("greet"); info.Defaults["name"] != "World" {
+		t.Fatalf("Describe does not report the defaults: %+v", info)
+	}
+}
+
+func TestDefaultsAreCopiedPerCall(t *testing.T) {
+	r := NewBaseRegistry()
+	defaults := map[string]interface{}{"x": map[string]interface{}{"a": 1.0}}
+	r.RegisterFunctionWithDefaults("mutate", defaults, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		args["x"].(map[string]interface{})["a"] = 2.0
+		return nil, nil
+	})
+	args := map[string]interface{}{"y": nil}
+	if _, err := r.Call("mutate", args, NewContext()); err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 1 {
+		t.Fatalf("defaults were merged into the caller's args: %v", args)
+	}
+	if defaults["x"].(map[string]interface{})["a"] != 1.0 {
+		t.Fatalf("the function mutated the registered defaults: %v", defaults)
+	}
+}
+
+func TestRegisterFunctionWithExamples(t *testing.T) {
+	r := NewBaseRegistry()
+	examples := []map[string]interface{}{{"args": map[string]interface{}{"a": 1.0, "b": 2.0}, "result": 3.0}}
+	r.RegisterFunctionWithExamples("sum", examples, noop)
+	info, _ := r.Describe("sum")
+	if !reflect.DeepEqual(info.Examples, examples) {
+		t.Fatalf("examples = %v, want %v", info.Examples, examples)
+	}
+}
+
+func TestRegisterFunctionWithLimit(t *testing.T) {
+	r := NewBaseRegistry()
+	var running, peak int32
+	r.RegisterFunctionWithLimit("db", 2, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			seen := atomic.LoadInt32(&peak)
+			if n <= seen || atomic.CompareAndSwapInt32(&peak, seen, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil, nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Call("db", nil, NewContext())
+		}()
+	}
+	wg.Wait()
+	if peak != 2 {
+		t.Fatalf("peak concurrency = %d, want 2", peak)
+	}
+}
+
+func TestRegisterCachedFunction(t *testing.T) {
+	r := NewBaseRegistry()
+	calls := 0
+	r.RegisterCachedFunction("lookup", time.Second, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		calls++
+		return calls, nil
+	})
+	ctx := NewContext()
+	ms := int64(1000)
+	ctx.Clock = &ClockState{VirtualTimeMs: &ms, Frozen: true}
+
+	r.Call("lookup", map[string]interface{}{"x": 1}, ctx)
+	r.Call("lookup", map[string]interface{}{"x": 1}, ctx)
+	if calls != 1 {
+		t.Fatalf("equal args ran the function %d times, want 1", calls)
+	}
+	r.Call("lookup", map[string]interface{}{"x": 2}, ctx)
+	if calls != 2 {
+		t.Fatalf("different args hit the cache")
+	}
+	later := int64(2000)
+	ctx.Clock = &ClockState{VirtualTimeMs: &later, Frozen: true}
+	r.Call("lookup", map[string]interface{}{"x": 1}, ctx)
+	if calls != 3 {
+		t.Fatalf("an expired entry was served from the cache")
+	}
+}
+
+func TestCachedResultsAreCopiedPerCaller(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterCachedFunction("lookup", time.Minute, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return map[string]interface{}{"status": "fresh"}, nil
+	})
+	ctx := NewContext()
+	first, _ := r.Call("lookup", map[string]interface{}{}, ctx)
+	first.(map[string]interface{})["status"] = "mutated"
+	second, _ := r.Call("lookup", map[string]interface{}{}, ctx)
+	second.(map[string]interface{})["status"] = "mutated again"
+	third, _ := r.Call("lookup", map[string]interface{}{}, ctx)
+	if got := third.(map[string]interface{})["status"]; got != "fresh" {
+		t.Fatalf("cached status = %v, want fresh", got)
+	}
+}
+
+func TestCachedFunctionEvictsWhenFull(t *testing.T) {
+	r := NewBaseRegistry()
+	calls := 0
+	r.RegisterCachedFunction("lookup", time.Minute, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		calls++
+		return nil, nil
+	})
+	ctx := NewContext()
+	ms := int64(0)
+	ctx.Clock = &ClockState{VirtualTimeMs: &ms, Frozen: true}
+	for i := 0; i <= maxCachedResults; i++ {
+		ms = int64(i)
+		r.Call("lookup", map[string]interface{}{"i": i}, ctx)
+	}
+	r.Call("lookup", map[string]interface{}{"i": maxCachedResults}, ctx)
+	if calls != maxCachedResults+1 {
+		t.Fatalf("newest entry was not cached: %d calls", calls)
+	}
+	r.Call("lookup", map[string]interface{}{"i": 0}, ctx)
+	if calls != maxCachedResults+2 {
+		t.Fatalf("oldest entry survived a full cache")
+	}
+}
+
+func TestRegisterRetryableFunction(t *testing.T) {
+	r := NewBaseRegistry()
+	attempts := 0
+	r.RegisterRetryableFunction("flaky", 3, time.Millisecond, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("not yet")
+		}
+		return "ok", nil
+	})
+	r.RegisterRetryableFunction("broken", 2, time.Hour, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return nil, errors.New("always")
+	})
+
+	result, err := r.Call("flaky", nil, NewContext())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"result": "ok", "attempts": 3}; !reflect.DeepEqual(result, want) {
+		t.Fatalf("flaky = %v, want %v", result, want)
+	}
+
+	ctx := NewContext()
+	ms := int64(1000)
+	ctx.Clock = &ClockState{VirtualTimeMs: &ms, Frozen: true}
+	start := time.Now()
+	_, err = r.Call("broken", nil, ctx)
+	if err == nil || err.Error() != "broken failed after 2 attempts: always" {
+		t.Fatalf("broken = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("a mocked clock still slept the backoff (%v)", elapsed)
+	}
+	if got := ctx.Now().UnixMilli(); got != 1000+maxRetryBackoff.Milliseconds() {
+		t.Fatalf("virtual time after a capped backoff = %d", got)
+	}
+}
+
+func TestRetryBackoffAdvancesMockedClockAndHonorsDeadline(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterRetryableFunction("broken", 4, 10*time.Millisecond, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return nil, errors.New("always")
+	})
+	ctx := NewContext()
+	ms := int64(0)
+	ctx.Clock = &ClockState{VirtualTimeMs: &ms, Frozen: true}
+	r.Call("broken", nil, ctx)
+	if got := ctx.Now().UnixMilli(); got != 70 {
+		t.Fatalf("virtual time after backoffs of 10, 20 and 40ms = %d, want 70", got)
+	}
+
+	ctx.SetDeadline(ctx.Now().Add(15 * time.Millisecond))
+	_, err := r.Call("broken", nil, ctx)
+	if code := errorCode(err); code != CodeDeadlineExceeded {
+		t.Fatalf("retry past the deadline = %v (code %d)", err, code)
+	}
+	if got := ctx.Now().UnixMilli(); got != 80 {
+		t.Fatalf("virtual time = %d, want only the 10ms backoff that fit", got)
+	}
+
+	r.RegisterRetryableFunction("slow_retry", 2, time.Hour, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return nil, errors.New("always")
+	})
+	real := NewContext()
+	real.SetDeadline(time.Now().Add(time.Second))
+	start := time.Now()
+	if _, err := r.Call("slow_retry", nil, real); errorCode(err) != CodeDeadlineExceeded {
+		t.Fatalf("real-clock retry past the deadline = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("gave up after %v, want before sleeping past the deadline", elapsed)
+	}
+}
+
+func TestAssertionsGetReadOnlyContext(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterAssertion("sneaky", func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+		ctx.Get("m").(map[string]interface{})["x"] = 2
+		return AssertionResult{Success: true}
+	})
+	ctx := NewContext()
+	ctx.Set("m", map[string]interface{}{"x": 1})
+	r.CallAssertion("sneaky", nil, ctx)
+	if got := ctx.Get("m").(map[string]interface{})["x"]; got != 1 {
+		t.Fatalf("assertion mutated the context: x = %v", got)
+	}
+}
+
+func TestListHooksCoversEveryKind(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterHook("after_all", func(ctx *Context) error { return nil })
+	r.RegisterContextHook("before_all", func(ctx *Context) (map[string]interface{}, error) { return nil, nil })
+	r.RegisterHookWithParams("before_each", func(ctx *Context, params map[string]interface{}) error { return nil })
+	if got, want := r.ListHooks(), []string{"after_all", "before_all", "before_each"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ListHooks = %v, want %v", got, want)
+	}
+}
+
+func TestContextHookValuesLandInContext(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterContextHook("before_all", func(ctx *Context) (map[string]interface{}, error) {
+		return map[string]interface{}{"test_started": "now"}, nil
+	})
+	ctx := NewContext()
+	if err := r.CallHook("before_all", ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := ctx.Get("test_started"); got != "now" {
+		t.Fatalf("test_started = %v, want now", got)
+	}
+}
+
+func TestHookWithParamsGetsEmptyMapWhenNoneSent(t *testing.T) {
+	r := NewBaseRegistry()
+	var got map[string]interface{}
+	r.RegisterHookWithParams("before_each", func(ctx *Context, params map[string]interface{}) error {
+		got = params
+		return nil
+	})
+	if _, err := r.CallHookWithParams("before_each", map[string]interface{}{"step": "build"}, NewContext()); err != nil {
+		t.Fatal(err)
+	}
+	if got["step"] != "build" {
+		t.Fatalf("params = %v, want step build", got)
+	}
+	if err := r.CallHook("before_each", NewContext()); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || len(got) != 0 {
+		t.Fatalf("params without hookParams = %#v, want an empty map", got)
+	}
+}
+
+func TestRegisterConditionalHook(t *testing.T) {
+	r := NewBaseRegistry()
+	runs := 0
+	r.RegisterConditionalHook("before_each", func(ctx *Context) bool { return ctx.JobName == "deploy" }, func(ctx *Context) error {
+		runs++
+		return nil
+	})
+	ctx := NewContext()
+	ctx.JobName = "build"
+	if err := r.CallHook("before_each", ctx); err != nil || runs != 0 {
+		t.Fatalf("skipped hook: err = %v, runs = %d", err, runs)
+	}
+	ctx.JobName = "deploy"
+	if err := r.CallHook("before_each", ctx); err != nil || runs != 1 {
+		t.Fatalf("matching hook: err = %v, runs = %d", err, runs)
+	}
+}
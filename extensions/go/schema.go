@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// validateSchema checks value against a small JSON Schema subset: "type"
+// (a name or a list of names), "required" and "properties", applied
+// recursively. It returns one message per violation, each prefixed with the
+// path of the offending value ("$" is the root), sorted for stable output.
+func validateSchema(value interface{}, schema map[string]interface{}) []string {
+	violations := schemaViolations(value, schema, "$")
+	sort.Strings(violations)
+	return violations
+}
+
+func schemaViolations(value interface{}, schema map[string]interface{}, path string) []string {
+	if raw, ok := schema["type"]; ok {
+		if !matchesSchemaType(value, raw) {
+			return []string{fmt.Sprintf("%s: expected %s, got %s", path, describeSchemaType(raw), jsonTypeName(value))}
+		}
+	}
+
+	object, isObject := value.(map[string]interface{})
+	if !isObject {
+		return nil
+	}
+
+	var violations []string
+	if required, ok := toSlice(schema["required"]); ok {
+		for _, name := range required {
+			key, _ := name.(string)
+			if _, present := object[key]; !present {
+				violations = append(violations, fmt.Sprintf("%s.%s: missing required property", path, key))
+			}
+		}
+	}
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		for key, sub := range properties {
+			subSchema, ok := sub.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if child, present := object[key]; present {
+				violations = append(violations, schemaViolations(child, subSchema, path+"."+key)...)
+			}
+		}
+	}
+	return violations
+}
+
+func matchesSchemaType(value interface{}, raw interface{}) bool {
+	if names, ok := toSlice(raw); ok {
+		for _, name := range names {
+			if matchesSchemaType(value, name) {
+				return true
+			}
+		}
+		return false
+	}
+	name, _ := raw.(string)
+	switch name {
+	case "integer":
+		n, ok := toFloat(value)
+		return ok && n == float64(int64(n))
+	case "number":
+		_, ok := toFloat(value)
+		return ok
+	}
+	return jsonTypeName(value) == name
+}
+
+func describeSchemaType(raw interface{}) string {
+	if names, ok := toSlice(raw); ok {
+		return fmt.Sprintf("one of %v", names)
+	}
+	return fmt.Sprintf("%v", raw)
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case map[string]interface{}:
+		return "object"
+	}
+	if _, ok := toFloat(value); ok {
+		return "number"
+	}
+	if _, ok := toSlice(value); ok {
+		return "array"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateSchema(t *testing.T) {
+	var schema map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["id", "name"],
+		"properties": {
+			"id": {"type": "integer"},
+			"name": {"type": "string"},
+			"tags": {"type": ["array", "null"]}
+		}
+	}`), &schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		actual string
+		want   []string
+	}{
+		{`{"id": 1, "name": "a", "tags": null}`, nil},
+		{`{"id": 1, "name": "a", "tags": ["x"]}`, nil},
+		{`{"id": 1}`, []string{"$.name: missing required property"}},
+		{`{"id": "1", "name": "a"}`, []string{"$.id: expected integer, got string"}},
+		{`{"id": 1.5, "name": "a"}`, []string{"$.id: expected integer, got number"}},
+		{`[]`, []string{"$: expected object, got array"}},
+	}
+	for _, tt := range tests {
+		var actual interface{}
+		if err := json.Unmarshal([]byte(tt.actual), &actual); err != nil {
+			t.Fatal(err)
+		}
+		got := validateSchema(actual, schema)
+		if len(got) != len(tt.want) {
+			t.Errorf("validateSchema(%s) = %q, want %q", tt.actual, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("validateSchema(%s) = %q, want %q", tt.actual, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMatchesSchemaAssertion(t *testing.T) {
+	schema := map[string]interface{}{"type": "object", "required": []interface{}{"id"}}
+	r := NewBaseRegistry()
+	if result := r.CallAssertion("matches_schema", map[string]interface{}{"actual": map[string]interface{}{"id": 1.0}, "schema": schema}, NewContext()); !result.Success {
+		t.Fatalf("valid value: %s", result.Message)
+	}
+	result := r.CallAssertion("matches_schema", map[string]interface{}{"actual": map[string]interface{}{}, "schema": schema}, NewContext())
+	if want := "schema violations: $.id: missing required property"; result.Success || result.Message != want {
+		t.Fatalf("missing id = %q, want %q", result.Message, want)
+	}
+}
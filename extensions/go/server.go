@@ -2,35 +2,78 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"os/signal"
 	"plugin"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
+	"unicode"
 )
 
 type ClockState struct {
 	VirtualTimeMs  *int64  `json:"virtual_time_ms"`
 	VirtualTimeIso *string `json:"virtual_time_iso"`
 	Frozen         bool    `json:"frozen"`
+	// OffsetMs shifts the real clock instead of replacing it; it only
+	// applies when VirtualTimeMs is unset.
+	OffsetMs *int64 `json:"offset_ms,omitempty"`
 }
 
 type Context struct {
-	data     map[string]interface{}
-	steps    map[string]map[string]interface{}
-	RunID    string
-	JobName  string
-	StepName string
-	Clock    *ClockState
-	mu       sync.RWMutex
+	data      map[string]interface{}
+	steps     map[string]map[string]interface{}
+	snapshots map[string]contextSnapshot
+	snapSeq   int
+	RunID     string
+	JobName   string
+	StepName  string
+	Clock     *ClockState
+	Deadline  time.Time
+	mu        sync.RWMutex
+
+	// HistoryDepth is how many versions of each key are kept for
+	// History; 0, the default, keeps none.
+	HistoryDepth int
+	versions     map[string][]ValueVersion
+
+	logMu       sync.Mutex
+	logSink     func(LogEvent)
+	requestID   interface{}
+	pendingLogs []LogEvent
+
+	watchMu  sync.Mutex
+	watchers map[int]*contextWatcher
+	watchSeq int
+
+	lockMu sync.Mutex
+	locks  map[string]*namedLock
+
+	// assertionCaller dispatches assertions nested inside another one
+	// (all_match, any_match) through the server, so they resolve against
+	// its full registry and get the same --loose-equals handling as
+	// assert.custom. It is nil for a Context used without a server.
+	assertionCaller func(name string, params map[string]interface{}) AssertionResult
 }
 
 func NewContext() *Context {
 	return &Context{
-		data:  make(map[string]interface{}),
-		steps: make(map[string]map[string]interface{}),
+		data:      make(map[string]interface{}),
+		steps:     make(map[string]map[string]interface{}),
+		snapshots: make(map[string]contextSnapshot),
 	}
 }
 
@@ -40,326 +83,3221 @@ func (c *Context) Get(key string) interface{} {
 	return c.data[key]
 }
 
+// GetMany reads keys under a single lock, giving a consistent view of all of
+// them. Missing keys map to nil.
+func (c *Context) GetMany(keys []string) map[string]interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	values := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		values[key] = c.data[key]
+	}
+	return values
+}
+
+func (c *Context) GetOrDefault(key string, def interface{}) interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if value, present := c.data[key]; present {
+		return value
+	}
+	return def
+}
+
+// Has reports whether key is set, including when it is set to nil.
+func (c *Context) Has(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, present := c.data[key]
+	return present
+}
+
 func (c *Context) Set(key string, value interface{}) {
+	at := c.versionTime()
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	c.data[key] = value
+	c.recordVersion(key, value, at)
+	c.mu.Unlock()
+	c.notifyWatchers(key, false)
 }
 
 func (c *Context) Remove(key string) bool {
+	at := c.versionTime()
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if _, exists := c.data[key]; exists {
+	_, exists := c.data[key]
+	if exists {
 		delete(c.data, key)
-		return true
+		c.recordRemoval(key, at)
 	}
-	return false
+	c.mu.Unlock()
+	if exists {
+		c.notifyWatchers(key, true)
+	}
+	return exists
+}
+
+// Rename moves the value at from to to, overwriting any existing value at
+// to. It reports false and leaves the context untouched if from is unset.
+func (c *Context) Rename(from, to string) bool {
+	at := c.versionTime()
+	c.mu.Lock()
+	value, exists := c.data[from]
+	if !exists {
+		c.mu.Unlock()
+		return false
+	}
+	delete(c.data, from)
+	c.data[to] = value
+	if from != to {
+		c.recordRemoval(from, at)
+	}
+	c.recordVersion(to, value, at)
+	c.mu.Unlock()
+	if from != to {
+		c.notifyWatchers(from, true)
+	}
+	c.notifyWatchers(to, false)
+	return true
+}
+
+// Swap exchanges the values at a and b under a single lock and returns their
+// new values. A missing key is treated as nil, so swapping with it leaves the
+// other key set to nil.
+func (c *Context) Swap(a, b string) (interface{}, interface{}) {
+	at := c.versionTime()
+	c.mu.Lock()
+	valueA, valueB := c.data[a], c.data[b]
+	c.data[a], c.data[b] = valueB, valueA
+	c.recordVersion(a, valueB, at)
+	if a != b {
+		c.recordVersion(b, valueA, at)
+	}
+	c.mu.Unlock()
+	c.notifyWatchers(a, false)
+	c.notifyWatchers(b, false)
+	return valueB, valueA
 }
 
 func (c *Context) Clear(pattern string) int {
+	at := c.versionTime()
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	count := 0
+	var removed []string
 	for key := range c.data {
 		if matchPattern(pattern, key) {
 			delete(c.data, key)
-			count++
+			c.recordRemoval(key, at)
+			removed = append(removed, key)
 		}
 	}
-	return count
+	c.mu.Unlock()
+	for _, key := range removed {
+		c.notifyWatchers(key, true)
+	}
+	return len(removed)
 }
 
-func (c *Context) GetStepOutput(stepID, outputName string) interface{} {
+type StepRow struct {
+	StepID  string      `json:"stepId"`
+	Outputs interface{} `json:"outputs"`
+}
+
+// StepsTable returns the outputs of every step whose id matches pattern,
+// sorted by step id.
+func (c *Context) StepsTable(pattern string) []StepRow {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	if step, ok := c.steps[stepID]; ok {
-		if outputs, ok := step["outputs"].(map[string]interface{}); ok {
-			return outputs[outputName]
+	rows := make([]StepRow, 0, len(c.steps))
+	for id, step := range c.steps {
+		if matchPattern(pattern, id) {
+			rows = append(rows, StepRow{StepID: id, Outputs: deepCopy(step["outputs"])})
 		}
 	}
-	return nil
+	sort.Slice(rows, func(i, j int) bool { return rows[i].StepID < rows[j].StepID })
+	return rows
 }
 
-func matchPattern(pattern, s string) bool {
-	if pattern == "*" {
-		return true
-	}
-	if strings.HasSuffix(pattern, "*") {
-		return strings.HasPrefix(s, pattern[:len(pattern)-1])
-	}
-	if strings.HasPrefix(pattern, "*") {
-		return strings.HasSuffix(s, pattern[1:])
+// ClearSteps removes the outputs of stepID, or of every step when stepID is
+// empty, and returns how many steps were cleared. Context data is untouched.
+func (c *Context) ClearSteps(stepID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stepID != "" {
+		if _, exists := c.steps[stepID]; !exists {
+			return 0
+		}
+		delete(c.steps, stepID)
+		return 1
 	}
-	return pattern == s
+	count := len(c.steps)
+	c.steps = make(map[string]map[string]interface{})
+	return count
 }
 
-type FunctionInfo struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
+type LogEvent struct {
+	ID      interface{}            `json:"id"`
+	Level   string                 `json:"level"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
 }
 
-type AssertionResult struct {
-	Success  bool        `json:"success"`
-	Message  string      `json:"message,omitempty"`
-	Actual   interface{} `json:"actual,omitempty"`
-	Expected interface{} `json:"expected,omitempty"`
+func (c *Context) Log(level, message string, fields map[string]interface{}) {
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	event := LogEvent{ID: c.requestID, Level: level, Message: message, Fields: fields}
+	if c.logSink == nil {
+		c.pendingLogs = append(c.pendingLogs, event)
+		return
+	}
+	c.logSink(event)
 }
 
-type Registry interface {
-	Call(name string, args map[string]interface{}, ctx *Context) (interface{}, error)
-	ListFunctions() []FunctionInfo
-	CallAssertion(name string, params map[string]interface{}, ctx *Context) AssertionResult
-	CallHook(hook string, ctx *Context) error
+func (c *Context) attachLogSink(requestID interface{}, sink func(LogEvent)) {
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	c.requestID = requestID
+	c.logSink = sink
+	for _, event := range c.pendingLogs {
+		sink(event)
+	}
+	c.pendingLogs = nil
 }
 
-type JSONRPCRequest struct {
-	JSONRPC string                 `json:"jsonrpc"`
-	ID      interface{}            `json:"id"`
-	Method  string                 `json:"method"`
-	Params  map[string]interface{} `json:"params"`
+func (c *Context) currentRequestID() interface{} {
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	return c.requestID
 }
 
-type JSONRPCResponse struct {
-	JSONRPC string      `json:"jsonrpc"`
-	ID      interface{} `json:"id"`
-	Result  interface{} `json:"result,omitempty"`
-	Error   *RPCError   `json:"error,omitempty"`
+func (c *Context) detachLogSink() {
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	c.requestID = nil
+	c.logSink = nil
 }
 
-type RPCError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+// contextSnapshot holds a copy of the data and, when the snapshot was taken
+// with includeSteps, of the step outputs; steps is nil otherwise.
+type contextSnapshot struct {
+	data  map[string]interface{}
+	steps map[string]map[string]interface{}
 }
 
-func jsonRPCSuccess(id interface{}, result interface{}) JSONRPCResponse {
-	return JSONRPCResponse{
-		JSONRPC: "2.0",
-		ID:      id,
-		Result:  result,
+func (c *Context) Snapshot(includeSteps bool) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.snapSeq++
+	token := fmt.Sprintf("snap-%d", c.snapSeq)
+	snapshot := contextSnapshot{data: deepCopy(c.data).(map[string]interface{})}
+	if includeSteps {
+		snapshot.steps = copySteps(c.steps)
 	}
+	c.snapshots[token] = snapshot
+	return token
 }
 
-func jsonRPCError(id interface{}, code int, message string) JSONRPCResponse {
-	return JSONRPCResponse{
-		JSONRPC: "2.0",
-		ID:      id,
-		Error:   &RPCError{Code: code, Message: message},
+func copySteps(steps map[string]map[string]interface{}) map[string]map[string]interface{} {
+	copied := make(map[string]map[string]interface{}, len(steps))
+	for id, step := range steps {
+		copied[id] = deepCopy(step).(map[string]interface{})
 	}
+	return copied
 }
 
-type Server struct {
-	registry Registry
-	ctx      *Context
+func (c *Context) Restore(token string) bool {
+	at := c.versionTime()
+	c.mu.Lock()
+	snapshot, ok := c.snapshots[token]
+	if !ok {
+		c.mu.Unlock()
+		return false
+	}
+	before := c.data
+	c.data = deepCopy(snapshot.data).(map[string]interface{})
+	after := c.data
+	c.recordReplaced(before, after, at)
+	if snapshot.steps != nil {
+		c.steps = copySteps(snapshot.steps)
+	}
+	c.mu.Unlock()
+	c.notifyReplaced(before, after)
+	return true
 }
 
-func NewServer(registry Registry) *Server {
-	return &Server{
-		registry: registry,
-		ctx:      NewContext(),
+func (c *Context) SnapshotData(token string) (map[string]interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if token == "current" {
+		return deepCopy(c.data).(map[string]interface{}), true
 	}
+	snapshot, ok := c.snapshots[token]
+	return snapshot.data, ok
 }
 
-func (s *Server) handleFnCall(params map[string]interface{}) (interface{}, error) {
-	name, _ := params["name"].(string)
-	args, _ := params["args"].(map[string]interface{})
-	if args == nil {
-		args = make(map[string]interface{})
-	}
+type ValueChange struct {
+	Key  string      `json:"key"`
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
 
-	result, err := s.registry.Call(name, args, s.ctx)
-	if err != nil {
-		return nil, err
-	}
-	return map[string]interface{}{"result": result}, nil
+type ContextDiff struct {
+	Added   []string      `json:"added"`
+	Removed []string      `json:"removed"`
+	Changed []ValueChange `json:"changed"`
 }
 
-func (s *Server) handleCtxGet(params map[string]interface{}) (interface{}, error) {
-	key, _ := params["key"].(string)
-	return map[string]interface{}{"value": s.ctx.Get(key)}, nil
+func DiffSnapshots(a, b map[string]interface{}) ContextDiff {
+	diff := ContextDiff{Added: []string{}, Removed: []string{}, Changed: []ValueChange{}}
+	for key, from := range a {
+		to, ok := b[key]
+		if !ok {
+			diff.Removed = append(diff.Removed, key)
+		} else if !deepEqual(from, to) {
+			diff.Changed = append(diff.Changed, ValueChange{Key: key, From: from, To: to})
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			diff.Added = append(diff.Added, key)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Key < diff.Changed[j].Key })
+	return diff
 }
 
-func (s *Server) handleCtxSet(params map[string]interface{}) (interface{}, error) {
-	key, _ := params["key"].(string)
-	value := params["value"]
-	s.ctx.Set(key, value)
-	return map[string]interface{}{}, nil
+func (c *Context) SetDeadline(deadline time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Deadline = deadline
 }
 
-func (s *Server) handleCtxClear(params map[string]interface{}) (interface{}, error) {
-	pattern, _ := params["pattern"].(string)
-	if pattern == "" {
-		pattern = "*"
+func (c *Context) TimeRemaining() (time.Duration, bool) {
+	c.mu.RLock()
+	deadline := c.Deadline
+	c.mu.RUnlock()
+	if deadline.IsZero() {
+		return 0, false
 	}
-	cleared := s.ctx.Clear(pattern)
-	return map[string]interface{}{"cleared": cleared}, nil
+	return deadline.Sub(c.Now()), true
 }
 
-func (s *Server) handleCtxSetExecutionInfo(params map[string]interface{}) (interface{}, error) {
-	s.ctx.RunID, _ = params["runId"].(string)
-	s.ctx.JobName, _ = params["jobName"].(string)
-	s.ctx.StepName, _ = params["stepName"].(string)
-	return map[string]interface{}{}, nil
+func (c *Context) deadlineExceeded() bool {
+	remaining, ok := c.TimeRemaining()
+	return ok && remaining <= 0
 }
 
-func (s *Server) handleCtxSyncStepOutputs(params map[string]interface{}) (interface{}, error) {
-	stepID, _ := params["stepId"].(string)
-	outputs, _ := params["outputs"].(map[string]interface{})
+func (c *Context) IsClockMocked() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Clock != nil && c.Clock.VirtualTimeMs != nil
+}
 
-	s.ctx.mu.Lock()
-	defer s.ctx.mu.Unlock()
+// Clock is the time source registered code should read instead of
+// time.Now, so it follows clock.sync and clock.offset.
+type Clock interface {
+	Now() time.Time
+}
 
-	if _, ok := s.ctx.steps[stepID]; !ok {
-		s.ctx.steps[stepID] = make(map[string]interface{})
-	}
-	s.ctx.steps[stepID]["outputs"] = outputs
-	return map[string]interface{}{}, nil
+// TimeSource returns the context's Clock. The exported Clock field is the
+// raw state clock.sync last set and is guarded by the context's lock;
+// TimeSource is the accessor functions should use.
+func (c *Context) TimeSource() Clock {
+	return c
 }
 
-func (s *Server) handleHookCall(params map[string]interface{}) (interface{}, error) {
-	hook, _ := params["hook"].(string)
-	err := s.registry.CallHook(hook, s.ctx)
-	if err != nil {
-		return nil, err
+// AdvanceClock moves a mocked clock forward by d and returns the new virtual
+// time. It reports false, leaving the clock alone, when time is not mocked.
+func (c *Context) AdvanceClock(d time.Duration) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Clock == nil || c.Clock.VirtualTimeMs == nil {
+		return time.Time{}, false
 	}
-	return map[string]interface{}{}, nil
+	now := time.UnixMilli(*c.Clock.VirtualTimeMs).Add(d)
+	ms := now.UnixMilli()
+	iso := now.UTC().Format(time.RFC3339Nano)
+	c.Clock = &ClockState{VirtualTimeMs: &ms, VirtualTimeIso: &iso, Frozen: c.Clock.Frozen}
+	return now, true
 }
 
-func (s *Server) handleAssertCustom(params map[string]interface{}) (interface{}, error) {
-	name, _ := params["name"].(string)
-	assertParams, _ := params["params"].(map[string]interface{})
-	if assertParams == nil {
-		assertParams = make(map[string]interface{})
+func (c *Context) Now() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.Clock != nil && c.Clock.VirtualTimeMs != nil {
+		return time.UnixMilli(*c.Clock.VirtualTimeMs)
+	}
+	if c.Clock != nil && c.Clock.OffsetMs != nil {
+		return time.Now().Add(time.Duration(*c.Clock.OffsetMs) * time.Millisecond)
 	}
+	return time.Now()
+}
 
-	result := s.registry.CallAssertion(name, assertParams, s.ctx)
-	return result, nil
+// FlattenEnv flattens the context into UPPER_SNAKE environment variable
+// names, joining nested map keys with "_". When two paths map to the same
+// name, the lexicographically first path wins.
+func (c *Context) FlattenEnv(prefix string) map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	env := make(map[string]string)
+	flattenEnvInto(env, envKey(prefix), c.data)
+	return env
 }
 
-func (s *Server) handleListFunctions(params map[string]interface{}) (interface{}, error) {
-	functions := s.registry.ListFunctions()
-	return map[string]interface{}{"functions": functions}, nil
+func flattenEnvInto(env map[string]string, prefix string, data map[string]interface{}) {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name := envKey(k)
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		if nested, ok := data[k].(map[string]interface{}); ok {
+			flattenEnvInto(env, name, nested)
+			continue
+		}
+		if _, exists := env[name]; !exists {
+			env[name] = envValue(data[k])
+		}
+	}
 }
 
-func (s *Server) handleClockSync(params map[string]interface{}) (interface{}, error) {
-	var virtualTimeMs *int64
-	var virtualTimeIso *string
+func envKey(key string) string {
+	var b strings.Builder
+	var prev rune
+	for i, r := range key {
+		switch {
+		case unicode.IsUpper(r):
+			if i > 0 && (unicode.IsLower(prev) || unicode.IsDigit(prev)) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToUpper(r))
+		default:
+			b.WriteByte('_')
+		}
+		prev = r
+	}
+	return b.String()
+}
 
-	if v, ok := params["virtual_time_ms"].(float64); ok {
-		ms := int64(v)
-		virtualTimeMs = &ms
+func envValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case bool:
+		return strconv.FormatBool(val)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
 	}
-	if v, ok := params["virtual_time_iso"].(string); ok {
-		virtualTimeIso = &v
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
 	}
-	frozen, _ := params["frozen"].(bool)
+	return string(data)
+}
 
-	s.ctx.Clock = &ClockState{
-		VirtualTimeMs:  virtualTimeMs,
-		VirtualTimeIso: virtualTimeIso,
-		Frozen:         frozen,
+type ContextExport struct {
+	Data  map[string]interface{}            `json:"data"`
+	Steps map[string]map[string]interface{} `json:"steps"`
+}
+
+func (c *Context) Export() ContextExport {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return ContextExport{Data: deepCopy(c.data).(map[string]interface{}), Steps: copySteps(c.steps)}
+}
+
+func (c *Context) Import(export ContextExport) {
+	at := c.versionTime()
+	c.mu.Lock()
+	before := c.data
+	c.data = make(map[string]interface{}, len(export.Data))
+	for k, v := range export.Data {
+		c.data[k] = deepCopy(v)
 	}
-	return map[string]interface{}{}, nil
+	after := c.data
+	c.recordReplaced(before, after, at)
+	c.steps = copySteps(export.Steps)
+	c.mu.Unlock()
+	c.notifyReplaced(before, after)
 }
 
-func (s *Server) Run() {
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+type ExecutionInfo struct {
+	RunID    string `json:"runId"`
+	JobName  string `json:"jobName"`
+	StepName string `json:"stepName"`
+}
 
-	fmt.Fprintln(os.Stderr, "Go bridge server started")
+// ReadOnlyContext is the view of a Context handed to assertions, which
+// should observe state rather than change it. Values are deep-copied on the
+// way out so mutating them has no effect on the context.
+type ReadOnlyContext struct {
+	ctx *Context
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
-		}
+func (c *Context) ReadOnly() *ReadOnlyContext {
+	return &ReadOnlyContext{ctx: c}
+}
 
-		var request JSONRPCRequest
-		if err := json.Unmarshal([]byte(line), &request); err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid JSON: %s\n", line)
-			continue
-		}
+func (r *ReadOnlyContext) Get(key string) interface{} {
+	return deepCopy(r.ctx.Get(key))
+}
 
-		var response JSONRPCResponse
+func (r *ReadOnlyContext) Has(key string) bool {
+	return r.ctx.Has(key)
+}
 
-		switch request.Method {
-		case "fn.call":
-			result, err := s.handleFnCall(request.Params)
-			if err != nil {
-				response = jsonRPCError(request.ID, -32000, err.Error())
-			} else {
-				response = jsonRPCSuccess(request.ID, result)
-			}
-		case "ctx.get":
-			result, _ := s.handleCtxGet(request.Params)
-			response = jsonRPCSuccess(request.ID, result)
-		case "ctx.set":
-			result, _ := s.handleCtxSet(request.Params)
-			response = jsonRPCSuccess(request.ID, result)
-		case "ctx.clear":
-			result, _ := s.handleCtxClear(request.Params)
-			response = jsonRPCSuccess(request.ID, result)
-		case "ctx.setExecutionInfo":
-			result, _ := s.handleCtxSetExecutionInfo(request.Params)
-			response = jsonRPCSuccess(request.ID, result)
-		case "ctx.syncStepOutputs":
-			result, _ := s.handleCtxSyncStepOutputs(request.Params)
-			response = jsonRPCSuccess(request.ID, result)
-		case "hook.call":
-			result, err := s.handleHookCall(request.Params)
-			if err != nil {
-				response = jsonRPCError(request.ID, -32000, err.Error())
-			} else {
-				response = jsonRPCSuccess(request.ID, result)
-			}
-		case "assert.custom":
-			result, _ := s.handleAssertCustom(request.Params)
-			response = jsonRPCSuccess(request.ID, result)
-		case "list_functions":
-			result, _ := s.handleListFunctions(request.Params)
-			response = jsonRPCSuccess(request.ID, result)
-		case "clock.sync":
-			result, _ := s.handleClockSync(request.Params)
-			response = jsonRPCSuccess(request.ID, result)
-		default:
-			response = jsonRPCError(request.ID, -32601, fmt.Sprintf("Method not found: %s", request.Method))
-		}
+func (r *ReadOnlyContext) GetStepOutput(stepID, outputName string) interface{} {
+	return deepCopy(r.ctx.GetStepOutput(stepID, outputName))
+}
+
+func (r *ReadOnlyContext) Resolve(ref string) (interface{}, bool) {
+	value, found := r.ctx.Resolve(ref)
+	return deepCopy(value), found
+}
+
+func (r *ReadOnlyContext) Now() time.Time {
+	return r.ctx.Now()
+}
+
+func (r *ReadOnlyContext) IsClockMocked() bool {
+	return r.ctx.IsClockMocked()
+}
+
+func (r *ReadOnlyContext) ExecutionInfo() ExecutionInfo {
+	r.ctx.mu.RLock()
+	defer r.ctx.mu.RUnlock()
+	return ExecutionInfo{RunID: r.ctx.RunID, JobName: r.ctx.JobName, StepName: r.ctx.StepName}
+}
 
-		responseJSON, _ := json.Marshal(response)
-		fmt.Println(string(responseJSON))
+// callAssertion runs a nested assertion through the server's caller when
+// the context belongs to one, and against fallback otherwise.
+func (r *ReadOnlyContext) callAssertion(fallback Registry, name string, params map[string]interface{}) AssertionResult {
+	if r.ctx.assertionCaller != nil {
+		return r.ctx.assertionCaller(name, params)
 	}
+	return fallback.CallAssertion(name, params, r.ctx)
 }
 
-func Serve(registry Registry) {
-	server := NewServer(registry)
-	server.Run()
+type ContextDump struct {
+	Data      map[string]interface{}            `json:"data"`
+	Steps     map[string]map[string]interface{} `json:"steps"`
+	Clock     *ClockState                       `json:"clock"`
+	Execution ExecutionInfo                     `json:"execution"`
 }
 
-func main() {
-	pluginPath := flag.String("plugin", "", "Path to the Go plugin (.so file)")
-	flag.Parse()
+const redactedValue = "[REDACTED]"
 
-	if *pluginPath == "" {
-		fmt.Fprintln(os.Stderr, "Usage: server --plugin path/to/registry.so")
-		os.Exit(1)
+func (c *Context) Dump(redact string) ContextDump {
+	export := c.Export()
+
+	c.mu.RLock()
+	dump := ContextDump{
+		Data:      export.Data,
+		Steps:     export.Steps,
+		Clock:     c.Clock,
+		Execution: ExecutionInfo{RunID: c.RunID, JobName: c.JobName, StepName: c.StepName},
 	}
+	c.mu.RUnlock()
 
-	p, err := plugin.Open(*pluginPath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to open plugin: %v\n", err)
-		os.Exit(1)
+	if redact != "" {
+		redactKeys(dump.Data, redact)
+		for _, step := range dump.Steps {
+			redactKeys(step, redact)
+		}
 	}
+	return dump
+}
 
-	sym, err := p.Lookup("Registry")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Plugin must export 'Registry' variable: %v\n", err)
-		os.Exit(1)
+func redactKeys(data map[string]interface{}, pattern string) {
+	for key, value := range data {
+		if matchRedactPattern(pattern, key) {
+			data[key] = redactedValue
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			redactKeys(nested, pattern)
+		}
 	}
+}
 
-	registry, ok := sym.(*Registry)
-	if !ok {
-		fmt.Fprintln(os.Stderr, "Registry must implement the Registry interface")
-		os.Exit(1)
+// matchRedactPattern is matchPattern plus *contains* globs such as
+// *secret*. It is kept separate so ctx.clear, watches and function lookups
+// keep their existing meaning for a pattern that starts and ends with *.
+func matchRedactPattern(pattern, key string) bool {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "*") && strings.HasSuffix(pattern, "*") {
+		return strings.Contains(key, pattern[1:len(pattern)-1])
 	}
+	return matchPattern(pattern, key)
+}
+
+type ContextStats struct {
+	KeyCount    int `json:"keyCount"`
+	StepCount   int `json:"stepCount"`
+	ApproxBytes int `json:"approxBytes"`
+}
 
-	Serve(*registry)
+// Fingerprint is the hex SHA-256 of the data serialized as JSON. Map keys
+// are always marshalled in sorted order, so the result does not depend on
+// insertion order.
+func (c *Context) Fingerprint() (string, error) {
+	c.mu.RLock()
+	data, err := json.Marshal(c.data)
+	c.mu.RUnlock()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (c *Context) Stats() ContextStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	stats := ContextStats{KeyCount: len(c.data), StepCount: len(c.steps)}
+	if data, err := json.Marshal(c.data); err == nil {
+		stats.ApproxBytes = len(data)
+	}
+	return stats
+}
+
+func (c *Context) Resolve(ref string) (interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	switch ref {
+	case "run:id":
+		return c.RunID, true
+	case "job:name":
+		return c.JobName, true
+	case "step:name":
+		return c.StepName, true
+	}
+
+	segments := strings.Split(ref, ".")
+	value, ok := c.data[segments[0]]
+	if !ok {
+		return nil, false
+	}
+	for _, segment := range segments[1:] {
+		nested, isMap := value.(map[string]interface{})
+		if !isMap {
+			return nil, false
+		}
+		if value, ok = nested[segment]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func (c *Context) SetStepOutputs(stepID string, outputs map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.steps[stepID]; !ok {
+		c.steps[stepID] = make(map[string]interface{})
+	}
+	c.steps[stepID]["outputs"] = outputs
+}
+
+// GetStepOutput returns a step output. outputName may be a dotted path such
+// as response.body.id into a nested output; an output whose own name
+// contains the dots takes precedence. Any missing segment yields nil.
+func (c *Context) GetStepOutput(stepID, outputName string) interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	step, ok := c.steps[stepID]
+	if !ok {
+		return nil
+	}
+	outputs, ok := step["outputs"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if value, ok := outputs[outputName]; ok {
+		return value
+	}
+	value, _ := valueAtPath(outputs, outputName)
+	return value
+}
+
+func (c *Context) stepOutputs(stepID string) (map[string]interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	step, ok := c.steps[stepID]
+	if !ok {
+		return nil, false
+	}
+	outputs, _ := step["outputs"].(map[string]interface{})
+	return outputs, true
+}
+
+func matchPattern(pattern, s string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(s, pattern[:len(pattern)-1])
+	}
+	if strings.HasPrefix(pattern, "*") {
+		return strings.HasSuffix(s, pattern[1:])
+	}
+	return pattern == s
+}
+
+type FunctionInfo struct {
+	Name        string                   `json:"name"`
+	Description string                   `json:"description"`
+	Tags        []string                 `json:"tags,omitempty"`
+	Defaults    map[string]interface{}   `json:"defaults,omitempty"`
+	Examples    []map[string]interface{} `json:"examples,omitempty"`
+	Plugin      string                   `json:"plugin,omitempty"`
+}
+
+type AssertionParam struct {
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"`
+	Required bool   `json:"required"`
+}
+
+type AssertionInfo struct {
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	Params      []AssertionParam `json:"params"`
+	Plugin      string           `json:"plugin,omitempty"`
+}
+
+type AssertionResult struct {
+	Success  bool        `json:"success"`
+	Message  string      `json:"message,omitempty"`
+	Actual   interface{} `json:"actual,omitempty"`
+	Expected interface{} `json:"expected,omitempty"`
+	Skipped  bool        `json:"skipped,omitempty"`
+	Severity string      `json:"severity,omitempty"`
+	Hint     string      `json:"hint,omitempty"`
+}
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+func requestedSeverity(params map[string]interface{}) (string, error) {
+	severity, err := optionalString(params, "severity")
+	if err != nil {
+		return "", err
+	}
+	switch severity {
+	case "":
+		return SeverityError, nil
+	case SeverityError, SeverityWarning, SeverityInfo:
+		return severity, nil
+	}
+	return "", invalidParams("unknown severity %q, expected error, warning or info", severity)
+}
+
+type Registry interface {
+	Call(name string, args map[string]interface{}, ctx *Context) (interface{}, error)
+	ListFunctions() []FunctionInfo
+	CallAssertion(name string, params map[string]interface{}, ctx *Context) AssertionResult
+	CallHook(hook string, ctx *Context) error
+	ListHooks() []string
+}
+
+type FunctionFinder interface {
+	FindFunctions(pattern string) []FunctionInfo
+}
+
+// isNilRegistry reports whether r is nil, including a nil pointer stored in
+// the interface (such as a plugin's unset *BaseRegistry).
+func isNilRegistry(r Registry) bool {
+	if r == nil {
+		return true
+	}
+	v := reflect.ValueOf(r)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Func, reflect.Interface, reflect.Slice, reflect.Chan:
+		return v.IsNil()
+	}
+	return false
+}
+
+type FunctionDescriber interface {
+	Describe(name string) (FunctionInfo, bool)
+}
+
+type AssertionDescriber interface {
+	DescribeAssertion(name string) (AssertionInfo, bool)
+}
+
+type ContextHookCaller interface {
+	CallContextHook(hook string, ctx *Context) (map[string]interface{}, error)
+}
+
+type ParamHookCaller interface {
+	CallHookWithParams(hook string, params map[string]interface{}, ctx *Context) (map[string]interface{}, error)
+}
+
+type Warmer interface {
+	Warmup(ctx *Context) error
+}
+
+// MethodHandler is implemented by registries that serve JSON-RPC methods of
+// their own. HandleMethod returns an error with CodeMethodNotFound for
+// methods it does not know.
+type MethodHandler interface {
+	HandleMethod(method string, params map[string]interface{}, ctx *Context) (interface{}, error)
+}
+
+type JSONRPCRequest struct {
+	JSONRPC string                 `json:"jsonrpc"`
+	ID      interface{}            `json:"id"`
+	Method  string                 `json:"method"`
+	Params  map[string]interface{} `json:"params"`
+}
+
+type JSONRPCResponse struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      interface{} `json:"id"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   *RPCError   `json:"error,omitempty"`
+}
+
+type JSONRPCNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func jsonRPCSuccess(id interface{}, result interface{}) JSONRPCResponse {
+	return JSONRPCResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Result:  result,
+	}
+}
+
+func jsonRPCError(id interface{}, code int, message string) JSONRPCResponse {
+	return JSONRPCResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error:   &RPCError{Code: code, Message: message},
+	}
+}
+
+func jsonRPCNotification(method string, params interface{}) JSONRPCNotification {
+	return JSONRPCNotification{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+	}
+}
+
+func jsonRPCResult(id interface{}, result interface{}, err error) JSONRPCResponse {
+	if err == nil {
+		return jsonRPCSuccess(id, result)
+	}
+	return jsonRPCError(id, errorCode(err), err.Error())
+}
+
+func requireString(params map[string]interface{}, key string) (string, error) {
+	raw, present := params[key]
+	if !present || raw == nil {
+		return "", invalidParams("missing required param %q", key)
+	}
+	value, ok := raw.(string)
+	if !ok {
+		return "", invalidParams("param %q must be a string, got %T", key, raw)
+	}
+	return value, nil
+}
+
+func optionalString(params map[string]interface{}, key string) (string, error) {
+	if raw, present := params[key]; !present || raw == nil {
+		return "", nil
+	}
+	return requireString(params, key)
+}
+
+func optionalNumber(params map[string]interface{}, key string) (float64, error) {
+	raw, present := params[key]
+	if !present || raw == nil {
+		return 0, nil
+	}
+	value, ok := raw.(float64)
+	if !ok {
+		return 0, invalidParams("param %q must be a number, got %T", key, raw)
+	}
+	return value, nil
+}
+
+func requireObject(params map[string]interface{}, key string) (map[string]interface{}, error) {
+	raw, present := params[key]
+	if !present || raw == nil {
+		return nil, invalidParams("missing required param %q", key)
+	}
+	value, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, invalidParams("param %q must be an object, got %T", key, raw)
+	}
+	return value, nil
+}
+
+func optionalObject(params map[string]interface{}, key string) (map[string]interface{}, error) {
+	if raw, present := params[key]; !present || raw == nil {
+		return nil, nil
+	}
+	return requireObject(params, key)
+}
+
+type CallRecord struct {
+	Method    string    `json:"method"`
+	Name      string    `json:"name"`
+	Args      string    `json:"args"`
+	Result    string    `json:"result"`
+	Success   bool      `json:"success"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type callHistory struct {
+	mu      sync.Mutex
+	size    int
+	entries []CallRecord
+	next    int
+
+	// recorded counts every entry ever stored and serves as the cursor for
+	// tail; grown is broadcast (under mu) whenever it increases.
+	recorded int
+	grown    *sync.Cond
+}
+
+func (h *callHistory) record(entry CallRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.size <= 0 {
+		return
+	}
+	if len(h.entries) < h.size {
+		h.entries = append(h.entries, entry)
+	} else {
+		h.entries[h.next] = entry
+	}
+	h.next = (h.next + 1) % h.size
+	h.recorded++
+	if h.grown != nil {
+		h.grown.Broadcast()
+	}
+}
+
+func (h *callHistory) snapshot() []CallRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ordered()
+}
+
+// tail waits up to timeout for entries recorded after cursor and returns
+// them with the cursor to pass next time. Entries that have already been
+// overwritten in the ring buffer are skipped.
+func (h *callHistory) tail(cursor int, timeout time.Duration) ([]CallRecord, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.grown == nil {
+		h.grown = sync.NewCond(&h.mu)
+	}
+
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		h.mu.Lock()
+		expired = true
+		h.grown.Broadcast()
+		h.mu.Unlock()
+	})
+	defer timer.Stop()
+	for h.recorded <= cursor && !expired {
+		h.grown.Wait()
+	}
+
+	entries := h.ordered()
+	fresh := h.recorded - cursor
+	if fresh > len(entries) {
+		fresh = len(entries)
+	}
+	if fresh < 0 {
+		fresh = 0
+	}
+	return entries[len(entries)-fresh:], h.recorded
+}
+
+func (h *callHistory) ordered() []CallRecord {
+	entries := make([]CallRecord, 0, len(h.entries))
+	if len(h.entries) < h.size {
+		return append(entries, h.entries...)
+	}
+	entries = append(entries, h.entries[h.next:]...)
+	return append(entries, h.entries[:h.next]...)
+}
+
+func (h *callHistory) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = nil
+	h.next = 0
+}
+
+type AssertionCounts struct {
+	Total  int `json:"total"`
+	Passed int `json:"passed"`
+	Failed int `json:"failed"`
+}
+
+func (c *AssertionCounts) add(passed bool) {
+	c.Total++
+	if passed {
+		c.Passed++
+	} else {
+		c.Failed++
+	}
+}
+
+type AssertionStats struct {
+	AssertionCounts
+	ByName map[string]AssertionCounts `json:"byName"`
+}
+
+type assertionCounter struct {
+	mu     sync.Mutex
+	totals AssertionCounts
+	byName map[string]AssertionCounts
+}
+
+func (c *assertionCounter) record(name string, passed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.byName == nil {
+		c.byName = make(map[string]AssertionCounts)
+	}
+	c.totals.add(passed)
+	counts := c.byName[name]
+	counts.add(passed)
+	c.byName[name] = counts
+}
+
+func (c *assertionCounter) snapshot() AssertionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := AssertionStats{AssertionCounts: c.totals, ByName: make(map[string]AssertionCounts, len(c.byName))}
+	for name, counts := range c.byName {
+		stats.ByName[name] = counts
+	}
+	return stats
+}
+
+func (c *assertionCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.totals = AssertionCounts{}
+	c.byName = nil
+}
+
+const historySummaryLimit = 200
+
+func summarize(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	if len(data) > historySummaryLimit {
+		return string(data[:historySummaryLimit]) + "..."
+	}
+	return string(data)
+}
+
+type Server struct {
+	registry       Registry
+	ctx            *Context
+	copyArgs       bool
+	reportDuration bool
+	looseEquals    bool
+	history        callHistory
+	assertions     assertionCounter
+	metrics        functionMetrics
+	in             io.Reader
+	out            io.Writer
+	warmupMu       sync.Mutex
+	warmedUp       bool
+
+	allowedMethods map[string]bool
+	session        *session
+	recorder       *recorder
+	replayer       *replayer
+	writeMu        sync.Mutex
+
+	// fallback, when set, is given methods the server does not know
+	// instead of answering them with CodeMethodNotFound.
+	fallback func(method string, params map[string]interface{}) (interface{}, error)
+
+	allowAdmin bool
+	draining   bool
+
+	allowTap   bool
+	detachConn bool
+	tapMu      sync.Mutex
+	taps       map[int]*tap
+	tapSeq     int
+
+	persistPath string
+	persistStop chan struct{}
+	persistDone chan struct{}
+
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+
+	stubMu sync.Mutex
+	stubs  map[string]interface{}
+
+	idempotencyTTL   time.Duration
+	idempotencyMu    sync.Mutex
+	idempotencyCache map[string]*idempotentResult
+}
+
+// idempotentResult is one idempotencyKey's slot. done is closed once the
+// first call finishes; only a successful result is kept, until expiresAt.
+type idempotentResult struct {
+	fingerprint string
+	done        chan struct{}
+	stored      bool
+	result      interface{}
+	expiresAt   time.Time
+}
+
+// NewServer never fails; a nil registry is reported on stderr and every
+// request is then answered with an Internal error instead of panicking.
+func NewServer(registry Registry) *Server {
+	if isNilRegistry(registry) {
+		fmt.Fprintln(os.Stderr, "Warning: server created with a nil registry; every request will fail")
+	}
+	s := &Server{
+		registry:       registry,
+		ctx:            NewContext(),
+		copyArgs:       true,
+		reportDuration: true,
+		in:             os.Stdin,
+		out:            os.Stdout,
+		session:        &session{},
+
+		idempotencyTTL:   5 * time.Minute,
+		idempotencyCache: make(map[string]*idempotentResult),
+
+		shutdown: make(chan struct{}),
+	}
+	s.ctx.assertionCaller = s.callNestedAssertion
+	return s
+}
+
+// callNestedAssertion runs an assertion on behalf of another assertion; see
+// Context.assertionCaller.
+func (s *Server) callNestedAssertion(name string, params map[string]interface{}) AssertionResult {
+	return s.registry.CallAssertion(name, s.applyLooseEquals(name, params), s.ctx)
+}
+
+func (s *Server) SetHistorySize(size int) {
+	s.history.mu.Lock()
+	s.history.size = size
+	s.history.mu.Unlock()
+	s.history.reset()
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			copied[k] = deepCopy(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(val))
+		for i, item := range val {
+			copied[i] = deepCopy(item)
+		}
+		return copied
+	default:
+		return val
+	}
+}
+
+func (s *Server) handleFnCall(params map[string]interface{}) (interface{}, error) {
+	name, err := requireString(params, "name")
+	if err != nil {
+		return nil, err
+	}
+	args, err := optionalObject(params, "args")
+	if err != nil {
+		return nil, err
+	}
+	idempotencyKey, err := optionalString(params, "idempotencyKey")
+	if err != nil {
+		return nil, err
+	}
+	keepaliveMs, err := optionalNumber(params, "keepaliveMs")
+	if err != nil {
+		return nil, err
+	}
+	if idempotencyKey != "" {
+		return s.callIdempotent(idempotencyKey, name, args, func() (interface{}, error) {
+			return s.runFnCall(name, args, params, keepaliveMs)
+		})
+	}
+	return s.runFnCall(name, args, params, keepaliveMs)
+}
+
+func (s *Server) runFnCall(name string, args, params map[string]interface{}, keepaliveMs float64) (interface{}, error) {
+	args, err := s.prepareCallArgs(name, args, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var response interface{}
+	start := time.Now()
+	stopKeepalive := s.startKeepalive(time.Duration(keepaliveMs * float64(time.Millisecond)))
+	result, err := s.callFunction(name, args)
+	stopKeepalive()
+	result, err = s.finishCallResult(result, err)
+	if err == nil {
+		envelope := map[string]interface{}{"result": result}
+		if s.reportDuration {
+			envelope["durationMs"] = float64(time.Since(start).Microseconds()) / 1000
+		}
+		response = envelope
+	}
+	return response, err
+}
+
+// prepareCallArgs resolves refs in args, copies them unless --no-copy-args,
+// and coerces string args when params asks for it. fn.call and every fn.pipe
+// step share it.
+func (s *Server) prepareCallArgs(name string, args, params map[string]interface{}) (map[string]interface{}, error) {
+	args, err := s.prepareArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if coerce, _ := params["coerce"].(bool); coerce {
+		info, _ := s.describeFunction(name)
+		if args, err = coerceArgs(args, info.Defaults); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+// finishCallResult turns what a function returned into a call result:
+// a StepResult is stored under the current step and an io.Reader is
+// streamed as fn.chunk notifications.
+func (s *Server) finishCallResult(result interface{}, err error) (interface{}, error) {
+	if stepResult, ok := result.(StepResult); ok && err == nil {
+		result, err = s.syncStepResult(stepResult)
+	}
+	if reader, ok := result.(io.Reader); ok && err == nil {
+		if err = s.requireProtocol(2, "streamed results"); err == nil {
+			result, err = s.streamReader(reader)
+		} else if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return result, err
+}
+
+// callIdempotent runs call once per idempotencyKey. A duplicate arriving
+// while the first call is still running waits for it; a failed call is not
+// cached, so a retry runs the function again. Reusing a key for a different
+// function or different args is Invalid params rather than a silent replay.
+// Expiry is measured with ctx.Now(), so a mocked clock decides when entries
+// age out.
+func (s *Server) callIdempotent(key, name string, args map[string]interface{}, call func() (interface{}, error)) (interface{}, error) {
+	fingerprint := idempotencyFingerprint(name, args)
+	for {
+		s.idempotencyMu.Lock()
+		s.sweepIdempotencyCache(s.ctx.Now())
+		entry, ok := s.idempotencyCache[key]
+		if !ok {
+			entry = &idempotentResult{fingerprint: fingerprint, done: make(chan struct{})}
+			s.idempotencyCache[key] = entry
+			s.idempotencyMu.Unlock()
+			result, err := call()
+			s.finishIdempotent(key, entry, result, err)
+			return result, err
+		}
+		s.idempotencyMu.Unlock()
+
+		if entry.fingerprint != fingerprint {
+			return nil, invalidParams("idempotencyKey %q was already used for a different call", key)
+		}
+		<-entry.done
+		if entry.stored {
+			return entry.result, nil
+		}
+	}
+}
+
+func (s *Server) finishIdempotent(key string, entry *idempotentResult, result interface{}, err error) {
+	s.idempotencyMu.Lock()
+	if err == nil {
+		entry.stored = true
+		entry.result = result
+		entry.expiresAt = s.ctx.Now().Add(s.idempotencyTTL)
+	} else if s.idempotencyCache[key] == entry {
+		delete(s.idempotencyCache, key)
+	}
+	s.idempotencyMu.Unlock()
+	close(entry.done)
+}
+
+// sweepIdempotencyCache drops expired results. The caller holds
+// idempotencyMu.
+func (s *Server) sweepIdempotencyCache(now time.Time) {
+	for key, entry := range s.idempotencyCache {
+		if entry.stored && !now.Before(entry.expiresAt) {
+			delete(s.idempotencyCache, key)
+		}
+	}
+}
+
+func idempotencyFingerprint(name string, args map[string]interface{}) string {
+	data, err := json.Marshal(map[string]interface{}{"name": name, "args": args})
+	if err != nil {
+		return fmt.Sprintf("%s %v", name, args)
+	}
+	return string(data)
+}
+
+// StepResult is returned by functions that produce named step outputs.
+// fn.call stores the outputs under the current step (the stepName from
+// ctx.setExecutionInfo) and returns them as the call result.
+type StepResult struct {
+	Outputs map[string]interface{}
+}
+
+func NewStepResult(outputs map[string]interface{}) StepResult {
+	if outputs == nil {
+		outputs = map[string]interface{}{}
+	}
+	return StepResult{Outputs: outputs}
+}
+
+func (s *Server) syncStepResult(result StepResult) (interface{}, error) {
+	s.ctx.mu.RLock()
+	stepID := s.ctx.StepName
+	s.ctx.mu.RUnlock()
+	if stepID == "" {
+		return nil, fmt.Errorf("function returned step outputs but no current step is set (see ctx.setExecutionInfo)")
+	}
+	s.ctx.SetStepOutputs(stepID, deepCopy(result.Outputs).(map[string]interface{}))
+	return result.Outputs, nil
+}
+
+// startKeepalive emits a keepalive notification every interval until the
+// returned stop function is called. Keepalives track the wall clock, not the
+// mocked one, since they exist to keep real connections from idling out.
+func (s *Server) startKeepalive(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	id := s.ctx.currentRequestID()
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.writeMessage(jsonRPCNotification("keepalive", map[string]interface{}{"id": id}))
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+const streamChunkSize = 32 * 1024
+
+type StreamChunk struct {
+	ID       interface{} `json:"id"`
+	Seq      int         `json:"seq"`
+	Encoding string      `json:"encoding"`
+	Data     string      `json:"data"`
+}
+
+// streamReader emits the reader's content as "fn.chunk" notifications of
+// base64-encoded data, ahead of the fn.call response, and returns a summary
+// to use as the call's result.
+func (s *Server) streamReader(reader io.Reader) (interface{}, error) {
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	id := s.ctx.currentRequestID()
+	buf := make([]byte, streamChunkSize)
+	chunks, total := 0, 0
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			s.writeMessage(jsonRPCNotification("fn.chunk", StreamChunk{
+				ID:       id,
+				Seq:      chunks,
+				Encoding: "base64",
+				Data:     base64.StdEncoding.EncodeToString(buf[:n]),
+			}))
+			chunks++
+			total += n
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stream failed after %d bytes: %w", total, err)
+		}
+	}
+	return map[string]interface{}{"streamed": true, "chunks": chunks, "bytes": total}, nil
+}
+
+func (s *Server) prepareArgs(args map[string]interface{}) (map[string]interface{}, error) {
+	if args == nil {
+		return make(map[string]interface{}), nil
+	}
+	resolved, err := resolveRefs(args, s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s.copyArgs {
+		resolved = deepCopy(resolved)
+	}
+	object, ok := resolved.(map[string]interface{})
+	if !ok {
+		return nil, invalidParams("param %q must resolve to an object, got %T", "args", resolved)
+	}
+	return object, nil
+}
+
+// coerceArgs converts string args for callers that can only send strings
+// (CLI flags, environment interpolation). A declared default is the arg's
+// schema: a string arg whose default is a number or boolean must parse as
+// one, and one whose default is a string is left alone. Args without a
+// default become a number or boolean when they parse as one. NaN and the
+// infinities are never numbers here: they cannot be encoded as JSON.
+func coerceArgs(args, defaults map[string]interface{}) (map[string]interface{}, error) {
+	coerced := make(map[string]interface{}, len(args))
+	for key, value := range args {
+		coerced[key] = value
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		def, declared := defaults[key]
+		switch def.(type) {
+		case float64:
+			n, ok := parseFiniteNumber(str)
+			if !ok {
+				return nil, invalidParams("arg %q must be a finite number, got %q", key, str)
+			}
+			coerced[key] = n
+		case bool:
+			b, err := strconv.ParseBool(strings.TrimSpace(str))
+			if err != nil {
+				return nil, invalidParams("arg %q must be a boolean, got %q", key, str)
+			}
+			coerced[key] = b
+		default:
+			if declared && def != nil {
+				continue
+			}
+			if n, ok := parseFiniteNumber(str); ok {
+				coerced[key] = n
+			} else if str == "true" || str == "false" {
+				coerced[key] = str == "true"
+			}
+		}
+	}
+	return coerced, nil
+}
+
+func parseFiniteNumber(str string) (float64, bool) {
+	n, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, false
+	}
+	return n, true
+}
+
+func (s *Server) callFunction(name string, args map[string]interface{}) (interface{}, error) {
+	argsSummary := summarize(args)
+	var result interface{}
+	var err error
+	start := time.Now()
+	if stubbed, ok := s.stubbedResult(name); ok {
+		result = stubbed
+	} else {
+		result, err = s.registry.Call(name, args, s.ctx)
+	}
+	s.metrics.record(name, time.Since(start), err != nil)
+	if err != nil {
+		s.history.record(CallRecord{
+			Method: "fn.call", Name: name, Args: argsSummary,
+			Result: err.Error(), Success: false, Timestamp: s.ctx.Now(),
+		})
+		return nil, err
+	}
+	s.history.record(CallRecord{
+		Method: "fn.call", Name: name, Args: argsSummary,
+		Result: summarize(result), Success: true, Timestamp: s.ctx.Now(),
+	})
+	return result, nil
+}
+
+type refResolver interface {
+	Resolve(ref string) (interface{}, bool)
+}
+
+// resolveRefs replaces every {"$ctx": "path"} object found in v with the
+// context value at that path.
+func resolveRefs(v interface{}, ctx refResolver) (interface{}, error) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if ref, ok := val["$ctx"].(string); ok && len(val) == 1 {
+			resolved, found := ctx.Resolve(ref)
+			if !found {
+				return nil, invalidParams("unresolvable context reference: %s", ref)
+			}
+			return resolved, nil
+		}
+		resolved := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			r, err := resolveRefs(item, ctx)
+			if err != nil {
+				return nil, err
+			}
+			resolved[k] = r
+		}
+		return resolved, nil
+	case []interface{}:
+		resolved := make([]interface{}, len(val))
+		for i, item := range val {
+			r, err := resolveRefs(item, ctx)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = r
+		}
+		return resolved, nil
+	default:
+		return val, nil
+	}
+}
+
+func (s *Server) handleFnPipe(params map[string]interface{}) (interface{}, error) {
+	steps, ok := params["steps"].([]interface{})
+	if !ok {
+		return nil, invalidParams("param %q must be an array of steps", "steps")
+	}
+	results := make([]interface{}, 0, len(steps))
+
+	for i, raw := range steps {
+		step, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, invalidParams("step %d must be an object", i)
+		}
+		name, err := requireString(step, "name")
+		if err != nil {
+			return nil, err
+		}
+		as, err := optionalString(step, "as")
+		if err != nil {
+			return nil, err
+		}
+		args, err := optionalObject(step, "args")
+		if err != nil {
+			return nil, err
+		}
+		args, err = s.prepareCallArgs(name, args, step)
+		if err != nil {
+			return nil, fmt.Errorf("step %d (%s): %w", i, name, err)
+		}
+		result, err := s.finishCallResult(s.callFunction(name, args))
+		if err != nil {
+			return nil, fmt.Errorf("step %d (%s): %w", i, name, err)
+		}
+		if as != "" {
+			s.ctx.Set(as, result)
+		}
+		results = append(results, result)
+	}
+	return map[string]interface{}{"results": results}, nil
+}
+
+func (s *Server) handleCtxGet(params map[string]interface{}) (interface{}, error) {
+	key, err := requireString(params, "key")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"value": s.ctx.Get(key)}, nil
+}
+
+func (s *Server) handleCtxGetMany(params map[string]interface{}) (interface{}, error) {
+	raw, ok := params["keys"].([]interface{})
+	if !ok {
+		return nil, invalidParams("param %q must be an array of strings, got %T", "keys", params["keys"])
+	}
+	keys := make([]string, 0, len(raw))
+	for _, item := range raw {
+		key, ok := item.(string)
+		if !ok {
+			return nil, invalidParams("param %q must be an array of strings, got element %T", "keys", item)
+		}
+		keys = append(keys, key)
+	}
+	return map[string]interface{}{"values": s.ctx.GetMany(keys)}, nil
+}
+
+func (s *Server) handleCtxGetOrDefault(params map[string]interface{}) (interface{}, error) {
+	key, err := requireString(params, "key")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"value": s.ctx.GetOrDefault(key, params["default"])}, nil
+}
+
+func (s *Server) handleCtxSet(params map[string]interface{}) (interface{}, error) {
+	key, err := requireString(params, "key")
+	if err != nil {
+		return nil, err
+	}
+	value := params["value"]
+	s.ctx.Set(key, value)
+	return map[string]interface{}{}, nil
+}
+
+func (s *Server) handleCtxClear(params map[string]interface{}) (interface{}, error) {
+	pattern, err := optionalString(params, "pattern")
+	if err != nil {
+		return nil, err
+	}
+	if pattern == "" {
+		pattern = "*"
+	}
+	cleared := s.ctx.Clear(pattern)
+	return map[string]interface{}{"cleared": cleared}, nil
+}
+
+func (s *Server) handleCtxRename(params map[string]interface{}) (interface{}, error) {
+	from, err := requireString(params, "from")
+	if err != nil {
+		return nil, err
+	}
+	to, err := requireString(params, "to")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"moved": s.ctx.Rename(from, to)}, nil
+}
+
+func (s *Server) handleCtxSwap(params map[string]interface{}) (interface{}, error) {
+	a, err := requireString(params, "a")
+	if err != nil {
+		return nil, err
+	}
+	b, err := requireString(params, "b")
+	if err != nil {
+		return nil, err
+	}
+	valueA, valueB := s.ctx.Swap(a, b)
+	return map[string]interface{}{"a": valueA, "b": valueB}, nil
+}
+
+func (s *Server) handleCtxEnv(params map[string]interface{}) (interface{}, error) {
+	prefix, err := optionalString(params, "prefix")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"env": s.ctx.FlattenEnv(prefix)}, nil
+}
+
+func (s *Server) handleCtxExport(params map[string]interface{}) (interface{}, error) {
+	return s.ctx.Export(), nil
+}
+
+func (s *Server) handleCtxImport(params map[string]interface{}) (interface{}, error) {
+	data, err := optionalObject(params, "data")
+	if err != nil {
+		return nil, err
+	}
+	rawSteps, err := optionalObject(params, "steps")
+	if err != nil {
+		return nil, err
+	}
+
+	steps := make(map[string]map[string]interface{}, len(rawSteps))
+	for id, raw := range rawSteps {
+		step, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, invalidParams("step %q must be an object", id)
+		}
+		steps[id] = step
+	}
+	s.ctx.Import(ContextExport{Data: data, Steps: steps})
+	return map[string]interface{}{}, nil
+}
+
+func (s *Server) handleCtxDump(params map[string]interface{}) (interface{}, error) {
+	redact, err := optionalString(params, "redact")
+	if err != nil {
+		return nil, err
+	}
+	return s.ctx.Dump(redact), nil
+}
+
+func (s *Server) handleCtxEval(params map[string]interface{}) (interface{}, error) {
+	expr, err := requireString(params, "expr")
+	if err != nil {
+		return nil, err
+	}
+	node, err := parseExpr(expr)
+	if err != nil {
+		return nil, invalidParams("invalid expression: %v", err)
+	}
+	return map[string]interface{}{"result": isTruthy(node.eval(s.ctx))}, nil
+}
+
+func (s *Server) handleCtxFingerprint(params map[string]interface{}) (interface{}, error) {
+	fingerprint, err := s.ctx.Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"fingerprint": fingerprint}, nil
+}
+
+func (s *Server) handleCtxStats(params map[string]interface{}) (interface{}, error) {
+	return s.ctx.Stats(), nil
+}
+
+func (s *Server) handleCtxSnapshot(params map[string]interface{}) (interface{}, error) {
+	includeSteps, _ := params["includeSteps"].(bool)
+	return map[string]interface{}{"token": s.ctx.Snapshot(includeSteps)}, nil
+}
+
+func (s *Server) handleCtxRestore(params map[string]interface{}) (interface{}, error) {
+	token, err := requireString(params, "token")
+	if err != nil {
+		return nil, err
+	}
+	if !s.ctx.Restore(token) {
+		return nil, invalidParams("unknown snapshot: %s", token)
+	}
+	return map[string]interface{}{}, nil
+}
+
+func (s *Server) handleCtxDiff(params map[string]interface{}) (interface{}, error) {
+	from, err := requireString(params, "from")
+	if err != nil {
+		return nil, err
+	}
+	to, err := optionalString(params, "to")
+	if err != nil {
+		return nil, err
+	}
+	if to == "" {
+		to = "current"
+	}
+
+	a, ok := s.ctx.SnapshotData(from)
+	if !ok {
+		return nil, invalidParams("unknown snapshot: %s", from)
+	}
+	b, ok := s.ctx.SnapshotData(to)
+	if !ok {
+		return nil, invalidParams("unknown snapshot: %s", to)
+	}
+	return DiffSnapshots(a, b), nil
+}
+
+// handleCtxSetDeadline sets the run deadline from exactly one of
+// deadline_ms (Unix milliseconds), deadline (RFC 3339) or duration_ms
+// (relative to ctx.Now). Sending that one field as null clears the deadline.
+func (s *Server) handleCtxSetDeadline(params map[string]interface{}) (interface{}, error) {
+	var field string
+	for _, key := range []string{"deadline_ms", "deadline", "duration_ms"} {
+		if _, present := params[key]; !present {
+			continue
+		}
+		if field != "" {
+			return nil, invalidParams("params %q and %q are mutually exclusive", field, key)
+		}
+		field = key
+	}
+	if field == "" {
+		return nil, invalidParams("one of %q, %q or %q is required (send it as null to clear the deadline)", "deadline_ms", "deadline", "duration_ms")
+	}
+
+	var deadline time.Time
+	switch raw := params[field].(type) {
+	case nil:
+	case float64:
+		if field == "deadline" {
+			return nil, invalidParams("param %q must be an RFC 3339 string, got %T", field, raw)
+		}
+		if field == "deadline_ms" {
+			deadline = time.UnixMilli(int64(raw))
+		} else {
+			deadline = s.ctx.Now().Add(time.Duration(raw * float64(time.Millisecond)))
+		}
+	case string:
+		if field != "deadline" {
+			return nil, invalidParams("param %q must be a number, got %T", field, raw)
+		}
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return nil, invalidParams("invalid deadline: %v", err)
+		}
+		deadline = parsed
+	default:
+		return nil, invalidParams("param %q must be a number or string, got %T", field, raw)
+	}
+
+	s.ctx.SetDeadline(deadline)
+	if deadline.IsZero() {
+		return map[string]interface{}{"deadline_ms": nil}, nil
+	}
+	return map[string]interface{}{"deadline_ms": deadline.UnixMilli()}, nil
+}
+
+// handleCtxSetExecutionInfo only updates the fields present in params, so a
+// caller can change stepName between steps without resending runId/jobName.
+func (s *Server) handleCtxSetExecutionInfo(params map[string]interface{}) (interface{}, error) {
+	fields := []struct {
+		key    string
+		target *string
+	}{
+		{"runId", &s.ctx.RunID},
+		{"jobName", &s.ctx.JobName},
+		{"stepName", &s.ctx.StepName},
+	}
+
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		if _, present := params[field.key]; !present {
+			continue
+		}
+		value, err := optionalString(params, field.key)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+
+	s.ctx.mu.Lock()
+	defer s.ctx.mu.Unlock()
+	for i, field := range fields {
+		if _, present := params[field.key]; present {
+			*field.target = values[i]
+		}
+	}
+	return map[string]interface{}{}, nil
+}
+
+func (s *Server) handleCtxSyncStepOutputs(params map[string]interface{}) (interface{}, error) {
+	stepID, err := requireString(params, "stepId")
+	if err != nil {
+		return nil, err
+	}
+	outputs, err := requireObject(params, "outputs")
+	if err != nil {
+		return nil, err
+	}
+
+	s.ctx.SetStepOutputs(stepID, outputs)
+	return map[string]interface{}{}, nil
+}
+
+func (s *Server) handleCtxGetStepOutput(params map[string]interface{}) (interface{}, error) {
+	stepID, err := requireString(params, "stepId")
+	if err != nil {
+		return nil, err
+	}
+	name, err := optionalString(params, "outputName")
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		if name, err = requireString(params, "name"); err != nil {
+			return nil, invalidParams("one of %q or %q is required", "outputName", "name")
+		}
+	}
+	return map[string]interface{}{"value": s.ctx.GetStepOutput(stepID, name)}, nil
+}
+
+func (s *Server) handleCtxClearSteps(params map[string]interface{}) (interface{}, error) {
+	stepID, err := optionalString(params, "stepId")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"cleared": s.ctx.ClearSteps(stepID)}, nil
+}
+
+func (s *Server) handleHookCall(params map[string]interface{}) (interface{}, error) {
+	hook, err := requireString(params, "hook")
+	if err != nil {
+		return nil, err
+	}
+	hookParams, err := optionalObject(params, "hookParams")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.runHook(hook, hookParams); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{}, nil
+}
+
+// handleHookCallAll runs every hook whose name starts with prefix, in name
+// order. A failing hook does not stop the others; their errors are reported
+// together once all have run.
+func (s *Server) handleHookCallAll(params map[string]interface{}) (interface{}, error) {
+	prefix, err := requireString(params, "prefix")
+	if err != nil {
+		return nil, err
+	}
+	hookParams, err := optionalObject(params, "hookParams")
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make([]string, 0)
+	for _, hook := range s.registry.ListHooks() {
+		if strings.HasPrefix(hook, prefix) {
+			hooks = append(hooks, hook)
+		}
+	}
+	sort.Strings(hooks)
+
+	var failures []string
+	for _, hook := range hooks {
+		if err := s.runHook(hook, hookParams); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", hook, err))
+		}
+	}
+	if len(failures) > 0 {
+		return nil, fmt.Errorf("%d of %d hooks with prefix %q failed: %s", len(failures), len(hooks), prefix, strings.Join(failures, "; "))
+	}
+	return map[string]interface{}{"hooks": hooks}, nil
+}
+
+func (s *Server) runHook(hook string, hookParams map[string]interface{}) error {
+	if caller, ok := s.registry.(ParamHookCaller); ok {
+		values, err := caller.CallHookWithParams(hook, hookParams, s.ctx)
+		if err != nil {
+			return err
+		}
+		for k, v := range values {
+			s.ctx.Set(k, v)
+		}
+		return nil
+	}
+
+	caller, ok := s.registry.(ContextHookCaller)
+	if !ok {
+		return s.registry.CallHook(hook, s.ctx)
+	}
+
+	values, err := caller.CallContextHook(hook, s.ctx)
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		s.ctx.Set(k, v)
+	}
+	return nil
+}
+
+func (s *Server) handleAssertCustom(params map[string]interface{}) (interface{}, error) {
+	name, err := requireString(params, "name")
+	if err != nil {
+		return nil, err
+	}
+	assertParams, err := optionalObject(params, "params")
+	if err != nil {
+		return nil, err
+	}
+	severity, err := requestedSeverity(params)
+	if err != nil {
+		return nil, err
+	}
+	if assertParams == nil {
+		assertParams = make(map[string]interface{})
+	} else if s.copyArgs {
+		assertParams = deepCopy(assertParams).(map[string]interface{})
+	}
+
+	if describer, ok := s.registry.(AssertionDescriber); ok {
+		if _, found := describer.DescribeAssertion(name); !found {
+			var available []string
+			if lister, ok := s.registry.(AssertionLister); ok {
+				available = lister.ListAssertions()
+			}
+			return nil, assertionNotFound(name, available)
+		}
+	}
+	assertParams = s.applyLooseEquals(name, assertParams)
+
+	paramsSummary := summarize(assertParams)
+	result := s.registry.CallAssertion(name, assertParams, s.ctx)
+	if result.Severity == "" {
+		result.Severity = severity
+	}
+	s.history.record(CallRecord{
+		Method: "assert.custom", Name: name, Args: paramsSummary,
+		Result: summarize(result), Success: result.Success, Timestamp: s.ctx.Now(),
+	})
+	s.assertions.record(name, result.Success)
+	return result, nil
+}
+
+// applyLooseEquals sets loose for --loose-equals when the assertion declares
+// a loose param and the request left it unset. It sets it on a copy, so the
+// caller's map is untouched even under --no-copy-args.
+func (s *Server) applyLooseEquals(name string, params map[string]interface{}) map[string]interface{} {
+	if !s.looseEquals {
+		return params
+	}
+	if _, set := params["loose"]; set {
+		return params
+	}
+	describer, ok := s.registry.(AssertionDescriber)
+	if !ok {
+		return params
+	}
+	info, found := describer.DescribeAssertion(name)
+	if !found {
+		return params
+	}
+	for _, param := range info.Params {
+		if param.Name != "loose" {
+			continue
+		}
+		withLoose := make(map[string]interface{}, len(params)+1)
+		for k, v := range params {
+			withLoose[k] = v
+		}
+		withLoose["loose"] = true
+		return withLoose
+	}
+	return params
+}
+
+type ChainResult struct {
+	AssertionResult
+	Index int `json:"index"`
+}
+
+// handleAssertChain runs assertions in order and stops at the first failure.
+// Inside a step's params, {"$prev": "actual"} (or "expected") is replaced by
+// that field of the previous step's result, so a chain can first check that
+// a value exists and then check the value itself. The result is that of the
+// failing step, or of the last step, with the index it stopped at.
+func (s *Server) handleAssertChain(params map[string]interface{}) (interface{}, error) {
+	steps, ok := params["assertions"].([]interface{})
+	if !ok || len(steps) == 0 {
+		return nil, invalidParams("param %q must be a non-empty array of assertions", "assertions")
+	}
+
+	var prev *AssertionResult
+	var chain ChainResult
+	for i, raw := range steps {
+		step, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, invalidParams("assertions[%d] must be an object, got %T", i, raw)
+		}
+		if prev != nil {
+			step = withPrevParams(step, prev)
+		}
+		result, err := s.handleAssertCustom(step)
+		if err != nil {
+			return nil, chainStepError(i, err)
+		}
+		current := result.(AssertionResult)
+		chain = ChainResult{AssertionResult: current, Index: i}
+		if !current.Success {
+			break
+		}
+		prev = &current
+	}
+	return chain, nil
+}
+
+// withPrevParams returns step with $prev references in its params replaced.
+// Only params is substituted, so the step itself always stays an object.
+func withPrevParams(step map[string]interface{}, prev *AssertionResult) map[string]interface{} {
+	params, present := step["params"]
+	if !present {
+		return step
+	}
+	substituted := make(map[string]interface{}, len(step))
+	for k, v := range step {
+		substituted[k] = v
+	}
+	substituted["params"] = substitutePrev(params, prev)
+	return substituted
+}
+
+// chainStepError adds the failing step's index to err and keeps the code it
+// is reported under.
+func chainStepError(index int, err error) error {
+	var be *BridgeError
+	if errors.As(err, &be) {
+		return &BridgeError{Code: be.Code, Message: fmt.Sprintf("assertions[%d]: %s", index, be.Message), Cause: be.Cause}
+	}
+	return fmt.Errorf("assertions[%d]: %w", index, err)
+}
+
+func substitutePrev(v interface{}, prev *AssertionResult) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if field, ok := val["$prev"].(string); ok && len(val) == 1 {
+			switch field {
+			case "actual":
+				return prev.Actual
+			case "expected":
+				return prev.Expected
+			}
+		}
+		substituted := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			substituted[k] = substitutePrev(item, prev)
+		}
+		return substituted
+	case []interface{}:
+		substituted := make([]interface{}, len(val))
+		for i, item := range val {
+			substituted[i] = substitutePrev(item, prev)
+		}
+		return substituted
+	default:
+		return val
+	}
+}
+
+func (s *Server) handleAssertConditional(params map[string]interface{}) (interface{}, error) {
+	when, err := requireString(params, "when")
+	if err != nil {
+		return nil, err
+	}
+	value, _ := s.ctx.Resolve(when)
+	if !isTruthy(value) {
+		return AssertionResult{Success: true, Skipped: true}, nil
+	}
+	return s.handleAssertCustom(params)
+}
+
+// handleAssertNoError calls a function and passes if it returns without an
+// error; the result itself is discarded.
+func (s *Server) handleAssertNoError(params map[string]interface{}) (interface{}, error) {
+	name, severity, callErr, err := s.callForAssertion(params)
+	if err != nil {
+		return nil, err
+	}
+	if callErr != nil {
+		return AssertionResult{
+			Success:  false,
+			Message:  fmt.Sprintf("expected %s not to error, got: %v", name, callErr),
+			Actual:   callErr.Error(),
+			Severity: severity,
+		}, nil
+	}
+	return AssertionResult{Success: true, Severity: severity}, nil
+}
+
+// handleAssertErrors is the inverse of assert.noError: it passes if the
+// function returns an error, and with "contains" set only if the error
+// message contains that substring.
+func (s *Server) handleAssertErrors(params map[string]interface{}) (interface{}, error) {
+	contains, err := optionalString(params, "contains")
+	if err != nil {
+		return nil, err
+	}
+	name, severity, callErr, err := s.callForAssertion(params)
+	if err != nil {
+		return nil, err
+	}
+	if callErr == nil {
+		return AssertionResult{
+			Success:  false,
+			Message:  fmt.Sprintf("expected %s to error, but it succeeded", name),
+			Expected: contains,
+			Severity: severity,
+		}, nil
+	}
+	if !strings.Contains(callErr.Error(), contains) {
+		return AssertionResult{
+			Success:  false,
+			Message:  fmt.Sprintf("expected %s to error with %q, got: %v", name, contains, callErr),
+			Actual:   callErr.Error(),
+			Expected: contains,
+			Severity: severity,
+		}, nil
+	}
+	return AssertionResult{Success: true, Actual: callErr.Error(), Expected: contains, Severity: severity}, nil
+}
+
+// callForAssertion calls params["function"] with params["args"] for
+// assert.noError and assert.errors. callErr is the function's own error;
+// err reports a request that could not be carried out (bad params, refs
+// that do not resolve or an unknown function), so those are never mistaken
+// for the function failing.
+func (s *Server) callForAssertion(params map[string]interface{}) (name, severity string, callErr, err error) {
+	if name, err = requireString(params, "function"); err != nil {
+		return "", "", nil, err
+	}
+	args, err := optionalObject(params, "args")
+	if err != nil {
+		return "", "", nil, err
+	}
+	if severity, err = requestedSeverity(params); err != nil {
+		return "", "", nil, err
+	}
+	if args, err = s.prepareArgs(args); err != nil {
+		return "", "", nil, err
+	}
+	result, callErr := s.callFunction(name, args)
+	if errorCode(callErr) == CodeFunctionNotFound {
+		return "", "", nil, callErr
+	}
+	if closer, ok := result.(io.Closer); ok {
+		closer.Close()
+	}
+	return name, severity, callErr, nil
+}
+
+func (s *Server) handleAssertStepEquals(params map[string]interface{}) (interface{}, error) {
+	stepID, err := requireString(params, "stepId")
+	if err != nil {
+		return nil, err
+	}
+	outputName, err := requireString(params, "outputName")
+	if err != nil {
+		return nil, err
+	}
+	severity, err := requestedSeverity(params)
+	if err != nil {
+		return nil, err
+	}
+
+	result := s.assertStepEquals(stepID, outputName, params)
+	result.Severity = severity
+	return result, nil
+}
+
+func (s *Server) assertStepEquals(stepID, outputName string, params map[string]interface{}) AssertionResult {
+	outputs, ok := s.ctx.stepOutputs(stepID)
+	if !ok {
+		return AssertionResult{Success: false, Message: fmt.Sprintf("step not found: %s", stepID)}
+	}
+	actual, ok := outputs[outputName]
+	if !ok {
+		return AssertionResult{Success: false, Message: fmt.Sprintf("output %s not found on step %s", outputName, stepID)}
+	}
+
+	expected := params["expected"]
+	if ref, isRef := params["expectedRef"].(string); isRef {
+		if expected, ok = s.ctx.Resolve(ref); !ok {
+			return AssertionResult{
+				Success: false,
+				Message: fmt.Sprintf("expected reference not found in context: %s", ref),
+				Actual:  actual,
+			}
+		}
+	}
+
+	if !deepEqual(actual, expected) {
+		return AssertionResult{
+			Success:  false,
+			Message:  fmt.Sprintf("step %s output %s: expected %v but got %v", stepID, outputName, expected, actual),
+			Actual:   actual,
+			Expected: expected,
+		}
+	}
+	return AssertionResult{Success: true, Actual: actual, Expected: expected}
+}
+
+// handleListFunctions returns every function, or with offset and/or limit
+// one page of them (in name order) together with the total count.
+func (s *Server) handleListFunctions(params map[string]interface{}) (interface{}, error) {
+	functions := s.registry.ListFunctions()
+	hasOffset := params["offset"] != nil
+	hasLimit := params["limit"] != nil
+	if !hasOffset && !hasLimit {
+		return map[string]interface{}{"functions": functions}, nil
+	}
+
+	offset, err := optionalNumber(params, "offset")
+	if err != nil {
+		return nil, err
+	}
+	limit, err := optionalNumber(params, "limit")
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset != float64(int(offset)) {
+		return nil, invalidParams("offset must be a non-negative integer")
+	}
+	if hasLimit && (limit < 1 || limit != float64(int(limit))) {
+		return nil, invalidParams("limit must be a positive integer")
+	}
+
+	total := len(functions)
+	start := int(offset)
+	if start > total {
+		start = total
+	}
+	end := total
+	if hasLimit && start+int(limit) < total {
+		end = start + int(limit)
+	}
+	return map[string]interface{}{
+		"functions": functions[start:end],
+		"offset":    start,
+		"total":     total,
+	}, nil
+}
+
+func (s *Server) handleListHooks(params map[string]interface{}) (interface{}, error) {
+	return map[string]interface{}{"hooks": s.registry.ListHooks()}, nil
+}
+
+// handleRegistryInfo answers list_functions, registry.listHooks and the
+// assertion list in one response. Every list is sorted by name; registries
+// that cannot list their assertions report none.
+func (s *Server) handleRegistryInfo(params map[string]interface{}) (interface{}, error) {
+	functions := s.registry.ListFunctions()
+	assertions := make([]string, 0)
+	if lister, ok := s.registry.(AssertionLister); ok {
+		assertions = lister.ListAssertions()
+	}
+	hooks := s.registry.ListHooks()
+	return map[string]interface{}{
+		"functionCount":  len(functions),
+		"assertionCount": len(assertions),
+		"hookCount":      len(hooks),
+		"functions":      functions,
+		"assertions":     assertions,
+		"hooks":          hooks,
+	}, nil
+}
+
+func (s *Server) handleDescribe(params map[string]interface{}) (interface{}, error) {
+	name, err := requireString(params, "name")
+	if err != nil {
+		return nil, err
+	}
+
+	if info, found := s.describeFunction(name); found {
+		return info, nil
+	}
+	return nil, invalidParams("function not found: %s", name)
+}
+
+func (s *Server) describeFunction(name string) (FunctionInfo, bool) {
+	if describer, ok := s.registry.(FunctionDescriber); ok {
+		return describer.Describe(name)
+	}
+	for _, info := range s.registry.ListFunctions() {
+		if info.Name == name {
+			return info, true
+		}
+	}
+	return FunctionInfo{}, false
+}
+
+func (s *Server) stubbedResult(name string) (interface{}, bool) {
+	s.stubMu.Lock()
+	defer s.stubMu.Unlock()
+	value, ok := s.stubs[name]
+	return deepCopy(value), ok
+}
+
+// handleRegistryStub makes fn.call (and fn.pipe) return a fixed value for
+// name, without calling the registry, until registry.unstub removes it. The
+// name does not have to be registered, so integrations can be faked too.
+func (s *Server) handleRegistryStub(params map[string]interface{}) (interface{}, error) {
+	name, err := requireString(params, "name")
+	if err != nil {
+		return nil, err
+	}
+	returns, present := params["returns"]
+	if !present {
+		return nil, invalidParams("missing required param %q", "returns")
+	}
+
+	s.stubMu.Lock()
+	defer s.stubMu.Unlock()
+	if s.stubs == nil {
+		s.stubs = make(map[string]interface{})
+	}
+	s.stubs[name] = deepCopy(returns)
+	return map[string]interface{}{}, nil
+}
+
+func (s *Server) handleRegistryUnstub(params map[string]interface{}) (interface{}, error) {
+	name, err := requireString(params, "name")
+	if err != nil {
+		return nil, err
+	}
+
+	s.stubMu.Lock()
+	defer s.stubMu.Unlock()
+	_, existed := s.stubs[name]
+	delete(s.stubs, name)
+	return map[string]interface{}{"removed": existed}, nil
+}
+
+func (s *Server) handleDescribeAssertion(params map[string]interface{}) (interface{}, error) {
+	name, err := requireString(params, "name")
+	if err != nil {
+		return nil, err
+	}
+
+	if describer, ok := s.registry.(AssertionDescriber); ok {
+		if info, found := describer.DescribeAssertion(name); found {
+			return info, nil
+		}
+		return nil, invalidParams("assertion not found: %s", name)
+	}
+	if lister, ok := s.registry.(AssertionLister); ok {
+		for _, assertion := range lister.ListAssertions() {
+			if assertion == name {
+				return AssertionInfo{Name: name, Params: []AssertionParam{}}, nil
+			}
+		}
+	}
+	return nil, invalidParams("assertion not found: %s", name)
+}
+
+func hasTag(info FunctionInfo, tag string) bool {
+	for _, t := range info.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleFindFunctions(params map[string]interface{}) (interface{}, error) {
+	pattern, err := optionalString(params, "pattern")
+	if err != nil {
+		return nil, err
+	}
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	tag, err := optionalString(params, "tag")
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []FunctionInfo
+	if finder, ok := s.registry.(FunctionFinder); ok {
+		candidates = finder.FindFunctions(pattern)
+	} else {
+		candidates = s.registry.ListFunctions()
+	}
+
+	functions := make([]FunctionInfo, 0, len(candidates))
+	for _, info := range candidates {
+		if matchPattern(pattern, info.Name) && (tag == "" || hasTag(info, tag)) {
+			functions = append(functions, info)
+		}
+	}
+	return map[string]interface{}{"functions": functions}, nil
+}
+
+func (s *Server) handleClockSync(params map[string]interface{}) (interface{}, error) {
+	var virtualTimeMs *int64
+	var virtualTimeIso *string
+
+	if v, ok := params["virtual_time_ms"].(float64); ok {
+		ms := int64(v)
+		virtualTimeMs = &ms
+	}
+	if v, ok := params["virtual_time_iso"].(string); ok {
+		virtualTimeIso = &v
+	}
+	frozen, _ := params["frozen"].(bool)
+
+	s.ctx.mu.Lock()
+	s.ctx.Clock = &ClockState{
+		VirtualTimeMs:  virtualTimeMs,
+		VirtualTimeIso: virtualTimeIso,
+		Frozen:         frozen,
+	}
+	s.ctx.mu.Unlock()
+	return map[string]interface{}{}, nil
+}
+
+// handleClockOffset makes ctx.Now() run at real time shifted by offset_ms.
+// Unlike clock.sync the clock keeps moving, so it does not count as mocked:
+// sleeps and retry backoff still wait for real.
+func (s *Server) handleClockOffset(params map[string]interface{}) (interface{}, error) {
+	raw, ok := params["offset_ms"].(float64)
+	if !ok {
+		return nil, invalidParams("param %q must be a number, got %T", "offset_ms", params["offset_ms"])
+	}
+	offset := int64(raw)
+
+	s.ctx.mu.Lock()
+	s.ctx.Clock = &ClockState{OffsetMs: &offset}
+	s.ctx.mu.Unlock()
+	return map[string]interface{}{"now_ms": s.ctx.Now().UnixMilli()}, nil
+}
+
+func (s *Server) handleServerWarmup(params map[string]interface{}) (interface{}, error) {
+	s.warmupMu.Lock()
+	defer s.warmupMu.Unlock()
+
+	if s.warmedUp {
+		return map[string]interface{}{"warmed": false}, nil
+	}
+	if warmer, ok := s.registry.(Warmer); ok {
+		if err := warmer.Warmup(s.ctx); err != nil {
+			return nil, err
+		}
+	}
+	s.warmedUp = true
+	return map[string]interface{}{"warmed": true}, nil
+}
+
+func (s *Server) handleServerHistory(params map[string]interface{}) (interface{}, error) {
+	entries := s.history.snapshot()
+	if clear, _ := params["clear"].(bool); clear {
+		s.history.reset()
+	}
+	return map[string]interface{}{"entries": entries}, nil
+}
+
+func (s *Server) handleServerAssertionStats(params map[string]interface{}) (interface{}, error) {
+	stats := s.assertions.snapshot()
+	if clear, _ := params["clear"].(bool); clear {
+		s.assertions.reset()
+	}
+	return stats, nil
+}
+
+// handleServerHistoryTail long-polls for history entries recorded after
+// cursor (0 for everything still buffered). Like ctx.waitFor it returns a
+// pendingResult, so a later fn.call from the same client wakes it.
+func (s *Server) handleServerHistoryTail(params map[string]interface{}) (interface{}, error) {
+	cursor, err := optionalNumber(params, "cursor")
+	if err != nil {
+		return nil, err
+	}
+	timeoutMs, err := optionalNumber(params, "timeout_ms")
+	if err != nil {
+		return nil, err
+	}
+	if timeoutMs <= 0 {
+		return nil, invalidParams("timeout_ms must be a positive number")
+	}
+
+	return pendingResult(func() (interface{}, error) {
+		entries, next := s.history.tail(int(cursor), time.Duration(timeoutMs*float64(time.Millisecond)))
+		return map[string]interface{}{"entries": entries, "cursor": next}, nil
+	}), nil
+}
+
+func (s *Server) methodAllowed(method string) bool {
+	if s.allowedMethods == nil {
+		return true
+	}
+	return s.allowedMethods[method]
+}
+
+func (s *Server) SetAllowedMethods(methods []string) {
+	if len(methods) == 0 {
+		s.allowedMethods = nil
+		return
+	}
+	s.allowedMethods = make(map[string]bool, len(methods))
+	for _, m := range methods {
+		s.allowedMethods[strings.TrimSpace(m)] = true
+	}
+}
+
+func (s *Server) handleRequest(request JSONRPCRequest) JSONRPCResponse {
+	var response JSONRPCResponse
+
+	if !s.methodAllowed(request.Method) {
+		return jsonRPCError(request.ID, CodeMethodNotFound, fmt.Sprintf("Method not allowed: %s", request.Method))
+	}
+	if s.replayer != nil {
+		return s.replay(request)
+	}
+	if isNilRegistry(s.registry) {
+		return jsonRPCError(request.ID, CodeInternalError, fmt.Sprintf("Internal error: cannot serve %s, the server has no registry (does the plugin set its Registry variable?)", request.Method))
+	}
+	if s.draining && drainBlocked[request.Method] {
+		return drainingError(request)
+	}
+
+	switch request.Method {
+	case "fn.call":
+		if s.ctx.deadlineExceeded() {
+			return jsonRPCError(request.ID, CodeDeadlineExceeded, "run deadline exceeded")
+		}
+		result, err := s.handleFnCall(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "fn.pipe":
+		if s.ctx.deadlineExceeded() {
+			return jsonRPCError(request.ID, CodeDeadlineExceeded, "run deadline exceeded")
+		}
+		result, err := s.handleFnPipe(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "session.hello":
+		result, err := s.handleSessionHello(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "server.capabilities":
+		result, err := s.handleServerCapabilities(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.get":
+		result, err := s.handleCtxGet(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.getMany":
+		result, err := s.handleCtxGetMany(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.getHistory":
+		result, err := s.handleCtxGetHistory(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.getOrDefault":
+		result, err := s.handleCtxGetOrDefault(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.set":
+		result, err := s.handleCtxSet(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.clear":
+		result, err := s.handleCtxClear(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.rename":
+		result, err := s.handleCtxRename(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.lock":
+		result, err := s.handleCtxLock(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.unlock":
+		result, err := s.handleCtxUnlock(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.swap":
+		result, err := s.handleCtxSwap(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.env":
+		result, err := s.handleCtxEnv(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.export":
+		result, err := s.handleCtxExport(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.import":
+		result, err := s.handleCtxImport(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.dump":
+		result, err := s.handleCtxDump(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.eval":
+		result, err := s.handleCtxEval(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.watch":
+		result, err := s.handleCtxWatch(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.waitFor":
+		result, err := s.handleCtxWaitFor(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.fingerprint":
+		result, err := s.handleCtxFingerprint(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.stats":
+		result, err := s.handleCtxStats(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.snapshot":
+		result, err := s.handleCtxSnapshot(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.restore":
+		result, err := s.handleCtxRestore(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.diff":
+		result, err := s.handleCtxDiff(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.setDeadline":
+		result, err := s.handleCtxSetDeadline(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.setExecutionInfo":
+		result, err := s.handleCtxSetExecutionInfo(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.syncStepOutputs":
+		result, err := s.handleCtxSyncStepOutputs(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.getStepOutput":
+		result, err := s.handleCtxGetStepOutput(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "ctx.clearSteps":
+		result, err := s.handleCtxClearSteps(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "hook.call":
+		result, err := s.handleHookCall(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "hook.callAll":
+		result, err := s.handleHookCallAll(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "assert.custom":
+		result, err := s.handleAssertCustom(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "assert.chain":
+		result, err := s.handleAssertChain(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "assert.conditional":
+		result, err := s.handleAssertConditional(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "assert.stepEquals":
+		result, err := s.handleAssertStepEquals(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "assert.noError":
+		result, err := s.handleAssertNoError(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "assert.errors":
+		result, err := s.handleAssertErrors(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "list_functions":
+		result, err := s.handleListFunctions(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "registry.listHooks":
+		result, err := s.handleListHooks(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "registry.info":
+		result, err := s.handleRegistryInfo(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "registry.describe":
+		result, err := s.handleDescribe(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "registry.stub":
+		result, err := s.handleRegistryStub(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "registry.unstub":
+		result, err := s.handleRegistryUnstub(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "registry.describeAssertion":
+		result, err := s.handleDescribeAssertion(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "registry.findFunctions":
+		result, err := s.handleFindFunctions(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "clock.sync":
+		result, err := s.handleClockSync(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "clock.offset":
+		result, err := s.handleClockOffset(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "server.warmup":
+		result, err := s.handleServerWarmup(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "server.history":
+		result, err := s.handleServerHistory(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "server.historyTail":
+		result, err := s.handleServerHistoryTail(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "server.drain":
+		result, err := s.handleServerDrain(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "server.resume":
+		result, err := s.handleServerResume(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "server.tap":
+		result, err := s.handleServerTap(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "server.replayRun":
+		result, err := s.handleServerReplayRun(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "server.metricsText":
+		result, err := s.handleServerMetricsText(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	case "server.assertionStats":
+		result, err := s.handleServerAssertionStats(request.Params)
+		response = jsonRPCResult(request.ID, result, err)
+	default:
+		if s.fallback != nil {
+			if s.draining {
+				return drainingError(request)
+			}
+			result, err := s.fallback(request.Method, request.Params)
+			response = jsonRPCResult(request.ID, result, err)
+			break
+		}
+		response = jsonRPCError(request.ID, CodeMethodNotFound, fmt.Sprintf("Method not found: %s", request.Method))
+	}
+	return response
+}
+
+// Run serves requests from stdin until it is closed or Shutdown is called.
+func (s *Server) Run() {
+	fmt.Fprintln(os.Stderr, "Go bridge server started")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.serveLines(s.in)
+	}()
+	select {
+	case <-done:
+	case <-s.shutdown:
+	}
+}
+
+// Shutdown makes Run and Listen return, so the caller's deferred cleanup
+// (the final --persist-path save, closing the --record file) still runs. It
+// is safe to call more than once and from any goroutine.
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+}
+
+// ShutdownOnSignal calls Shutdown on the first SIGINT or SIGTERM. The returned
+// func stops watching for the signals.
+func (s *Server) ShutdownOnSignal() func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			s.Shutdown()
+		case <-s.shutdown:
+		}
+	}()
+	return func() { signal.Stop(signals) }
+}
+
+// serveLines serves one request per line as a fresh session. A handler that
+// returns a pendingResult is finished on its own goroutine while the loop
+// keeps reading, so its response can come after responses to later
+// requests; serveLines waits for those before it returns.
+func (s *Server) serveLines(in io.Reader) {
+	s.serveSession(in, &session{})
+}
+
+func (s *Server) serveSession(in io.Reader, sess *session) {
+	s.session = sess
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	var pending sync.WaitGroup
+	defer pending.Wait()
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if sess.compressFrames {
+			decoded, err := decompressLine(line)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid frame: %v\n", err)
+				continue
+			}
+			line = decoded
+		}
+
+		if strings.HasPrefix(strings.TrimSpace(line), "[") {
+			s.handleBatch([]byte(line))
+			continue
+		}
+
+		request, errResponse, err := decodeRequest([]byte(line))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid JSON: %s\n", line)
+			continue
+		}
+		if errResponse != nil {
+			s.writeMessage(*errResponse)
+			continue
+		}
+
+		response := s.startRequest(request)
+		if wait, ok := response.Result.(pendingResult); ok {
+			out := s.currentOut()
+			pending.Add(1)
+			go func() {
+				defer pending.Done()
+				s.writeMessageTo(out, s.finishRequest(request, runPending(request, wait)))
+			}()
+			continue
+		}
+		s.writeMessage(s.finishRequest(request, response))
+		if s.detachConn {
+			return
+		}
+	}
+}
+
+func decodeRequest(data []byte) (JSONRPCRequest, *JSONRPCResponse, error) {
+	var request JSONRPCRequest
+	err := json.Unmarshal(data, &request)
+	if err == nil {
+		return request, nil, nil
+	}
+
+	var envelope struct {
+		ID interface{} `json:"id"`
+	}
+	if json.Unmarshal(data, &envelope) != nil {
+		return request, nil, err
+	}
+	// The line is a JSON object, so a field has the wrong type. Only a
+	// non-object params is Invalid params; anything else (a numeric method,
+	// say) means the envelope itself is not a valid request.
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		response := jsonRPCError(envelope.ID, CodeInvalidRequest, "Invalid Request: "+err.Error())
+		return request, &response, nil
+	}
+	if typeErr.Field == "params" {
+		response := jsonRPCError(envelope.ID, CodeInvalidParams, "Invalid params: params must be an object")
+		return request, &response, nil
+	}
+	response := jsonRPCError(envelope.ID, CodeInvalidRequest, fmt.Sprintf("Invalid Request: %s must be a %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value))
+	return request, &response, nil
+}
+
+// serveRequest serves request to completion, waiting in place for a
+// pendingResult; batches answer in one message, so they cannot hand it off.
+func (s *Server) serveRequest(request JSONRPCRequest) JSONRPCResponse {
+	return s.finishRequest(request, resolvePending(request, s.startRequest(request)))
+}
+
+func (s *Server) startRequest(request JSONRPCRequest) JSONRPCResponse {
+	s.ctx.attachLogSink(request.ID, s.emitLog)
+	defer s.ctx.detachLogSink()
+	return s.handleRequest(request)
+}
+
+func (s *Server) finishRequest(request JSONRPCRequest, response JSONRPCResponse) JSONRPCResponse {
+	response = encodeResult(request, response)
+
+	if s.recorder != nil {
+		if err := s.recorder.record(request, response); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to record exchange: %v\n", err)
+		}
+	}
+	s.publishTap(request, response)
+	return response
+}
+
+// pendingResult is returned by handlers whose answer depends on a later
+// request, such as ctx.waitFor waiting for a ctx.set. The handler has
+// already validated its params; calling the func waits and produces the
+// result. It must only touch state that is safe to use concurrently with
+// other requests.
+type pendingResult func() (interface{}, error)
+
+func runPending(request JSONRPCRequest, wait pendingResult) JSONRPCResponse {
+	result, err := wait()
+	return jsonRPCResult(request.ID, result, err)
+}
+
+func resolvePending(request JSONRPCRequest, response JSONRPCResponse) JSONRPCResponse {
+	if wait, ok := response.Result.(pendingResult); ok {
+		return runPending(request, wait)
+	}
+	return response
+}
+
+// encodeResult encodes the result up front, so a value json.Marshal cannot
+// handle (a channel, a func, a map with non-string keys) becomes an Internal
+// error naming the method instead of a broken response line.
+func encodeResult(request JSONRPCRequest, response JSONRPCResponse) JSONRPCResponse {
+	if response.Result == nil {
+		return response
+	}
+	data, err := json.Marshal(response.Result)
+	if err != nil {
+		return jsonRPCError(request.ID, CodeInternalError, fmt.Sprintf("Internal error: result of %s cannot be encoded as JSON: %v", request.Method, err))
+	}
+	response.Result = json.RawMessage(data)
+	return response
+}
+
+// handleBatch serves a JSON-RPC batch. Every element is dispatched on its
+// own, so a failing element never prevents the others from running, and
+// responses keep input order with notifications (no id) omitted.
+func (s *Server) handleBatch(data []byte) {
+	if err := s.requireProtocol(2, "batch requests"); err != nil {
+		s.writeMessage(jsonRPCError(nil, CodeInvalidRequest, err.Error()))
+		return
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil || len(items) == 0 {
+		s.writeMessage(jsonRPCError(nil, CodeInvalidRequest, "Invalid Request"))
+		return
+	}
+
+	responses := make([]JSONRPCResponse, 0, len(items))
+	for _, item := range items {
+		request, errResponse, err := decodeRequest(item)
+		if err != nil {
+			responses = append(responses, jsonRPCError(nil, CodeInvalidRequest, "Invalid Request"))
+			continue
+		}
+		if errResponse != nil {
+			responses = append(responses, *errResponse)
+			continue
+		}
+
+		response := s.serveRequest(request)
+		if request.ID != nil {
+			responses = append(responses, response)
+		}
+	}
+
+	if len(responses) > 0 {
+		s.writeMessage(responses)
+	}
+}
+
+func (s *Server) writeMessage(message interface{}) {
+	s.writeMessageTo(nil, message)
+}
+
+// writeMessageTo writes to out, or to the current s.out when out is nil. A
+// pendingResult's response is written to the writer its request came in on,
+// so it never lands on a later --listen connection.
+func (s *Server) writeMessageTo(out io.Writer, message interface{}) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode message: %v\n", err)
+		return
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if out == nil {
+		out = s.out
+	}
+	fmt.Fprintln(out, string(data))
+}
+
+func (s *Server) currentOut() io.Writer {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.out
+}
+
+func (s *Server) emitLog(event LogEvent) {
+	s.writeMessage(jsonRPCNotification("log", event))
+}
+
+func (s *Server) ProtectStdout() error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	// s.out keeps whatever it pointed at before (the real stdout unless
+	// --output-fd chose another descriptor).
+	os.Stdout = w
+
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			fmt.Fprintf(os.Stderr, "Warning: stray stdout write redirected to stderr: %s\n", scanner.Text())
+		}
+	}()
+	return nil
+}
+
+// OutputToFD sends JSON-RPC responses and notifications to the already-open
+// file descriptor fd instead of stdout, leaving stdout free for plugin logs.
+func (s *Server) OutputToFD(fd int) error {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	if f == nil {
+		return fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return fmt.Errorf("file descriptor %d is not open: %w", fd, err)
+	}
+	s.out = f
+	return nil
+}
+
+func Serve(registry Registry) {
+	if isNilRegistry(registry) {
+		fmt.Fprintln(os.Stderr, "Serve called with a nil registry")
+		os.Exit(1)
+	}
+	server := NewServer(registry)
+	server.Run()
+}
+
+func main() {
+	var pluginPaths pluginList
+	flag.Var(&pluginPaths, "plugin", "Path to a Go plugin (.so file); repeat to load several")
+	overridePolicy := flag.String("override-policy", OverrideError, "How function names provided by more than one --plugin are resolved: error, last-wins or first-wins")
+	noDuration := flag.Bool("no-duration", false, "Omit durationMs from fn.call results")
+	looseEquals := flag.Bool("loose-equals", false, "Set loose on assertions that declare a loose param (such as equals) unless a request sets it")
+	noCopyArgs := flag.Bool("no-copy-args", false, "Pass decoded args to functions without deep-copying them")
+	valueHistory := flag.Int("value-history", 0, "Number of versions of each context key to keep for ctx.getHistory (0 disables)")
+	historySize := flag.Int("history-size", 0, "Number of recent fn.call/assert.custom invocations to keep for server.history (0 disables)")
+	outputFD := flag.Int("output-fd", 0, "Write JSON-RPC responses to this already-open file descriptor instead of stdout (e.g. 3)")
+	protectStdout := flag.Bool("protect-stdout", false, "Reserve stdout for JSON-RPC responses and redirect stray writes to stderr")
+	unknownMethods := flag.String("unknown-methods", "strict", "How methods the server does not know are answered: strict (Method not found) or passthrough (forwarded to the registry)")
+	allowMethods := flag.String("allow-methods", "", "Comma-separated list of JSON-RPC methods to serve (default: all)")
+	recordPath := flag.String("record", "", "Append every request/response pair to this JSON Lines file")
+	replayPath := flag.String("replay", "", "Serve recorded responses from this JSON Lines file instead of calling the registry")
+	idempotencyTTL := flag.Duration("idempotency-ttl", 5*time.Minute, "How long fn.call results are kept for idempotencyKey deduplication")
+	persistPath := flag.String("persist-path", "", "Periodically save the context to this JSON file and load it on startup")
+	allowAdmin := flag.Bool("allow-admin", false, "Allow the admin methods server.drain and server.resume")
+	allowTap := flag.Bool("allow-tap", false, "Allow --listen connections to call server.tap and stream every exchange")
+	listenAddr := flag.String("listen", "", "Serve JSON-RPC on this address instead of stdin/stdout (unix:///path/to.sock)")
+	persistInterval := flag.Duration("persist-interval", 30*time.Second, "How often the context is saved to --persist-path")
+	flag.Parse()
+
+	if len(pluginPaths) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: server --plugin path/to/registry.so [--plugin another.so ...]")
+		os.Exit(1)
+	}
+
+	var registry Registry
+	if len(pluginPaths) == 1 {
+		registry = loadPlugin(pluginPaths[0])
+	} else {
+		composite, err := NewCompositeRegistry(*overridePolicy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --override-policy: %v\n", err)
+			os.Exit(1)
+		}
+		for _, path := range pluginPaths {
+			if err := composite.Add(path, loadPlugin(path)); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load plugin: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		registry = composite
+	}
+
+	server := NewServer(registry)
+	server.copyArgs = !*noCopyArgs
+	server.reportDuration = !*noDuration
+	server.looseEquals = *looseEquals
+	server.idempotencyTTL = *idempotencyTTL
+	server.SetHistorySize(*historySize)
+	server.ctx.HistoryDepth = *valueHistory
+	server.allowTap = *allowTap
+	server.allowAdmin = *allowAdmin
+	switch *unknownMethods {
+	case "strict":
+	case "passthrough":
+		handler, ok := registry.(MethodHandler)
+		if !ok {
+			fmt.Fprintln(os.Stderr, "--unknown-methods=passthrough requires a registry that implements HandleMethod")
+			os.Exit(1)
+		}
+		server.fallback = func(method string, params map[string]interface{}) (interface{}, error) {
+			return handler.HandleMethod(method, params, server.ctx)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid --unknown-methods %q (want strict or passthrough)\n", *unknownMethods)
+		os.Exit(1)
+	}
+	if *allowMethods != "" {
+		server.SetAllowedMethods(strings.Split(*allowMethods, ","))
+	}
+	if *recordPath != "" {
+		f, err := openRecording(*recordPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open recording: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		server.RecordTo(f)
+	}
+	if *replayPath != "" {
+		f, err := os.Open(*replayPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open replay file: %v\n", err)
+			os.Exit(1)
+		}
+		err = server.ReplayFrom(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load replay file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	stopSignals := server.ShutdownOnSignal()
+	defer stopSignals()
+	if *persistPath != "" {
+		server.EnablePersistence(*persistPath, *persistInterval)
+		defer server.StopPersistence()
+	}
+	if *outputFD != 0 {
+		if err := server.OutputToFD(*outputFD); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to use --output-fd: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *protectStdout {
+		if err := server.ProtectStdout(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to protect stdout: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *listenAddr != "" {
+		if err := server.Listen(*listenAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to listen: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	server.Run()
+}
+
+func loadPlugin(path string) Registry {
+	p, err := plugin.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open plugin: %v\n", err)
+		os.Exit(1)
+	}
+
+	sym, err := p.Lookup("Registry")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Plugin must export 'Registry' variable: %v\n", err)
+		os.Exit(1)
+	}
+
+	registry, ok := sym.(*Registry)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Registry must implement the Registry interface")
+		os.Exit(1)
+	}
+	if isNilRegistry(*registry) {
+		fmt.Fprintf(os.Stderr, "Plugin %s exports a nil Registry\n", path)
+		os.Exit(1)
+	}
+	return *registry
 }
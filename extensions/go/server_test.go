@@ -0,0 +1,1643 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimeSourceFollowsMockedClock(t *testing.T) {
+	ctx := NewContext()
+	ms := int64(1700000000000)
+	ctx.Clock = &ClockState{VirtualTimeMs: &ms}
+
+	clock := ctx.TimeSource()
+	if got := clock.Now(); !got.Equal(time.UnixMilli(ms)) {
+		t.Fatalf("Now() = %v, want %v", got, time.UnixMilli(ms))
+	}
+	if first, second := clock.Now(), clock.Now(); !first.Equal(second) {
+		t.Fatalf("frozen clock moved: %v then %v", first, second)
+	}
+}
+
+func TestTimeSourceUsesRealTimeWhenUnmocked(t *testing.T) {
+	clock := NewContext().TimeSource()
+	before := time.Now()
+	got := clock.Now()
+	if got.Before(before) || got.After(time.Now()) {
+		t.Fatalf("Now() = %v, want a time between %v and now", got, before)
+	}
+}
+
+func TestDecodeRequestReportsWhatFailed(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		code int
+	}{
+		{"params array", `{"jsonrpc":"2.0","id":1,"method":"fn.call","params":[1]}`, CodeInvalidParams},
+		{"params string", `{"jsonrpc":"2.0","id":1,"method":"fn.call","params":"x"}`, CodeInvalidParams},
+		{"numeric method", `{"jsonrpc":"2.0","id":1,"method":5,"params":{}}`, CodeInvalidRequest},
+		{"numeric jsonrpc", `{"jsonrpc":2,"id":1,"method":"ping"}`, CodeInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, response, err := decodeRequest([]byte(tt.line))
+			if err != nil {
+				t.Fatalf("decodeRequest returned a parse error: %v", err)
+			}
+			if response == nil || response.Error == nil {
+				t.Fatalf("expected an error response, got %+v", response)
+			}
+			if response.Error.Code != tt.code {
+				t.Fatalf("code = %d (%s), want %d", response.Error.Code, response.Error.Message, tt.code)
+			}
+			if response.ID != 1.0 {
+				t.Fatalf("id = %v, want 1", response.ID)
+			}
+		})
+	}
+}
+
+func TestDecodeRequestAcceptsValidAndRejectsMalformed(t *testing.T) {
+	request, response, err := decodeRequest([]byte(`{"jsonrpc":"2.0","id":1,"method":"ping"}`))
+	if err != nil || response != nil || request.Method != "ping" {
+		t.Fatalf("valid request: got %+v, %+v, %v", request, response, err)
+	}
+	if _, _, err := decodeRequest([]byte(`{"method":`)); err == nil {
+		t.Fatal("expected a parse error for truncated JSON")
+	}
+}
+
+// countingRegistry registers "inc", which returns how many times it has run
+// and fails while fail is set.
+func countingRegistry() (*BaseRegistry, *int64, *atomic.Bool) {
+	r := NewBaseRegistry()
+	var calls int64
+	var fail atomic.Bool
+	r.RegisterFunction("inc", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		n := atomic.AddInt64(&calls, 1)
+		if fail.Load() {
+			return nil, errors.New("transient failure")
+		}
+		return float64(n), nil
+	})
+	return r, &calls, &fail
+}
+
+func TestIdempotencyKeyReplaysFirstResult(t *testing.T) {
+	r, calls, _ := countingRegistry()
+	s := NewServer(r)
+	params := map[string]interface{}{"name": "inc", "idempotencyKey": "k1"}
+
+	first, err := s.handleFnCall(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.handleFnCall(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 1 {
+		t.Fatalf("function ran %d times, want 1", *calls)
+	}
+	if first.(map[string]interface{})["result"] != second.(map[string]interface{})["result"] {
+		t.Fatalf("duplicate returned %v, want %v", second, first)
+	}
+
+	s.handleFnCall(map[string]interface{}{"name": "inc", "idempotencyKey": "k2"})
+	s.handleFnCall(map[string]interface{}{"name": "inc"})
+	if *calls != 3 {
+		t.Fatalf("function ran %d times, want 3", *calls)
+	}
+}
+
+func TestIdempotencyKeyDoesNotCacheErrors(t *testing.T) {
+	r, calls, fail := countingRegistry()
+	s := NewServer(r)
+	params := map[string]interface{}{"name": "inc", "idempotencyKey": "k"}
+
+	fail.Store(true)
+	if _, err := s.handleFnCall(params); err == nil {
+		t.Fatal("expected the first call to fail")
+	}
+	fail.Store(false)
+	result, err := s.handleFnCall(params)
+	if err != nil {
+		t.Fatalf("retry replayed the failure: %v", err)
+	}
+	if *calls != 2 || result.(map[string]interface{})["result"] != 2.0 {
+		t.Fatalf("calls = %d, result = %v", *calls, result)
+	}
+}
+
+func TestIdempotencyKeyRejectsDifferentInput(t *testing.T) {
+	r, calls, _ := countingRegistry()
+	s := NewServer(r)
+	s.handleFnCall(map[string]interface{}{"name": "inc", "idempotencyKey": "k", "args": map[string]interface{}{"a": 1.0}})
+
+	_, err := s.handleFnCall(map[string]interface{}{"name": "inc", "idempotencyKey": "k", "args": map[string]interface{}{"a": 2.0}})
+	if errorCode(err) != CodeInvalidParams {
+		t.Fatalf("err = %v, want Invalid params", err)
+	}
+	if *calls != 1 {
+		t.Fatalf("function ran %d times, want 1", *calls)
+	}
+}
+
+func TestIdempotencyKeyExpiresWithMockedClock(t *testing.T) {
+	r, calls, _ := countingRegistry()
+	s := NewServer(r)
+	s.idempotencyTTL = 10 * time.Millisecond
+	ms := int64(0)
+	s.ctx.Clock = &ClockState{VirtualTimeMs: &ms, Frozen: true}
+
+	s.handleFnCall(map[string]interface{}{"name": "inc", "idempotencyKey": "a"})
+	s.handleFnCall(map[string]interface{}{"name": "inc", "idempotencyKey": "b"})
+	time.Sleep(20 * time.Millisecond)
+	s.handleFnCall(map[string]interface{}{"name": "inc", "idempotencyKey": "a"})
+	if *calls != 2 {
+		t.Fatalf("function ran %d times, want 2 while the frozen clock stands still", *calls)
+	}
+
+	s.ctx.AdvanceClock(20 * time.Millisecond)
+	s.handleFnCall(map[string]interface{}{"name": "inc", "idempotencyKey": "a"})
+	if *calls != 3 {
+		t.Fatalf("function ran %d times, want 3 once the mocked clock passed the TTL", *calls)
+	}
+	s.idempotencyMu.Lock()
+	_, stale := s.idempotencyCache["b"]
+	s.idempotencyMu.Unlock()
+	if stale {
+		t.Fatal("expired entry b was not swept")
+	}
+}
+
+func TestIdempotencyKeyConcurrentDuplicatesRunOnce(t *testing.T) {
+	r := NewBaseRegistry()
+	var calls int64
+	release := make(chan struct{})
+	r.RegisterFunction("slow", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		<-release
+		return "done", nil
+	})
+	s := NewServer(r)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.handleFnCall(map[string]interface{}{"name": "slow", "idempotencyKey": "k"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("function ran %d times, want 1", calls)
+	}
+}
+
+func TestDumpRedactsContainsPattern(t *testing.T) {
+	ctx := NewContext()
+	ctx.Set("api_secret_key", "s3cr3t")
+	ctx.Set("user", map[string]interface{}{"client_secret": "x", "name": "ada"})
+	ctx.Set("region", "eu")
+
+	dump := ctx.Dump("*secret*")
+	if dump.Data["api_secret_key"] != redactedValue {
+		t.Fatalf("api_secret_key = %v, want redacted", dump.Data["api_secret_key"])
+	}
+	user := dump.Data["user"].(map[string]interface{})
+	if user["client_secret"] != redactedValue || user["name"] != "ada" {
+		t.Fatalf("user = %v", user)
+	}
+	if dump.Data["region"] != "eu" {
+		t.Fatalf("region = %v, want it preserved", dump.Data["region"])
+	}
+	if ctx.Get("api_secret_key") != "s3cr3t" {
+		t.Fatal("Dump modified the live context")
+	}
+}
+
+func TestClearKeepsPrefixMeaningForStarWrappedPatterns(t *testing.T) {
+	ctx := NewContext()
+	ctx.Set("*tmp_a", 1)
+	ctx.Set("x_tmp_y", 2)
+
+	if n := ctx.Clear("*tmp*"); n != 1 {
+		t.Fatalf("Clear removed %d keys, want 1", n)
+	}
+	if !ctx.Has("x_tmp_y") || ctx.Has("*tmp_a") {
+		t.Fatalf("Clear(\"*tmp*\") should only remove keys starting with \"*tmp\"")
+	}
+}
+
+// lineSink collects what the server writes, one message per Write.
+type lineSink chan string
+
+func (l lineSink) Write(p []byte) (int, error) {
+	l <- strings.TrimSuffix(string(p), "\n")
+	return len(p), nil
+}
+
+// pipeClient drives serveLines the way a runner drives stdin and stdout.
+type pipeClient struct {
+	t   *testing.T
+	in  *io.PipeWriter
+	out lineSink
+}
+
+func newPipeClient(t *testing.T, s *Server) *pipeClient {
+	t.Helper()
+	in, w := io.Pipe()
+	c := &pipeClient{t: t, in: w, out: make(lineSink, 64)}
+	s.out = c.out
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.serveLines(in)
+	}()
+	t.Cleanup(func() {
+		w.Close()
+		<-done
+	})
+	return c
+}
+
+func (c *pipeClient) send(id int, method string, params map[string]interface{}) {
+	c.t.Helper()
+	data, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	fmt.Fprintln(c.in, string(data))
+}
+
+// next returns the next message the server wrote, decoded.
+func (c *pipeClient) next() map[string]interface{} {
+	c.t.Helper()
+	select {
+	case line := <-c.out:
+		var message map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &message); err != nil {
+			c.t.Fatalf("server wrote invalid JSON %q: %v", line, err)
+		}
+		return message
+	case <-time.After(2 * time.Second):
+		c.t.Fatal("timed out waiting for a response")
+		return nil
+	}
+}
+
+// nextResult returns the result of the next response, which must have id.
+func (c *pipeClient) nextResult(id int) map[string]interface{} {
+	c.t.Helper()
+	message := c.next()
+	if message["id"] != float64(id) {
+		c.t.Fatalf("got response %v, want id %d", message, id)
+	}
+	result, ok := message["result"].(map[string]interface{})
+	if !ok {
+		c.t.Fatalf("response %d has no object result: %v", id, message)
+	}
+	return result
+}
+
+func TestLooseEqualsOnlyReachesAssertionsThatDeclareIt(t *testing.T) {
+	r := NewBaseRegistry()
+	seen := make(map[string]interface{})
+	record := func(name string) func(map[string]interface{}, *ReadOnlyContext) AssertionResult {
+		return func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+			_, present := params["loose"]
+			seen[name] = present
+			return AssertionResult{Success: true}
+		}
+	}
+	r.RegisterAssertionWithSchema("with_loose", "declares loose", []string{"actual", "loose?:boolean"}, record("with_loose"))
+	r.RegisterAssertionWithSchema("without_loose", "does not declare loose", []string{"actual"}, record("without_loose"))
+	s := NewServer(r)
+	s.looseEquals = true
+	s.copyArgs = false
+
+	params := map[string]interface{}{"actual": 1.0}
+	for _, name := range []string{"with_loose", "without_loose"} {
+		if _, err := s.handleAssertCustom(map[string]interface{}{"name": name, "params": params}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seen["with_loose"] != true {
+		t.Fatal("with_loose did not receive loose")
+	}
+	if seen["without_loose"] != false {
+		t.Fatal("without_loose received loose")
+	}
+	if _, mutated := params["loose"]; mutated {
+		t.Fatal("--loose-equals modified the caller's params under --no-copy-args")
+	}
+}
+
+// nextResults reads n responses, which may arrive in any order, and returns
+// their results by id.
+func (c *pipeClient) nextResults(n int) map[int]map[string]interface{} {
+	c.t.Helper()
+	results := make(map[int]map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		message := c.next()
+		id, _ := message["id"].(float64)
+		result, ok := message["result"].(map[string]interface{})
+		if !ok {
+			c.t.Fatalf("response has no object result: %v", message)
+		}
+		results[int(id)] = result
+	}
+	return results
+}
+
+func TestHistoryTailIsWokenByLaterCall(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterFunction("noop", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return nil, nil
+	})
+	s := NewServer(r)
+	s.SetHistorySize(10)
+	c := newPipeClient(t, s)
+
+	c.send(1, "server.historyTail", map[string]interface{}{"cursor": 0, "timeout_ms": 2000})
+	c.send(2, "fn.call", map[string]interface{}{"name": "noop"})
+	tail := c.nextResults(2)[1]
+	entries, _ := tail["entries"].([]interface{})
+	if len(entries) != 1 || tail["cursor"] != 1.0 {
+		t.Fatalf("server.historyTail = %v, want the one fn.call", tail)
+	}
+
+	c.send(3, "server.historyTail", map[string]interface{}{"cursor": 1, "timeout_ms": 20})
+	tail = c.nextResult(3)
+	if entries, ok := tail["entries"].([]interface{}); !ok || len(entries) != 0 {
+		t.Fatalf("timed-out server.historyTail = %v, want an empty entries list", tail)
+	}
+}
+
+func TestCoerceArgs(t *testing.T) {
+	got, err := coerceArgs(
+		map[string]interface{}{"count": "42", "verbose": "true", "ratio": " 0.5 ", "name": "42", "raw": "7", "flag": "false"},
+		map[string]interface{}{"count": 0.0, "verbose": false, "name": "", "ratio": 1.0},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"count": 42.0, "verbose": true, "ratio": 0.5, "name": "42", "raw": 7.0, "flag": false}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("coerceArgs = %v, want %v", got, want)
+	}
+}
+
+func TestCoerceArgsRejectsNonFiniteNumbers(t *testing.T) {
+	for _, str := range []string{"NaN", "Inf", "-Infinity", "1e400"} {
+		_, err := coerceArgs(map[string]interface{}{"count": str}, map[string]interface{}{"count": 0.0})
+		if errorCode(err) != CodeInvalidParams {
+			t.Fatalf("coerceArgs(%q) with a number default: err = %v, want invalid params", str, err)
+		}
+		got, err := coerceArgs(map[string]interface{}{"value": str}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got["value"] != str {
+			t.Fatalf("coerceArgs(%q) without a default = %v, want it left as a string", str, got["value"])
+		}
+	}
+}
+
+// newTestRegistry provides the example registry's greet and add functions
+// and equals assertion. example_registry.go is built on its own as a plugin,
+// so tests cannot use createExampleRegistry.
+func newTestRegistry() *BaseRegistry {
+	r := NewBaseRegistry()
+	r.RegisterFunctionWithDefaults("greet", map[string]interface{}{"name": "World"}, func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		name, _ := args["name"].(string)
+		return map[string]interface{}{"message": fmt.Sprintf("Hello, %s!", name)}, nil
+	})
+	r.RegisterFunction("add", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		a, _ := args["a"].(float64)
+		b, _ := args["b"].(float64)
+		return a + b, nil
+	})
+	r.RegisterAssertionWithSchema("equals", "actual deep-equals expected", []string{"actual", "expected", "loose?:boolean"}, func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+		success := deepEqual(params["actual"], params["expected"])
+		if loose, _ := params["loose"].(bool); loose {
+			success = looseEqual(params["actual"], params["expected"])
+		}
+		return AssertionResult{Success: success, Actual: params["actual"], Expected: params["expected"]}
+	})
+	return r
+}
+
+// runLines serves input line by line and returns the lines written back.
+func runLines(s *Server, input string) []string {
+	var out strings.Builder
+	s.out = &out
+	s.serveLines(strings.NewReader(input))
+	return strings.Split(strings.TrimSpace(out.String()), "\n")
+}
+
+func requestLine(id int, method string, params map[string]interface{}) string {
+	data, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+	if err != nil {
+		panic(err)
+	}
+	return string(data) + "\n"
+}
+
+// call sends method through handleRequest and fails the test on an error
+// response.
+func call(t *testing.T, s *Server, method string, params map[string]interface{}) interface{} {
+	t.Helper()
+	response := s.handleRequest(JSONRPCRequest{JSONRPC: "2.0", ID: 1, Method: method, Params: params})
+	if response.Error != nil {
+		t.Fatalf("%s %v: %s", method, params, response.Error.Message)
+	}
+	return response.Result
+}
+
+// callError sends method through handleRequest and returns the error code
+// of its response, or 0 when it succeeded.
+func callError(s *Server, method string, params map[string]interface{}) int {
+	response := s.handleRequest(JSONRPCRequest{JSONRPC: "2.0", ID: 1, Method: method, Params: params})
+	if response.Error == nil {
+		return 0
+	}
+	return response.Error.Code
+}
+
+func TestFnCallCopiesArgs(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterFunction("mutate", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		first := args["list"].([]interface{})[0]
+		args["list"].([]interface{})[0] = "changed"
+		args["extra"] = true
+		return first, nil
+	})
+	s := NewServer(r)
+	params := map[string]interface{}{"name": "mutate", "args": map[string]interface{}{"list": []interface{}{"orig"}}}
+	for i := 0; i < 2; i++ {
+		result := call(t, s, "fn.call", params).(map[string]interface{})
+		if result["result"] != "orig" {
+			t.Fatalf("call %d saw %v, want the caller's args untouched", i, result["result"])
+		}
+	}
+}
+
+// BenchmarkHandleFnCallCopyArgs measures what the per-call deep copy of
+// args costs; compare the copy and nocopy runs (--no-copy-args).
+func BenchmarkHandleFnCallCopyArgs(b *testing.B) {
+	rows := make([]interface{}, 100)
+	for i := range rows {
+		rows[i] = map[string]interface{}{"id": float64(i), "name": "row", "tags": []interface{}{"a", "b", "c"}}
+	}
+	request := JSONRPCRequest{JSONRPC: "2.0", ID: 1, Method: "fn.call", Params: map[string]interface{}{
+		"name": "noop",
+		"args": map[string]interface{}{"rows": rows},
+	}}
+	for _, copyArgs := range []bool{true, false} {
+		name := "nocopy"
+		if copyArgs {
+			name = "copy"
+		}
+		b.Run(name, func(b *testing.B) {
+			r := NewBaseRegistry()
+			r.RegisterFunction("noop", noop)
+			s := NewServer(r)
+			s.copyArgs = copyArgs
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if response := s.handleRequest(request); response.Error != nil {
+					b.Fatal(response.Error.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestFindFunctionsRequest(t *testing.T) {
+	r := newTestRegistry()
+	r.RegisterFunctionWithTags("db_read", []string{"readonly", "db"}, noop)
+	r.RegisterFunctionWithTags("db_write", []string{"mutation", "db"}, noop)
+	s := NewServer(r)
+	find := func(params map[string]interface{}) []string {
+		return functionNames(call(t, s, "registry.findFunctions", params).(map[string]interface{})["functions"].([]FunctionInfo))
+	}
+	if got, want := find(map[string]interface{}{"pattern": "g*"}), []string{"greet"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("pattern g* = %v, want %v", got, want)
+	}
+	if got, want := find(map[string]interface{}{"tag": "db"}), []string{"db_read", "db_write"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("tag db = %v, want %v", got, want)
+	}
+	if got := find(map[string]interface{}{"tag": "readonly", "pattern": "db_w*"}); len(got) != 0 {
+		t.Fatalf("tag and pattern are not combined: %v", got)
+	}
+}
+
+func TestServerHistoryKeepsLastCalls(t *testing.T) {
+	s := NewServer(newTestRegistry())
+	s.handleFnCall(map[string]interface{}{"name": "add"})
+	if entries := s.history.snapshot(); len(entries) != 0 {
+		t.Fatalf("history is off by default, got %v", entries)
+	}
+	s.SetHistorySize(2)
+	for _, name := range []string{"add", "greet", "nope"} {
+		s.handleFnCall(map[string]interface{}{"name": name})
+	}
+	entries := s.history.snapshot()
+	if len(entries) != 2 || entries[0].Name != "greet" || entries[1].Name != "nope" || entries[1].Success {
+		t.Fatalf("history = %+v, want greet then the failed nope", entries)
+	}
+	s.handleAssertCustom(map[string]interface{}{"name": "equals", "params": map[string]interface{}{"actual": 1, "expected": 1}})
+	if last := s.history.snapshot()[1]; last.Method != "assert.custom" || !last.Success {
+		t.Fatalf("assertion entry = %+v", last)
+	}
+
+	cleared := call(t, s, "server.history", map[string]interface{}{"clear": true}).(map[string]interface{})
+	if len(cleared["entries"].([]CallRecord)) != 2 || len(s.history.snapshot()) != 0 {
+		t.Fatalf("clear returned %v and left %v", cleared, s.history.snapshot())
+	}
+}
+
+func TestHookCallMergesReturnedValuesAndParams(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterContextHook("before_all", func(ctx *Context) (map[string]interface{}, error) {
+		return map[string]interface{}{"test_started": true}, nil
+	})
+	r.RegisterHookWithParams("before_each", func(ctx *Context, params map[string]interface{}) error {
+		ctx.Set("seen", params["step"])
+		return nil
+	})
+	s := NewServer(r)
+	call(t, s, "hook.call", map[string]interface{}{"hook": "before_all"})
+	if s.ctx.Get("test_started") != true {
+		t.Fatal("hook return values did not reach the context")
+	}
+	call(t, s, "hook.call", map[string]interface{}{"hook": "before_each", "hookParams": map[string]interface{}{"step": "build"}})
+	if s.ctx.Get("seen") != "build" {
+		t.Fatalf("seen = %v, want build", s.ctx.Get("seen"))
+	}
+	call(t, s, "hook.call", map[string]interface{}{"hook": "before_each"})
+	if s.ctx.Get("seen") != nil {
+		t.Fatalf("hookParams leaked into the next call: %v", s.ctx.Get("seen"))
+	}
+}
+
+func TestProtectStdoutKeepsProtocolStreamClean(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterFunction("noisy", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		fmt.Println("stray output")
+		return 1, nil
+	})
+	s := NewServer(r)
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+	if err := s.ProtectStdout(); err != nil {
+		t.Fatal(err)
+	}
+	lines := runLines(s, requestLine(1, "fn.call", map[string]interface{}{"name": "noisy"}))
+	if len(lines) != 1 || !strings.Contains(lines[0], `"result"`) {
+		t.Fatalf("protocol stream = %q, want only the response", lines)
+	}
+}
+
+// warmRegistry counts Warmup calls and fails them with err.
+type warmRegistry struct {
+	*BaseRegistry
+	calls int
+	err   error
+}
+
+func (w *warmRegistry) Warmup(ctx *Context) error {
+	w.calls++
+	return w.err
+}
+
+func TestWarmupRunsOnce(t *testing.T) {
+	w := &warmRegistry{BaseRegistry: NewBaseRegistry()}
+	s := NewServer(w)
+	call(t, s, "server.warmup", nil)
+	call(t, s, "server.warmup", nil)
+	if w.calls != 1 {
+		t.Fatalf("Warmup ran %d times, want 1", w.calls)
+	}
+	failing := NewServer(&warmRegistry{BaseRegistry: NewBaseRegistry(), err: errors.New("no database")})
+	if code := callError(failing, "server.warmup", nil); code == 0 {
+		t.Fatal("a failed warmup was reported as success")
+	}
+	if result := call(t, NewServer(NewBaseRegistry()), "server.warmup", nil).(map[string]interface{}); result["warmed"] != true {
+		t.Fatalf("warmup without a Warmer = %v", result)
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	s := NewServer(newTestRegistry())
+	s.SetAllowedMethods([]string{"fn.call", " ctx.get"})
+	if code := callError(s, "ctx.set", map[string]interface{}{"key": "k", "value": 1}); code != CodeMethodNotFound {
+		t.Fatalf("ctx.set outside the allowlist = %d, want %d", code, CodeMethodNotFound)
+	}
+	call(t, s, "ctx.get", map[string]interface{}{"key": "k"})
+	call(t, s, "fn.call", map[string]interface{}{"name": "add"})
+}
+
+func TestCtxDiffAgainstSnapshot(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	s.ctx.Set("keep", 1)
+	s.ctx.Set("gone", 1)
+	s.ctx.Set("changed", map[string]interface{}{"a": 1})
+	token := s.ctx.Snapshot(false)
+	s.ctx.Remove("gone")
+	s.ctx.Set("new", 1)
+	s.ctx.Set("changed", map[string]interface{}{"a": 2})
+
+	diff := call(t, s, "ctx.diff", map[string]interface{}{"from": token}).(ContextDiff)
+	if !reflect.DeepEqual(diff.Added, []string{"new"}) || !reflect.DeepEqual(diff.Removed, []string{"gone"}) {
+		t.Fatalf("added %v, removed %v", diff.Added, diff.Removed)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].Key != "changed" {
+		t.Fatalf("changed = %+v", diff.Changed)
+	}
+	if code := callError(s, "ctx.diff", map[string]interface{}{"from": "unknown"}); code == 0 {
+		t.Fatal("an unknown snapshot token was accepted")
+	}
+}
+
+func TestFunctionLogEventsPrecedeResponse(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterFunction("chatty", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		ctx.Log("info", "one", nil)
+		ctx.Log("warn", "two", map[string]interface{}{"n": 2})
+		return 1, nil
+	})
+	lines := runLines(NewServer(r), requestLine(7, "fn.call", map[string]interface{}{"name": "chatty"}))
+	if len(lines) != 3 {
+		t.Fatalf("got %q, want two log notifications and the response", lines)
+	}
+	for _, line := range lines[:2] {
+		if !strings.Contains(line, `"method":"log"`) || !strings.Contains(line, `"id":7`) {
+			t.Fatalf("log notification %s does not name request 7", line)
+		}
+	}
+	if !strings.Contains(lines[2], `"result"`) {
+		t.Fatalf("last line %s is not the response", lines[2])
+	}
+}
+
+func TestFlattenEnv(t *testing.T) {
+	ctx := NewContext()
+	ctx.Set("lastUser", map[string]interface{}{
+		"email":   "a@b",
+		"age":     3.0,
+		"tags":    []interface{}{"x"},
+		"profile": map[string]interface{}{"is-admin": true},
+	})
+	ctx.Set("n", nil)
+	env := ctx.FlattenEnv("ta")
+	for key, want := range map[string]string{
+		"TA_LAST_USER_EMAIL":            "a@b",
+		"TA_LAST_USER_AGE":              "3",
+		"TA_LAST_USER_TAGS":             `["x"]`,
+		"TA_LAST_USER_PROFILE_IS_ADMIN": "true",
+		"TA_N":                          "",
+	} {
+		if got, ok := env[key]; !ok || got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestListHooksRequest(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterHook("after_all", func(ctx *Context) error { return nil })
+	r.RegisterHook("before_all", func(ctx *Context) error { return nil })
+	result := call(t, NewServer(r), "registry.listHooks", nil).(map[string]interface{})
+	if want := []string{"after_all", "before_all"}; !reflect.DeepEqual(result["hooks"], want) {
+		t.Fatalf("hooks = %v, want %v", result["hooks"], want)
+	}
+}
+
+func TestAssertConditionalSkipsWhenFalsy(t *testing.T) {
+	s := NewServer(newTestRegistry())
+	spec := map[string]interface{}{"when": "user.premium", "name": "equals", "params": map[string]interface{}{"actual": 1, "expected": 2}}
+	if result := call(t, s, "assert.conditional", spec).(AssertionResult); !result.Success || !result.Skipped {
+		t.Fatalf("falsy condition = %+v, want a skipped pass", result)
+	}
+	s.ctx.Set("user", map[string]interface{}{"premium": true})
+	if result := call(t, s, "assert.conditional", spec).(AssertionResult); result.Success || result.Skipped {
+		t.Fatalf("truthy condition = %+v, want the assertion to run and fail", result)
+	}
+}
+
+func TestFnPipeFeedsResultsForward(t *testing.T) {
+	r := newTestRegistry()
+	r.RegisterFunction("create_user", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return map[string]interface{}{"name": args["name"]}, nil
+	})
+	s := NewServer(r)
+	steps := []interface{}{
+		map[string]interface{}{"name": "create_user", "args": map[string]interface{}{"name": "A"}, "as": "u"},
+		map[string]interface{}{"name": "greet", "args": map[string]interface{}{"name": map[string]interface{}{"$ctx": "u.name"}}},
+	}
+	results := call(t, s, "fn.pipe", map[string]interface{}{"steps": steps}).(map[string]interface{})["results"].([]interface{})
+	if got := results[1].(map[string]interface{})["message"]; got != "Hello, A!" {
+		t.Fatalf("second step = %v, want it to see the first step's result", got)
+	}
+	failing := append([]interface{}{map[string]interface{}{"name": "nope"}}, steps...)
+	if code := callError(s, "fn.pipe", map[string]interface{}{"steps": failing}); code == 0 {
+		t.Fatal("a pipe with a missing function succeeded")
+	}
+	unresolved := []interface{}{map[string]interface{}{"name": "greet", "args": map[string]interface{}{"name": map[string]interface{}{"$ctx": "missing"}}}}
+	if code := callError(s, "fn.pipe", map[string]interface{}{"steps": unresolved}); code == 0 {
+		t.Fatal("a pipe with an unresolved reference succeeded")
+	}
+}
+
+func TestFnPipeStepsGetFnCallResultHandling(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterFunction("build", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return NewStepResult(map[string]interface{}{"artifact": "a.tar"}), nil
+	})
+	r.RegisterFunction("tail", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return strings.NewReader("log line"), nil
+	})
+	r.RegisterFunction("echo", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return args["n"], nil
+	})
+	s := NewServer(r)
+	s.ctx.StepName = "compile"
+	steps := []interface{}{
+		map[string]interface{}{"name": "build", "as": "b"},
+		map[string]interface{}{"name": "tail", "as": "t"},
+		map[string]interface{}{"name": "echo", "args": map[string]interface{}{"n": "3"}, "coerce": true, "as": "n"},
+	}
+	lines := runLines(s, requestLine(1, "fn.pipe", map[string]interface{}{"steps": steps}))
+	if last := lines[len(lines)-1]; strings.Contains(last, `"error"`) {
+		t.Fatalf("fn.pipe = %s", last)
+	}
+	if got := s.ctx.Get("b"); !deepEqual(got, map[string]interface{}{"artifact": "a.tar"}) {
+		t.Fatalf("step result stored as %#v, want its outputs", got)
+	}
+	if got := s.ctx.GetStepOutput("compile", "artifact"); got != "a.tar" {
+		t.Fatalf("step output = %v", got)
+	}
+	if got, _ := s.ctx.Get("t").(map[string]interface{}); got["streamed"] != true {
+		t.Fatalf("reader result stored as %#v, want the stream summary", s.ctx.Get("t"))
+	}
+	if got := s.ctx.Get("n"); got != 3.0 {
+		t.Fatalf("coerced arg = %#v, want 3", got)
+	}
+}
+
+func TestAssertStepEquals(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	s.ctx.SetStepOutputs("build", map[string]interface{}{"sha": "abc"})
+	s.ctx.Set("stored", map[string]interface{}{"sha": "abc"})
+	tests := []struct {
+		params map[string]interface{}
+		want   bool
+	}{
+		{map[string]interface{}{"stepId": "build", "outputName": "sha", "expectedRef": "stored.sha"}, true},
+		{map[string]interface{}{"stepId": "build", "outputName": "sha", "expected": "abc"}, true},
+		{map[string]interface{}{"stepId": "deploy", "outputName": "sha", "expected": "abc"}, false},
+		{map[string]interface{}{"stepId": "build", "outputName": "tag", "expected": "abc"}, false},
+		{map[string]interface{}{"stepId": "build", "outputName": "sha", "expectedRef": "nope"}, false},
+		{map[string]interface{}{"stepId": "build", "outputName": "sha", "expected": "zzz"}, false},
+	}
+	for _, tt := range tests {
+		if got := call(t, s, "assert.stepEquals", tt.params).(AssertionResult); got.Success != tt.want {
+			t.Errorf("assert.stepEquals %v = %+v, want %v", tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestRunDeadline(t *testing.T) {
+	s := NewServer(newTestRegistry())
+	add := map[string]interface{}{"name": "add"}
+	ms := int64(1000)
+	s.ctx.Clock = &ClockState{VirtualTimeMs: &ms, Frozen: true}
+	call(t, s, "ctx.setDeadline", map[string]interface{}{"duration_ms": 500.0})
+	call(t, s, "fn.call", add)
+	if remaining, ok := s.ctx.TimeRemaining(); !ok || remaining != 500*time.Millisecond {
+		t.Fatalf("TimeRemaining = %v, %v", remaining, ok)
+	}
+	later := int64(1500)
+	s.ctx.Clock = &ClockState{VirtualTimeMs: &later, Frozen: true}
+	if code := callError(s, "fn.call", add); code != CodeDeadlineExceeded {
+		t.Fatalf("fn.call past the deadline = %d, want %d", code, CodeDeadlineExceeded)
+	}
+	call(t, s, "ctx.setDeadline", map[string]interface{}{"duration_ms": nil})
+	call(t, s, "fn.call", add)
+}
+
+func TestSetDeadlineRequiresExactlyOneValidField(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	call(t, s, "ctx.setDeadline", map[string]interface{}{"deadline": "2030-01-01T00:00:00Z"})
+	for _, params := range []map[string]interface{}{
+		{},
+		{"deadline_ms": "soon"},
+		{"deadline": 5.0},
+		{"duration_ms": true},
+		{"deadline": "tomorrow"},
+		{"deadline_ms": 1.0, "duration_ms": 1.0},
+	} {
+		if code := callError(s, "ctx.setDeadline", params); code != CodeInvalidParams {
+			t.Errorf("%v = %d, want %d", params, code, CodeInvalidParams)
+		}
+	}
+	if _, ok := s.ctx.TimeRemaining(); !ok {
+		t.Fatal("a rejected ctx.setDeadline cleared the deadline")
+	}
+	call(t, s, "ctx.setDeadline", map[string]interface{}{"deadline": nil})
+	if _, ok := s.ctx.TimeRemaining(); ok {
+		t.Fatal("an explicit null did not clear the deadline")
+	}
+}
+
+func TestGetOrDefault(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	s.ctx.Set("null", nil)
+	s.ctx.Set("set", 1)
+	for key, want := range map[string]interface{}{"null": nil, "set": 1, "unset": 5.0} {
+		result := call(t, s, "ctx.getOrDefault", map[string]interface{}{"key": key, "default": 5.0}).(map[string]interface{})
+		if result["value"] != want {
+			t.Errorf("%s = %v, want %v", key, result["value"], want)
+		}
+	}
+}
+
+func TestFnCallResolvesContextRefs(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterFunction("echo", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		args["list"].([]interface{})[1].(map[string]interface{})["x"] = "mutated"
+		return args, nil
+	})
+	s := NewServer(r)
+	s.ctx.Set("last_user", map[string]interface{}{"email": "a@b", "meta": map[string]interface{}{"x": 1}})
+	result := call(t, s, "fn.call", map[string]interface{}{"name": "echo", "args": map[string]interface{}{
+		"plain": map[string]interface{}{"$ctx": "a", "other": 1},
+		"list":  []interface{}{map[string]interface{}{"$ctx": "last_user.email"}, map[string]interface{}{"$ctx": "last_user.meta"}},
+	}}).(map[string]interface{})["result"].(map[string]interface{})
+	if got := result["list"].([]interface{})[0]; got != "a@b" {
+		t.Fatalf("ref resolved to %v, want a@b", got)
+	}
+	if result["plain"].(map[string]interface{})["$ctx"] != "a" {
+		t.Fatal("an object with keys besides $ctx was treated as a ref")
+	}
+	if v, _ := s.ctx.Resolve("last_user.meta.x"); v != 1 {
+		t.Fatalf("the function mutated the context through a resolved ref: x = %v", v)
+	}
+	if code := callError(s, "fn.call", map[string]interface{}{"name": "echo", "args": map[string]interface{}{"a": map[string]interface{}{"$ctx": "nope"}}}); code != CodeInvalidParams {
+		t.Fatalf("unresolved ref = %d, want %d", code, CodeInvalidParams)
+	}
+}
+
+func TestFnCallRejectsArgsRefToNonObject(t *testing.T) {
+	s := NewServer(newTestRegistry())
+	s.ctx.Set("k", "str")
+	s.ctx.Set("obj", map[string]interface{}{"a": 1.0, "b": 2.0})
+	params := map[string]interface{}{"name": "add", "args": map[string]interface{}{"$ctx": "k"}}
+	if code := callError(s, "fn.call", params); code != CodeInvalidParams {
+		t.Fatalf("args ref to a string = %d, want %d", code, CodeInvalidParams)
+	}
+	params["args"] = map[string]interface{}{"$ctx": "obj"}
+	if result := call(t, s, "fn.call", params).(map[string]interface{}); result["result"] != 3.0 {
+		t.Fatalf("args ref to an object = %v", result)
+	}
+}
+
+func TestBatchReturnsPartialResults(t *testing.T) {
+	s := NewServer(newTestRegistry())
+	lines := runLines(s, `[`+
+		`{"jsonrpc":"2.0","id":1,"method":"ctx.set","params":{"key":"k","value":1}},`+
+		`{"jsonrpc":"2.0","method":"ctx.set","params":{"key":"n","value":2}},`+
+		`{"jsonrpc":"2.0","id":2,"method":"nope"},`+
+		`{"jsonrpc":"2.0","id":3,"method":"fn.call","params":{"name":"missing"}},`+
+		`5]`+"\n[]\n")
+	var responses []JSONRPCResponse
+	if err := json.Unmarshal([]byte(lines[0]), &responses); err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 4 {
+		t.Fatalf("got %d responses, want one per request with an id plus the invalid entry: %s", len(responses), lines[0])
+	}
+	if responses[0].Error != nil || responses[1].Error.Code != CodeMethodNotFound ||
+		responses[2].Error.Code != CodeFunctionNotFound || responses[2].ID != 3.0 ||
+		responses[3].Error.Code != CodeInvalidRequest {
+		t.Fatalf("batch responses = %s", lines[0])
+	}
+	if s.ctx.Get("n") != 2.0 {
+		t.Fatal("the notification in the batch was not applied")
+	}
+	if !strings.Contains(lines[1], strconv.Itoa(CodeInvalidRequest)) {
+		t.Fatalf("empty batch = %s, want an invalid request", lines[1])
+	}
+}
+
+func TestExecutionInfoRefs(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	call(t, s, "ctx.setExecutionInfo", map[string]interface{}{"runId": "r1", "jobName": "j", "stepName": "st"})
+	for ref, want := range map[string]string{"run:id": "r1", "job:name": "j", "step:name": "st"} {
+		if v, ok := s.ctx.Resolve(ref); !ok || v != want {
+			t.Errorf("Resolve(%s) = %v, %v; want %s", ref, v, ok, want)
+		}
+	}
+}
+
+func TestSetExecutionInfoUpdatesOnlyGivenFields(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	call(t, s, "ctx.setExecutionInfo", map[string]interface{}{"runId": "r", "jobName": "j", "stepName": "a"})
+	call(t, s, "ctx.setExecutionInfo", map[string]interface{}{"stepName": "b"})
+	if s.ctx.RunID != "r" || s.ctx.JobName != "j" || s.ctx.StepName != "b" {
+		t.Fatalf("execution info = %q/%q/%q", s.ctx.RunID, s.ctx.JobName, s.ctx.StepName)
+	}
+	call(t, s, "ctx.setExecutionInfo", map[string]interface{}{"jobName": ""})
+	if s.ctx.JobName != "" || s.ctx.RunID != "r" {
+		t.Fatal("an empty string did not clear only jobName")
+	}
+	if code := callError(s, "ctx.setExecutionInfo", map[string]interface{}{"runId": 1}); code != CodeInvalidParams || s.ctx.RunID != "r" {
+		t.Fatalf("wrong-typed runId = %d and left runId %q", code, s.ctx.RunID)
+	}
+}
+
+func TestAssertionSeverity(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	result := call(t, s, "assert.custom", map[string]interface{}{
+		"name": "in_range", "severity": "warning", "params": map[string]interface{}{"actual": 1, "min": 2, "max": 3},
+	}).(AssertionResult)
+	if result.Success || result.Severity != "warning" {
+		t.Fatalf("warning assertion = %+v", result)
+	}
+	result = call(t, s, "assert.custom", map[string]interface{}{"name": "is_true", "params": map[string]interface{}{"actual": 1}}).(AssertionResult)
+	if result.Severity != "error" {
+		t.Fatalf("default severity = %q, want error", result.Severity)
+	}
+	if code := callError(s, "assert.custom", map[string]interface{}{"name": "is_true", "severity": "loud"}); code != CodeInvalidParams {
+		t.Fatalf("unknown severity = %d, want %d", code, CodeInvalidParams)
+	}
+}
+
+func TestRegistryDescribe(t *testing.T) {
+	r := newTestRegistry()
+	examples := []map[string]interface{}{{"args": map[string]interface{}{"a": 1.0, "b": 2.0}, "result": 3.0}}
+	r.RegisterFunctionWithExamples("sum", examples, noop)
+	s := NewServer(r)
+	if info := call(t, s, "registry.describe", map[string]interface{}{"name": "greet"}).(FunctionInfo); info.Name != "greet" || info.Defaults["name"] != "World" {
+		t.Fatalf("describe greet = %+v", info)
+	}
+	if info := call(t, s, "registry.describe", map[string]interface{}{"name": "sum"}).(FunctionInfo); !reflect.DeepEqual(info.Examples, examples) {
+		t.Fatalf("describe sum = %+v", info)
+	}
+	if code := callError(s, "registry.describe", map[string]interface{}{"name": "nope"}); code != CodeInvalidParams {
+		t.Fatalf("describe nope = %d, want %d", code, CodeInvalidParams)
+	}
+}
+
+func TestCtxStats(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	s.ctx.Set("a", 1)
+	s.ctx.SetStepOutputs("build", map[string]interface{}{})
+	before := s.ctx.Stats()
+	s.ctx.Set("big", strings.Repeat("x", 1000))
+	after := s.ctx.Stats()
+	if before.KeyCount != 1 || before.StepCount != 1 || after.KeyCount != 2 {
+		t.Fatalf("stats = %+v then %+v", before, after)
+	}
+	if after.ApproxBytes < before.ApproxBytes+1000 {
+		t.Fatalf("ApproxBytes grew from %d to %d after adding 1000 bytes", before.ApproxBytes, after.ApproxBytes)
+	}
+}
+
+func TestFnCallReportsDuration(t *testing.T) {
+	s := NewServer(newTestRegistry())
+	result := call(t, s, "fn.call", map[string]interface{}{"name": "add"}).(map[string]interface{})
+	if d, ok := result["durationMs"].(float64); !ok || d < 0 {
+		t.Fatalf("durationMs = %v", result["durationMs"])
+	}
+	s.reportDuration = false
+	if result := call(t, s, "fn.call", map[string]interface{}{"name": "add"}).(map[string]interface{}); result["durationMs"] != nil {
+		t.Fatalf("durationMs reported after it was turned off: %v", result)
+	}
+}
+
+func TestReaderResultsAreStreamedAsChunks(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef\x00\xff"), 5000)
+	r := NewBaseRegistry()
+	r.RegisterFunction("tail", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return io.NopCloser(bytes.NewReader(payload)), nil
+	})
+	lines := runLines(NewServer(r), requestLine(5, "fn.call", map[string]interface{}{"name": "tail"}))
+	if len(lines) < 3 {
+		t.Fatalf("got %d lines, want several chunks and the response", len(lines))
+	}
+	var got []byte
+	for _, line := range lines[:len(lines)-1] {
+		var notification struct {
+			Method string
+			Params StreamChunk
+		}
+		if err := json.Unmarshal([]byte(line), &notification); err != nil {
+			t.Fatal(err)
+		}
+		if notification.Method != "fn.chunk" || notification.Params.ID != 5.0 {
+			t.Fatalf("unexpected line %s", line)
+		}
+		data, err := base64.StdEncoding.DecodeString(notification.Params.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, data...)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("reassembled %d bytes, want %d", len(got), len(payload))
+	}
+	if !strings.Contains(lines[len(lines)-1], `"id":5`) {
+		t.Fatalf("last line %s is not the response", lines[len(lines)-1])
+	}
+}
+
+func TestKeepaliveDuringLongCall(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterFunction("slow", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		time.Sleep(60 * time.Millisecond)
+		return "done", nil
+	})
+	lines := runLines(NewServer(r), requestLine(7, "fn.call", map[string]interface{}{"name": "slow", "keepaliveMs": 10}))
+	if len(lines) < 2 || !strings.Contains(lines[0], `"keepalive"`) || !strings.Contains(lines[0], `"id":7`) {
+		t.Fatalf("got %q, want keepalive notifications for request 7", lines)
+	}
+	if last := lines[len(lines)-1]; !strings.Contains(last, `"done"`) {
+		t.Fatalf("last line %s is not the response", last)
+	}
+}
+
+func TestCtxRename(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	s.ctx.Set("a", 1)
+	s.ctx.Set("b", 2)
+	if result := call(t, s, "ctx.rename", map[string]interface{}{"from": "a", "to": "b"}).(map[string]interface{}); result["moved"] != true {
+		t.Fatalf("rename = %v", result)
+	}
+	if s.ctx.Get("b") != 1 || s.ctx.Has("a") {
+		t.Fatalf("after rename a = %v, b = %v", s.ctx.Get("a"), s.ctx.Get("b"))
+	}
+	if result := call(t, s, "ctx.rename", map[string]interface{}{"from": "missing", "to": "x"}).(map[string]interface{}); result["moved"] != false || s.ctx.Has("x") {
+		t.Fatalf("renaming a missing key = %v", result)
+	}
+}
+
+func TestCtxClearSteps(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	for _, id := range []string{"a", "b", "c"} {
+		s.ctx.SetStepOutputs(id, map[string]interface{}{"x": 1})
+	}
+	s.ctx.Set("k", 1)
+	if result := call(t, s, "ctx.clearSteps", map[string]interface{}{"stepId": "a"}).(map[string]interface{}); result["cleared"] != 1 {
+		t.Fatalf("clearing one step = %v", result)
+	}
+	if result := call(t, s, "ctx.clearSteps", nil).(map[string]interface{}); result["cleared"] != 2 {
+		t.Fatalf("clearing the rest = %v", result)
+	}
+	if s.ctx.Get("k") != 1 {
+		t.Fatal("clearSteps removed a context value")
+	}
+}
+
+func TestOutputToFD(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	s := NewServer(NewBaseRegistry())
+	if err := s.OutputToFD(int(w.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	s.serveLines(strings.NewReader(requestLine(1, "ctx.stats", nil)))
+	w.Close()
+	data, _ := io.ReadAll(r)
+	if !strings.Contains(string(data), `"id":1`) {
+		t.Fatalf("descriptor received %q", data)
+	}
+	if err := s.OutputToFD(987); err == nil {
+		t.Fatal("a closed descriptor was accepted")
+	}
+}
+
+func TestAssertionStats(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	for _, params := range []map[string]interface{}{
+		{"name": "is_true", "params": map[string]interface{}{"actual": true}},
+		{"name": "is_true", "params": map[string]interface{}{"actual": false}},
+		{"name": "is_empty", "params": map[string]interface{}{"actual": ""}},
+	} {
+		call(t, s, "assert.custom", params)
+	}
+	data, _ := json.Marshal(call(t, s, "server.assertionStats", map[string]interface{}{"clear": true}))
+	want := `{"total":3,"passed":2,"failed":1,"byName":{"is_empty":{"total":1,"passed":1,"failed":0},"is_true":{"total":2,"passed":1,"failed":1}}}`
+	if string(data) != want {
+		t.Fatalf("stats = %s, want %s", data, want)
+	}
+	if stats := call(t, s, "server.assertionStats", nil).(AssertionStats); stats.Total != 0 {
+		t.Fatalf("stats after clear = %+v", stats)
+	}
+}
+
+func TestSnapshotCanIncludeStepOutputs(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	s.ctx.SetStepOutputs("a", map[string]interface{}{"x": "1"})
+	withSteps := call(t, s, "ctx.snapshot", map[string]interface{}{"includeSteps": true}).(map[string]interface{})["token"].(string)
+	dataOnly := call(t, s, "ctx.snapshot", nil).(map[string]interface{})["token"].(string)
+	s.ctx.SetStepOutputs("a", map[string]interface{}{"x": "2"})
+
+	call(t, s, "ctx.restore", map[string]interface{}{"token": dataOnly})
+	if got := s.ctx.GetStepOutput("a", "x"); got != "2" {
+		t.Fatalf("a data-only restore changed step outputs: x = %v", got)
+	}
+	call(t, s, "ctx.restore", map[string]interface{}{"token": withSteps})
+	if got := s.ctx.GetStepOutput("a", "x"); got != "1" {
+		t.Fatalf("restoring with steps left x = %v, want 1", got)
+	}
+}
+
+func TestDescribeAssertion(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	data, _ := json.Marshal(call(t, s, "registry.describeAssertion", map[string]interface{}{"name": "delta_equals"}))
+	want := `{"name":"delta_equals","description":"right - left equals expected within tolerance","params":[` +
+		`{"name":"left","required":true},{"name":"right","required":true},` +
+		`{"name":"expected","type":"number","required":true},{"name":"tolerance","type":"number","required":false}]}`
+	if string(data) != want {
+		t.Fatalf("describe delta_equals = %s, want %s", data, want)
+	}
+	if code := callError(s, "registry.describeAssertion", map[string]interface{}{"name": "nope"}); code == 0 {
+		t.Fatal("describing an unknown assertion succeeded")
+	}
+}
+
+func TestCtxGetMany(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	s.ctx.Set("a", 1)
+	data, _ := json.Marshal(call(t, s, "ctx.getMany", map[string]interface{}{"keys": []interface{}{"a", "b"}}))
+	if string(data) != `{"values":{"a":1,"b":null}}` {
+		t.Fatalf("getMany = %s", data)
+	}
+	if code := callError(s, "ctx.getMany", map[string]interface{}{"keys": []interface{}{1.0}}); code != CodeInvalidParams {
+		t.Fatalf("non-string key = %d, want %d", code, CodeInvalidParams)
+	}
+}
+
+func TestAssertChainShortCircuits(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	notEmpty := map[string]interface{}{"name": "is_not_empty", "params": map[string]interface{}{"actual": 5.0}}
+	inRange := func(min float64) map[string]interface{} {
+		return map[string]interface{}{"name": "in_range", "params": map[string]interface{}{
+			"actual": map[string]interface{}{"$prev": "actual"}, "min": min, "max": 10.0,
+		}}
+	}
+	result := call(t, s, "assert.chain", map[string]interface{}{"assertions": []interface{}{notEmpty, inRange(1)}}).(ChainResult)
+	if !result.Success || result.Index != 1 {
+		t.Fatalf("passing chain = %+v", result)
+	}
+	var ran bool
+	s.registry.(*BaseRegistry).RegisterAssertion("never", func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+		ran = true
+		return AssertionResult{Success: true}
+	})
+	never := map[string]interface{}{"name": "never"}
+	result = call(t, s, "assert.chain", map[string]interface{}{"assertions": []interface{}{notEmpty, inRange(6), never}}).(ChainResult)
+	if result.Success || result.Index != 1 || ran {
+		t.Fatalf("failing chain = %+v, ran after failure = %v", result, ran)
+	}
+}
+
+func TestAssertChainStepErrors(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	inRange := map[string]interface{}{"name": "in_range", "params": map[string]interface{}{"actual": 5.0, "min": 1.0, "max": 9.0}}
+	tests := []struct {
+		step interface{}
+		want int
+	}{
+		{map[string]interface{}{"$prev": "actual"}, CodeInvalidParams},
+		{map[string]interface{}{"name": "in_range", "params": map[string]interface{}{"$prev": "actual"}}, CodeInvalidParams},
+		{map[string]interface{}{"name": "nope"}, CodeAssertionNotFound},
+	}
+	for _, tt := range tests {
+		response := s.handleRequest(JSONRPCRequest{JSONRPC: "2.0", ID: 1, Method: "assert.chain", Params: map[string]interface{}{
+			"assertions": []interface{}{inRange, tt.step},
+		}})
+		if response.Error == nil || response.Error.Code != tt.want || !strings.HasPrefix(response.Error.Message, "assertions[1]: ") {
+			t.Errorf("step %v = %+v, want code %d for assertions[1]", tt.step, response.Error, tt.want)
+		}
+	}
+}
+
+func TestAssertionHintReachesClient(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterAssertion("user_exists", func(params map[string]interface{}, ctx *ReadOnlyContext) AssertionResult {
+		return AssertionResult{Success: false, Message: "no user in context", Hint: "did you forget to call create_user first?"}
+	})
+	lines := runLines(NewServer(r), requestLine(1, "assert.custom", map[string]interface{}{"name": "user_exists"}))
+	if !strings.Contains(lines[0], `"hint":"did you forget to call create_user first?"`) {
+		t.Fatalf("response %s has no hint", lines[0])
+	}
+}
+
+func TestLooseComparison(t *testing.T) {
+	s := NewServer(newTestRegistry())
+	equals := func(params map[string]interface{}) bool {
+		return call(t, s, "assert.custom", map[string]interface{}{"name": "equals", "params": params}).(AssertionResult).Success
+	}
+	if equals(map[string]interface{}{"actual": "2", "expected": 2.0}) {
+		t.Fatal("strict comparison matched a string to a number")
+	}
+	if !equals(map[string]interface{}{"actual": "2", "expected": 2.0, "loose": true}) {
+		t.Fatal("loose comparison did not match")
+	}
+	s.looseEquals = true
+	if !equals(map[string]interface{}{"actual": "2", "expected": 2.0}) {
+		t.Fatal("--loose-equals did not apply")
+	}
+	if equals(map[string]interface{}{"actual": "2", "expected": 2.0, "loose": false}) {
+		t.Fatal("an explicit loose false did not override --loose-equals")
+	}
+}
+
+func TestRegistryStub(t *testing.T) {
+	s := NewServer(newTestRegistry())
+	stubbed := map[string]interface{}{"message": "stubbed"}
+	call(t, s, "registry.stub", map[string]interface{}{"name": "greet", "returns": stubbed})
+	greet := map[string]interface{}{"name": "greet", "args": map[string]interface{}{"name": "x"}}
+	if got := call(t, s, "fn.call", greet).(map[string]interface{})["result"]; !deepEqual(got, stubbed) {
+		t.Fatalf("stubbed greet = %v", got)
+	}
+	if result := call(t, s, "registry.unstub", map[string]interface{}{"name": "greet"}).(map[string]interface{}); result["removed"] != true {
+		t.Fatalf("unstub = %v", result)
+	}
+	if got := call(t, s, "fn.call", greet).(map[string]interface{})["result"]; deepEqual(got, stubbed) {
+		t.Fatal("greet still stubbed after unstub")
+	}
+	if code := callError(s, "registry.stub", map[string]interface{}{"name": "greet"}); code == 0 {
+		t.Fatal("a stub without returns was accepted")
+	}
+}
+
+func TestStepResultBecomesStepOutputs(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterFunction("build", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return NewStepResult(map[string]interface{}{"artifact": "a.tar"}), nil
+	})
+	s := NewServer(r)
+	if code := callError(s, "fn.call", map[string]interface{}{"name": "build"}); code == 0 {
+		t.Fatal("a step result outside a step was accepted")
+	}
+	call(t, s, "ctx.setExecutionInfo", map[string]interface{}{"stepName": "compile"})
+	result := call(t, s, "fn.call", map[string]interface{}{"name": "build"}).(map[string]interface{})
+	if !deepEqual(result["result"], map[string]interface{}{"artifact": "a.tar"}) {
+		t.Fatalf("fn.call = %v", result)
+	}
+	output := call(t, s, "ctx.getStepOutput", map[string]interface{}{"stepId": "compile", "name": "artifact"}).(map[string]interface{})
+	if output["value"] != "a.tar" {
+		t.Fatalf("step output = %v", output)
+	}
+}
+
+func TestFingerprintIgnoresOrderAndNumberTypes(t *testing.T) {
+	a, b := NewContext(), NewContext()
+	a.Set("x", map[string]interface{}{"p": 1, "q": 2})
+	a.Set("y", "z")
+	b.Set("y", "z")
+	b.Set("x", map[string]interface{}{"q": 2.0, "p": 1.0})
+	fa, _ := a.Fingerprint()
+	fb, _ := b.Fingerprint()
+	if fa != fb || len(fa) != 64 {
+		t.Fatalf("fingerprints %q and %q differ", fa, fb)
+	}
+	b.Set("y", "w")
+	if changed, _ := b.Fingerprint(); changed == fa {
+		t.Fatal("changing a value kept the fingerprint")
+	}
+}
+
+func TestHookCallAllRunsEveryPrefixedHook(t *testing.T) {
+	r := NewBaseRegistry()
+	var ran []string
+	r.RegisterHook("before_b", func(ctx *Context) error {
+		ran = append(ran, "b")
+		return errors.New("boom")
+	})
+	r.RegisterHook("before_a", func(ctx *Context) error {
+		ran = append(ran, "a")
+		return nil
+	})
+	r.RegisterContextHook("before_c", func(ctx *Context) (map[string]interface{}, error) {
+		ran = append(ran, "c")
+		return map[string]interface{}{"x": 1}, nil
+	})
+	r.RegisterHook("after_a", func(ctx *Context) error {
+		ran = append(ran, "after")
+		return nil
+	})
+	s := NewServer(r)
+	response := s.handleRequest(JSONRPCRequest{ID: 1, Method: "hook.callAll", Params: map[string]interface{}{"prefix": "before"}})
+	if response.Error == nil || !strings.Contains(response.Error.Message, "1 of 3") {
+		t.Fatalf("hook.callAll = %+v, want one of three failures reported", response)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(ran, want) {
+		t.Fatalf("ran %v, want %v in name order despite the failure", ran, want)
+	}
+	if s.ctx.Get("x") != 1 {
+		t.Fatal("values from a later context hook were dropped")
+	}
+}
+
+func TestRegistryInfo(t *testing.T) {
+	r := newTestRegistry()
+	r.RegisterHook("before_all", func(ctx *Context) error { return nil })
+	info := call(t, NewServer(r), "registry.info", nil).(map[string]interface{})
+	if info["functionCount"] != len(r.ListFunctions()) || info["assertionCount"] != len(r.ListAssertions()) || info["hookCount"] != 1 {
+		t.Fatalf("registry.info = %v", info)
+	}
+	if !reflect.DeepEqual(info["assertions"], r.ListAssertions()) {
+		t.Fatalf("assertions = %v", info["assertions"])
+	}
+}
+
+// methodRegistry serves custom.ping itself.
+type methodRegistry struct{ *BaseRegistry }
+
+func (m methodRegistry) HandleMethod(method string, params map[string]interface{}, ctx *Context) (interface{}, error) {
+	if method == "custom.ping" {
+		return map[string]interface{}{"pong": params["x"]}, nil
+	}
+	return nil, methodNotFound(method)
+}
+
+func TestPassthroughFallback(t *testing.T) {
+	if code := callError(NewServer(newTestRegistry()), "custom.ping", nil); code != CodeMethodNotFound {
+		t.Fatalf("strict server = %d, want %d", code, CodeMethodNotFound)
+	}
+	c, _ := NewCompositeRegistry(OverrideLastWins)
+	c.Add("a", NewBaseRegistry())
+	c.Add("b", methodRegistry{NewBaseRegistry()})
+	s := NewServer(c)
+	s.fallback = func(method string, params map[string]interface{}) (interface{}, error) {
+		return c.HandleMethod(method, params, s.ctx)
+	}
+	if result := call(t, s, "custom.ping", map[string]interface{}{"x": 1}).(map[string]interface{}); result["pong"] != 1 {
+		t.Fatalf("custom.ping = %v", result)
+	}
+	if code := callError(s, "custom.other", nil); code != CodeMethodNotFound {
+		t.Fatalf("method no plugin knows = %d, want %d", code, CodeMethodNotFound)
+	}
+	call(t, s, "ctx.get", map[string]interface{}{"key": "k"})
+}
+
+func TestCtxSwap(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	s.ctx.Set("blue", 1.0)
+	s.ctx.Set("green", 2.0)
+	result := call(t, s, "ctx.swap", map[string]interface{}{"a": "blue", "b": "green"}).(map[string]interface{})
+	if result["a"] != 2.0 || result["b"] != 1.0 || s.ctx.Get("blue") != 2.0 || s.ctx.Get("green") != 1.0 {
+		t.Fatalf("swap = %v", result)
+	}
+	a, b := s.ctx.Swap("blue", "none")
+	if a != nil || b != 2.0 || s.ctx.Get("none") != 2.0 || !s.ctx.Has("blue") || s.ctx.Get("blue") != nil {
+		t.Fatalf("swapping with an unset key = %v, %v", a, b)
+	}
+	if code := callError(s, "ctx.swap", map[string]interface{}{"a": "x"}); code != CodeInvalidParams {
+		t.Fatalf("swap without b = %d, want %d", code, CodeInvalidParams)
+	}
+}
+
+func TestListFunctionsPaging(t *testing.T) {
+	r := NewBaseRegistry()
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		r.RegisterFunction(name, noop)
+	}
+	total := len(r.ListFunctions())
+	s := NewServer(r)
+	page := func(params map[string]interface{}) map[string]interface{} {
+		return call(t, s, "list_functions", params).(map[string]interface{})
+	}
+	if result := page(nil); result["total"] != nil || len(result["functions"].([]FunctionInfo)) != total {
+		t.Fatalf("unpaged list = %v", result)
+	}
+	first := page(map[string]interface{}{"limit": 3.0})
+	if names := functionNames(first["functions"].([]FunctionInfo)); !reflect.DeepEqual(names, []string{"a", "b", "c"}) || first["total"] != total {
+		t.Fatalf("first page = %v", first)
+	}
+	if last := page(map[string]interface{}{"offset": float64(total - 1), "limit": 3.0}); len(last["functions"].([]FunctionInfo)) != 1 {
+		t.Fatalf("last page = %v", last)
+	}
+	if past := page(map[string]interface{}{"offset": float64(total + 1)}); len(past["functions"].([]FunctionInfo)) != 0 || past["offset"] != total {
+		t.Fatalf("page past the end = %v", past)
+	}
+	for _, params := range []map[string]interface{}{{"limit": 0.0}, {"offset": 1.5}} {
+		if code := callError(s, "list_functions", params); code != CodeInvalidParams {
+			t.Errorf("list_functions %v = %d, want %d", params, code, CodeInvalidParams)
+		}
+	}
+}
+
+func TestListFunctionsReportsExamples(t *testing.T) {
+	r := NewBaseRegistry()
+	r.RegisterFunctionWithExamples("sum", []map[string]interface{}{{"args": map[string]interface{}{"a": 1.0}, "result": 1.0}}, noop)
+	data, _ := json.Marshal(call(t, NewServer(r), "list_functions", nil))
+	if strings.Count(string(data), `"examples"`) != 1 {
+		t.Fatalf("list_functions = %s, want examples on sum only", data)
+	}
+}
+
+func TestClockOffsetFollowsRealTime(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	call(t, s, "clock.offset", map[string]interface{}{"offset_ms": 3600000.0})
+	if d := s.ctx.Now().Sub(time.Now()); d < 59*time.Minute || d > 61*time.Minute {
+		t.Fatalf("offset clock is %v ahead, want an hour", d)
+	}
+	if s.ctx.IsClockMocked() {
+		t.Fatal("an offset clock counts as mocked")
+	}
+	before := s.ctx.Now()
+	time.Sleep(20 * time.Millisecond)
+	if s.ctx.Now().Sub(before) < 20*time.Millisecond {
+		t.Fatal("the offset clock does not advance")
+	}
+	if code := callError(s, "clock.offset", nil); code != CodeInvalidParams {
+		t.Fatalf("clock.offset without offset_ms = %d, want %d", code, CodeInvalidParams)
+	}
+	call(t, s, "clock.sync", map[string]interface{}{})
+	if d := s.ctx.Now().Sub(time.Now()); d > time.Minute {
+		t.Fatalf("clock.sync left the clock %v ahead", d)
+	}
+}
+
+func TestUnencodableResultsAreInternalErrors(t *testing.T) {
+	r := newTestRegistry()
+	r.RegisterFunction("channel", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return make(chan int), nil
+	})
+	r.RegisterFunction("func_value", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return map[string]interface{}{"f": func() {}}, nil
+	})
+	lines := runLines(NewServer(r),
+		requestLine(1, "fn.call", map[string]interface{}{"name": "channel"})+
+			requestLine(2, "fn.call", map[string]interface{}{"name": "func_value"})+
+			requestLine(3, "fn.call", map[string]interface{}{"name": "add", "args": map[string]interface{}{"a": 1, "b": 2}}))
+	if len(lines) != 3 {
+		t.Fatalf("got %q, want one line per request", lines)
+	}
+	for _, line := range lines[:2] {
+		var response struct{ Error *RPCError }
+		if err := json.Unmarshal([]byte(line), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Error == nil || response.Error.Code != CodeInternalError || !strings.Contains(response.Error.Message, "fn.call") {
+			t.Fatalf("unencodable result = %s", line)
+		}
+	}
+	if !strings.Contains(lines[2], `"result":3`) {
+		t.Fatalf("the server did not recover: %s", lines[2])
+	}
+}
+
+func TestNilRegistryAnswersWithInternalError(t *testing.T) {
+	var nilBase *BaseRegistry
+	for _, registry := range []Registry{nil, nilBase} {
+		s := NewServer(registry)
+		for _, method := range []string{"fn.call", "list_functions", "assert.custom", "hook.call", "registry.info"} {
+			if code := callError(s, method, map[string]interface{}{"name": "x", "hook": "y"}); code != CodeInternalError {
+				t.Errorf("%s with registry %#v = %d, want %d", method, registry, code, CodeInternalError)
+			}
+		}
+	}
+	if isNilRegistry(NewBaseRegistry()) {
+		t.Fatal("a real registry counted as nil")
+	}
+}
+
+func TestGetStepOutputFollowsNestedPaths(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	s.ctx.SetStepOutputs("login", map[string]interface{}{
+		"response": map[string]interface{}{"body": map[string]interface{}{"id": "u1"}},
+		"a.b":      5.0,
+		"flat":     1.0,
+	})
+	tests := []struct {
+		params map[string]interface{}
+		want   interface{}
+	}{
+		{map[string]interface{}{"stepId": "login", "outputName": "response.body.id"}, "u1"},
+		{map[string]interface{}{"stepId": "login", "name": "flat"}, 1.0},
+		{map[string]interface{}{"stepId": "login", "name": "a.b"}, 5.0},
+		{map[string]interface{}{"stepId": "login", "outputName": "response.nope.id"}, nil},
+		{map[string]interface{}{"stepId": "login", "outputName": "flat.x"}, nil},
+		{map[string]interface{}{"stepId": "unknown", "outputName": "a"}, nil},
+	}
+	for _, tt := range tests {
+		if got := call(t, s, "ctx.getStepOutput", tt.params).(map[string]interface{})["value"]; got != tt.want {
+			t.Errorf("getStepOutput %v = %v, want %v", tt.params, got, tt.want)
+		}
+	}
+	if code := callError(s, "ctx.getStepOutput", map[string]interface{}{"stepId": "login"}); code != CodeInvalidParams {
+		t.Fatalf("getStepOutput without a name = %d, want %d", code, CodeInvalidParams)
+	}
+}
+
+func TestAssertNoErrorAndErrors(t *testing.T) {
+	r := newTestRegistry()
+	r.RegisterFunction("fail", func(args map[string]interface{}, ctx *Context) (interface{}, error) {
+		return nil, errors.New("disk full")
+	})
+	s := NewServer(r)
+	tests := []struct {
+		method string
+		params map[string]interface{}
+		want   bool
+	}{
+		{"assert.noError", map[string]interface{}{"function": "greet"}, true},
+		{"assert.noError", map[string]interface{}{"function": "fail"}, false},
+		{"assert.errors", map[string]interface{}{"function": "fail"}, true},
+		{"assert.errors", map[string]interface{}{"function": "fail", "contains": "disk"}, true},
+		{"assert.errors", map[string]interface{}{"function": "fail", "contains": "network"}, false},
+		{"assert.errors", map[string]interface{}{"function": "add", "args": map[string]interface{}{"a": 1.0}}, false},
+	}
+	for _, tt := range tests {
+		if got := call(t, s, tt.method, tt.params).(AssertionResult); got.Success != tt.want {
+			t.Errorf("%s %v = %+v, want %v", tt.method, tt.params, got, tt.want)
+		}
+	}
+	if code := callError(s, "assert.errors", map[string]interface{}{"function": "nope"}); code != CodeFunctionNotFound {
+		t.Fatalf("unknown function = %d, want %d", code, CodeFunctionNotFound)
+	}
+	if code := callError(s, "assert.noError", map[string]interface{}{}); code != CodeInvalidParams {
+		t.Fatalf("missing function = %d, want %d", code, CodeInvalidParams)
+	}
+}
+
+func TestDumpIncludesStepsAndExecution(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	s.ctx.SetStepOutputs("s", map[string]interface{}{"my_secret": "v", "plain": "p"})
+	call(t, s, "ctx.setExecutionInfo", map[string]interface{}{"runId": "r"})
+	dump := call(t, s, "ctx.dump", map[string]interface{}{"redact": "*secret*"}).(ContextDump)
+	outputs := dump.Steps["s"]["outputs"].(map[string]interface{})
+	if outputs["my_secret"] != redactedValue || outputs["plain"] != "p" {
+		t.Fatalf("step outputs = %v", outputs)
+	}
+	if dump.Execution.RunID != "r" {
+		t.Fatalf("execution = %+v", dump.Execution)
+	}
+	if NewContext().Dump("").Data == nil {
+		t.Fatal("an empty context dumps nil data")
+	}
+}
+
+func TestRequestsWithoutParamsAreAnswered(t *testing.T) {
+	methods := []string{
+		"fn.call", "fn.pipe", "session.hello", "ctx.get", "ctx.getMany", "ctx.getOrDefault",
+		"ctx.set", "ctx.swap", "ctx.rename", "ctx.clear", "ctx.clearSteps", "ctx.diff", "ctx.dump",
+		"ctx.env", "ctx.eval", "ctx.export", "ctx.import", "ctx.fingerprint", "ctx.getHistory",
+		"ctx.getStepOutput", "ctx.syncStepOutputs", "ctx.snapshot", "ctx.restore", "ctx.stats",
+		"ctx.setDeadline", "ctx.setExecutionInfo", "ctx.lock", "ctx.unlock", "ctx.waitFor",
+		"ctx.watch", "assert.custom", "assert.chain", "assert.conditional", "assert.errors",
+		"assert.noError", "assert.stepEquals", "clock.offset", "clock.sync", "hook.call",
+		"hook.callAll", "registry.describe", "registry.describeAssertion", "registry.findFunctions",
+		"registry.info", "registry.listHooks", "registry.stub", "registry.unstub",
+		"server.assertionStats", "server.history", "server.historyTail", "server.metricsText",
+		"server.replayRun", "server.warmup", "server.capabilities",
+	}
+	var input strings.Builder
+	for i, method := range methods {
+		fmt.Fprintf(&input, `{"jsonrpc":"2.0","id":%d,"method":%q}`+"\n", i+1, method)
+	}
+	lines := runLines(NewServer(newTestRegistry()), input.String())
+	if len(lines) != len(methods) {
+		t.Fatalf("got %d responses for %d requests", len(lines), len(methods))
+	}
+	for _, line := range lines {
+		var response JSONRPCResponse
+		if err := json.Unmarshal([]byte(line), &response); err != nil {
+			t.Fatalf("response %q: %v", line, err)
+		}
+		if response.Error != nil && response.Error.Code == CodeInternalError {
+			t.Errorf("internal error: %s", line)
+		}
+	}
+}
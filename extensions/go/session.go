@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Protocol versions understood by the server. Version 2 added batch requests
+// and fn.chunk streaming; a client that negotiates version 1 gets neither.
+// A session that never sends session.hello (as on stdin/stdout) runs at
+// protocolVersionMax.
+const (
+	protocolVersionMin = 1
+	protocolVersionMax = 2
+)
+
+// session is what one connection, or the stdin/stdout stream, has
+// negotiated. serveLines and serveListener start a fresh one for every
+// stream they serve, so a version or compression setting never carries over
+// to the next connection.
+type session struct {
+	// conn is the --listen connection being served; nil on stdin/stdout.
+	conn           net.Conn
+	version        int
+	compressFrames bool
+}
+
+func (s *Server) protocolVersion() int {
+	if s.session.version == 0 {
+		return protocolVersionMax
+	}
+	return s.session.version
+}
+
+// handleSessionHello negotiates the protocol version for the current
+// session. A version the server does not support is rejected with the
+// supported range rather than lowered, so a mismatch surfaces up front.
+func (s *Server) handleSessionHello(params map[string]interface{}) (interface{}, error) {
+	raw, ok := params["version"].(float64)
+	if !ok || raw != float64(int(raw)) {
+		return nil, invalidParams("param %q must be an integer protocol version", "version")
+	}
+	requested := int(raw)
+	if requested < protocolVersionMin || requested > protocolVersionMax {
+		return nil, invalidParams("unsupported protocol version %d: server supports versions %d to %d", requested, protocolVersionMin, protocolVersionMax)
+	}
+
+	s.session.version = requested
+	return map[string]interface{}{
+		"version":       requested,
+		"serverVersion": protocolVersionMax,
+		"minVersion":    protocolVersionMin,
+	}, nil
+}
+
+func (s *Server) requireProtocol(version int, feature string) error {
+	if s.protocolVersion() < version {
+		return fmt.Errorf("%s require protocol version %d, session negotiated %d", feature, version, s.protocolVersion())
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSessionHelloNegotiatesVersion(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	if _, err := s.handleSessionHello(map[string]interface{}{"version": 0.0}); err == nil || !strings.Contains(err.Error(), "unsupported protocol version 0") {
+		t.Fatalf("version 0: %v", err)
+	}
+	if _, err := s.handleSessionHello(map[string]interface{}{"version": 1.5}); errorCode(err) != CodeInvalidParams {
+		t.Fatalf("fractional version: %v", err)
+	}
+	_, err := s.handleSessionHello(map[string]interface{}{"version": 9.0})
+	if errorCode(err) != CodeInvalidParams || !strings.Contains(err.Error(), "server supports versions 1 to 2") {
+		t.Fatalf("version 9: %v", err)
+	}
+	result, err := s.handleSessionHello(map[string]interface{}{"version": 1.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.(map[string]interface{})["version"]; got != 1 {
+		t.Fatalf("negotiated %v, want 1", got)
+	}
+}
+
+func TestVersionOneSessionRejectsBatches(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	hello := requestLine(1, "session.hello", map[string]interface{}{"version": 1})
+	lines := runLines(s, hello+`[{"jsonrpc":"2.0","id":2,"method":"ctx.stats"}]`+"\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], "batch requests require protocol version 2") {
+		t.Fatalf("batch under version 1 = %q", lines)
+	}
+}
+
+func TestSessionVersionDoesNotOutliveItsConnection(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	runLines(s, requestLine(1, "session.hello", map[string]interface{}{"version": 1}))
+	lines := runLines(s, `[{"jsonrpc":"2.0","id":2,"method":"ctx.stats"}]`+"\n")
+	if strings.Contains(lines[0], "require protocol version") {
+		t.Fatalf("a new session inherited version 1: %s", lines[0])
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// tapBuffer is how many exchanges a tap may fall behind by before further
+// ones are dropped for it.
+const tapBuffer = 256
+
+type TapEvent struct {
+	Request  JSONRPCRequest  `json:"request"`
+	Response JSONRPCResponse `json:"response"`
+	Dropped  uint64          `json:"dropped"`
+}
+
+type tap struct {
+	events  chan TapEvent
+	dropped atomic.Uint64
+}
+
+// handleServerTap turns the calling connection into a read-only stream of
+// "tap" notifications, one per exchange served on any later connection.
+// It needs --listen (the stdin/stdout session has no connection to hand
+// over) and --allow-tap. Once the response is written the connection is no
+// longer read for requests, and the next connection is accepted.
+func (s *Server) handleServerTap(params map[string]interface{}) (interface{}, error) {
+	if !s.allowTap {
+		return nil, fmt.Errorf("server.tap is disabled (start the server with --allow-tap)")
+	}
+	if s.session.conn == nil {
+		return nil, fmt.Errorf("server.tap is only available on --listen connections")
+	}
+	s.detachConn = true
+	return map[string]interface{}{"tapping": true}, nil
+}
+
+// startTap hands conn over to a new tap. Exchanges reach it through a
+// buffered channel, so a slow reader never holds up dispatch: when the
+// buffer is full the exchange is dropped and counted in the next event's
+// dropped field.
+func (s *Server) startTap(conn net.Conn) {
+	t := &tap{events: make(chan TapEvent, tapBuffer)}
+
+	s.tapMu.Lock()
+	if s.taps == nil {
+		s.taps = make(map[int]*tap)
+	}
+	s.tapSeq++
+	id := s.tapSeq
+	s.taps[id] = t
+	s.tapMu.Unlock()
+
+	go func() {
+		defer conn.Close()
+		for event := range t.events {
+			data, err := json.Marshal(jsonRPCNotification("tap", event))
+			if err != nil {
+				continue
+			}
+			if _, err := conn.Write(append(data, '\n')); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		// Anything the tap sends is ignored; reading only notices when it
+		// hangs up.
+		io.Copy(io.Discard, conn)
+		s.stopTap(id)
+		conn.Close()
+	}()
+}
+
+func (s *Server) stopTap(id int) {
+	s.tapMu.Lock()
+	defer s.tapMu.Unlock()
+	if t, ok := s.taps[id]; ok {
+		close(t.events)
+		delete(s.taps, id)
+	}
+}
+
+func (s *Server) publishTap(request JSONRPCRequest, response JSONRPCResponse) {
+	s.tapMu.Lock()
+	defer s.tapMu.Unlock()
+	for _, t := range s.taps {
+		select {
+		case t.events <- TapEvent{Request: request, Response: response, Dropped: t.dropped.Load()}:
+		default:
+			t.dropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTapStreamsExchangesFromOtherConnections(t *testing.T) {
+	s := NewServer(newTestRegistry())
+	s.allowTap = true
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "bridge.sock"))
+	if err != nil {
+		t.Skip(err)
+	}
+	go s.serveListener(listener)
+	defer listener.Close()
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("unix", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+
+	tapConn, tapReader := dial()
+	defer tapConn.Close()
+	tapConn.Write([]byte(requestLine(1, "server.tap", nil)))
+	if line, _ := tapReader.ReadString('\n'); !strings.Contains(line, `"tapping":true`) {
+		t.Fatalf("server.tap = %s", line)
+	}
+
+	conn, reader := dial()
+	defer conn.Close()
+	conn.Write([]byte(requestLine(7, "fn.call", map[string]interface{}{"name": "add", "args": map[string]interface{}{"a": 1, "b": 2}})))
+	if line, _ := reader.ReadString('\n'); !strings.Contains(line, `"result":3`) {
+		t.Fatalf("fn.call = %s", line)
+	}
+	event, err := tapReader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"method":"tap"`, `"method":"fn.call"`, `"result":3`} {
+		if !strings.Contains(event, want) {
+			t.Fatalf("tap event %s is missing %s", event, want)
+		}
+	}
+}
+
+func TestTapRequiresAllowTap(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	if _, err := s.handleServerTap(nil); err == nil || !strings.Contains(err.Error(), "disabled") {
+		t.Fatalf("server.tap without --allow-tap: %v", err)
+	}
+}
+
+func TestSlowTapDropsInsteadOfBlocking(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	slow := &tap{events: make(chan TapEvent, 1)}
+	s.taps = map[int]*tap{1: slow}
+	s.publishTap(JSONRPCRequest{}, JSONRPCResponse{})
+	s.publishTap(JSONRPCRequest{}, JSONRPCResponse{})
+	if got := slow.dropped.Load(); got != 1 {
+		t.Fatalf("dropped = %d, want 1", got)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ValueVersion is one change to a key. Removed marks a Remove, Clear, the
+// source of a Rename, or a key that a Restore or Import dropped.
+type ValueVersion struct {
+	Value     interface{} `json:"value"`
+	Removed   bool        `json:"removed,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// versionTime is the timestamp for the versions a mutation is about to
+// record. Now takes c.mu, so mutators call it before locking.
+func (c *Context) versionTime() time.Time {
+	if c.HistoryDepth <= 0 {
+		return time.Time{}
+	}
+	return c.Now()
+}
+
+// recordVersion appends value to key's history, dropping the oldest version
+// once HistoryDepth is exceeded. It does nothing while history is off. The
+// caller must hold c.mu.
+func (c *Context) recordVersion(key string, value interface{}, at time.Time) {
+	if c.HistoryDepth <= 0 {
+		return
+	}
+	c.appendVersion(key, ValueVersion{Value: deepCopy(value), Timestamp: at})
+}
+
+// recordRemoval is recordVersion for a key that no longer exists.
+func (c *Context) recordRemoval(key string, at time.Time) {
+	if c.HistoryDepth <= 0 {
+		return
+	}
+	c.appendVersion(key, ValueVersion{Removed: true, Timestamp: at})
+}
+
+// recordReplaced records the difference between two whole data maps, for
+// Restore and Import: a removal for every dropped key and a version for
+// every key that is new or holds a different value.
+func (c *Context) recordReplaced(before, after map[string]interface{}, at time.Time) {
+	if c.HistoryDepth <= 0 {
+		return
+	}
+	for key := range before {
+		if _, kept := after[key]; !kept {
+			c.recordRemoval(key, at)
+		}
+	}
+	for key, value := range after {
+		if old, existed := before[key]; !existed || !deepEqual(old, value) {
+			c.recordVersion(key, value, at)
+		}
+	}
+}
+
+func (c *Context) appendVersion(key string, version ValueVersion) {
+	if c.versions == nil {
+		c.versions = make(map[string][]ValueVersion)
+	}
+	versions := append(c.versions[key], version)
+	if len(versions) > c.HistoryDepth {
+		versions = append([]ValueVersion(nil), versions[len(versions)-c.HistoryDepth:]...)
+	}
+	c.versions[key] = versions
+}
+
+// History returns up to limit of the most recent versions of key, oldest
+// first; the last entry is its current value, or a removal if it is unset.
+// Every mutation records versions (Set, Rename, Swap, Remove, Clear, Restore
+// and Import). A limit of 0 returns every version kept. Nothing is recorded
+// unless HistoryDepth is positive.
+func (c *Context) History(key string, limit int) []ValueVersion {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	versions := c.versions[key]
+	if limit > 0 && len(versions) > limit {
+		versions = versions[len(versions)-limit:]
+	}
+	history := make([]ValueVersion, len(versions))
+	for i, v := range versions {
+		history[i] = ValueVersion{Value: deepCopy(v.Value), Removed: v.Removed, Timestamp: v.Timestamp}
+	}
+	return history
+}
+
+func (s *Server) handleCtxGetHistory(params map[string]interface{}) (interface{}, error) {
+	key, err := requireString(params, "key")
+	if err != nil {
+		return nil, err
+	}
+	limit, err := optionalNumber(params, "limit")
+	if err != nil {
+		return nil, err
+	}
+	if limit < 0 {
+		return nil, invalidParams("limit must not be negative")
+	}
+	if s.ctx.HistoryDepth <= 0 {
+		return nil, fmt.Errorf("value history is disabled (start the server with --value-history)")
+	}
+	return map[string]interface{}{"versions": s.ctx.History(key, int(limit))}, nil
+}
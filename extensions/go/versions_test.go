@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+
+func TestHistoryKeepsLastVersionsInOrder(t *testing.T) {
+	ctx := NewContext()
+	ctx.HistoryDepth = 2
+	ctx.Set("k", 1.0)
+	ctx.Set("k", 2.0)
+	ctx.Set("k", 3.0)
+
+	history := ctx.History("k", 0)
+	if len(history) != 2 || history[0].Value != 2.0 || history[1].Value != 3.0 {
+		t.Fatalf("History = %v, want versions 2 then 3", history)
+	}
+	if len(ctx.History("k", 1)) != 1 {
+		t.Fatal("limit 1 should return only the latest version")
+	}
+}
+
+func TestHistoryIsOffByDefault(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	s.ctx.Set("k", 1.0)
+	if len(s.ctx.History("k", 0)) != 0 {
+		t.Fatal("history was recorded with HistoryDepth 0")
+	}
+	if _, err := s.handleCtxGetHistory(map[string]interface{}{"key": "k"}); err == nil {
+		t.Fatal("ctx.getHistory should fail while history is disabled")
+	}
+}
+
+func TestHistoryRecordsEveryMutation(t *testing.T) {
+	ctx := NewContext()
+	ctx.HistoryDepth = 10
+	before := ctx.Snapshot(false)
+
+	ctx.Set("a", 1.0)
+	ctx.Set("b", 2.0)
+	ctx.Swap("a", "b")
+	ctx.Rename("a", "c")
+	ctx.Remove("b")
+	ctx.Set("tmp_x", true)
+	ctx.Clear("tmp_*")
+	ctx.Restore(before)
+
+	tests := []struct {
+		key  string
+		want []interface{} // nil entries stand for removals
+	}{
+		{"a", []interface{}{1.0, 2.0, nil}},
+		{"b", []interface{}{2.0, 1.0, nil}},
+		{"c", []interface{}{2.0, nil}},
+		{"tmp_x", []interface{}{true, nil}},
+	}
+	for _, tt := range tests {
+		history := ctx.History(tt.key, 0)
+		if len(history) != len(tt.want) {
+			t.Fatalf("History(%q) = %v, want %d versions", tt.key, history, len(tt.want))
+		}
+		for i, want := range tt.want {
+			if want == nil {
+				if !history[i].Removed {
+					t.Fatalf("History(%q)[%d] = %v, want a removal", tt.key, i, history[i])
+				}
+			} else if history[i].Removed || history[i].Value != want {
+				t.Fatalf("History(%q)[%d] = %v, want %v", tt.key, i, history[i], want)
+			}
+		}
+	}
+}
+
+func TestHistoryRecordsImportedChanges(t *testing.T) {
+	ctx := NewContext()
+	ctx.HistoryDepth = 10
+	ctx.Set("same", 1.0)
+	ctx.Set("gone", 1.0)
+	ctx.Import(ContextExport{Data: map[string]interface{}{"same": 1.0, "new": 2.0}})
+
+	if n := len(ctx.History("same", 0)); n != 1 {
+		t.Fatalf("unchanged key got %d versions, want 1", n)
+	}
+	if h := ctx.History("gone", 0); len(h) != 2 || !h[1].Removed {
+		t.Fatalf("History(gone) = %v, want a trailing removal", h)
+	}
+	if h := ctx.History("new", 0); len(h) != 1 || h[0].Value != 2.0 {
+		t.Fatalf("History(new) = %v", h)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+type contextWatcher struct {
+	match func(key string, removed bool) bool
+	fired chan string
+}
+
+// watch registers match to be signalled with the key of every later change
+// it matches: a Set, Rename, Swap, Remove, Clear, Restore or Import. removed
+// tells match whether the key is gone afterwards. Signals do not queue: a
+// watcher that has not drained its last signal only sees the first of
+// several changes. The returned cancel function must be called once the
+// watcher is no longer needed.
+func (c *Context) watch(match func(key string, removed bool) bool) (<-chan string, func()) {
+	w := &contextWatcher{match: match, fired: make(chan string, 1)}
+
+	c.watchMu.Lock()
+	if c.watchers == nil {
+		c.watchers = make(map[int]*contextWatcher)
+	}
+	c.watchSeq++
+	id := c.watchSeq
+	c.watchers[id] = w
+	c.watchMu.Unlock()
+
+	return w.fired, func() {
+		c.watchMu.Lock()
+		delete(c.watchers, id)
+		c.watchMu.Unlock()
+	}
+}
+
+// notifyWatchers must be called after c.mu is released, since a woken
+// watcher usually reads the context straight away.
+func (c *Context) notifyWatchers(key string, removed bool) {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+	for _, w := range c.watchers {
+		if !w.match(key, removed) {
+			continue
+		}
+		select {
+		case w.fired <- key:
+		default:
+		}
+	}
+}
+
+// notifyReplaced signals every key of after, and every key of before that
+// after no longer has, for mutations that replace the whole data map.
+func (c *Context) notifyReplaced(before, after map[string]interface{}) {
+	for key := range before {
+		if _, kept := after[key]; !kept {
+			c.notifyWatchers(key, true)
+		}
+	}
+	for key := range after {
+		c.notifyWatchers(key, false)
+	}
+}
+
+// WaitForSet blocks until a key matching pattern (a matchPattern glob, or a
+// plain key) is set, returning that key, or until timeout elapses.
+func (c *Context) WaitForSet(pattern string, timeout time.Duration) (string, bool) {
+	return c.prepareWaitForSet(pattern)(timeout)
+}
+
+// prepareWaitForSet registers the watcher straight away and returns the
+// wait, so a set that lands before the wait starts is not missed.
+func (c *Context) prepareWaitForSet(pattern string) func(timeout time.Duration) (string, bool) {
+	fired, cancel := c.watch(func(key string, removed bool) bool { return !removed && matchPattern(pattern, key) })
+	return func(timeout time.Duration) (string, bool) {
+		defer cancel()
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case key := <-fired:
+			return key, true
+		case <-timer.C:
+			return "", false
+		}
+	}
+}
+
+// WaitFor blocks until node evaluates truthy or timeout elapses, and reports
+// whether it was satisfied. The expression is only re-evaluated when a key it
+// refers to changes, including being removed. The timeout runs on the wall
+// clock: a mocked clock does not advance by itself, so it cannot bound a
+// wait.
+func (c *Context) WaitFor(node exprNode, timeout time.Duration) bool {
+	return c.prepareWaitFor(node)(timeout)
+}
+
+// prepareWaitFor is WaitFor split like prepareWaitForSet.
+func (c *Context) prepareWaitFor(node exprNode) func(timeout time.Duration) bool {
+	roots := make(map[string]bool)
+	for _, ref := range exprRefs(node) {
+		roots[strings.SplitN(ref, ".", 2)[0]] = true
+	}
+	fired, cancel := c.watch(func(key string, _ bool) bool { return roots[key] })
+	return func(timeout time.Duration) bool {
+		defer cancel()
+		if isTruthy(node.eval(c)) {
+			return true
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-fired:
+				if isTruthy(node.eval(c)) {
+					return true
+				}
+			case <-timer.C:
+				return false
+			}
+		}
+	}
+}
+
+// handleCtxWatch waits for the next set of a key matching pattern (or key).
+// Like ctx.waitFor it returns a pendingResult, so a later ctx.set request can
+// fire it.
+func (s *Server) handleCtxWatch(params map[string]interface{}) (interface{}, error) {
+	pattern, err := optionalString(params, "pattern")
+	if err != nil {
+		return nil, err
+	}
+	if pattern == "" {
+		if pattern, err = requireString(params, "key"); err != nil {
+			return nil, invalidParams("one of %q or %q is required", "key", "pattern")
+		}
+	}
+	timeoutMs, err := optionalNumber(params, "timeout_ms")
+	if err != nil {
+		return nil, err
+	}
+	if timeoutMs <= 0 {
+		return nil, invalidParams("timeout_ms must be a positive number")
+	}
+
+	wait := s.ctx.prepareWaitForSet(pattern)
+	return pendingResult(func() (interface{}, error) {
+		key, fired := wait(time.Duration(timeoutMs * float64(time.Millisecond)))
+		if !fired {
+			return map[string]interface{}{"fired": false, "key": nil}, nil
+		}
+		return map[string]interface{}{"fired": true, "key": key}, nil
+	}), nil
+}
+
+// handleCtxWaitFor validates its params and returns a pendingResult, so the
+// wait runs off the request loop and a later ctx.set from the same client can
+// satisfy it.
+func (s *Server) handleCtxWaitFor(params map[string]interface{}) (interface{}, error) {
+	expr, err := requireString(params, "expr")
+	if err != nil {
+		return nil, err
+	}
+	timeoutMs, err := optionalNumber(params, "timeout_ms")
+	if err != nil {
+		return nil, err
+	}
+	if timeoutMs <= 0 {
+		return nil, invalidParams("timeout_ms must be a positive number")
+	}
+	node, err := parseExpr(expr)
+	if err != nil {
+		return nil, invalidParams("invalid expression: %v", err)
+	}
+
+	wait := s.ctx.prepareWaitFor(node)
+	return pendingResult(func() (interface{}, error) {
+		start := time.Now()
+		satisfied := wait(time.Duration(timeoutMs * float64(time.Millisecond)))
+		return map[string]interface{}{
+			"satisfied": satisfied,
+			"waitedMs":  time.Since(start).Milliseconds(),
+		}, nil
+	}), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWaitForIsSatisfiedByLaterSetRequest(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	c := newPipeClient(t, s)
+
+	c.send(1, "ctx.waitFor", map[string]interface{}{"expr": "status == 'done' && count >= 3", "timeout_ms": 2000})
+	c.send(2, "ctx.set", map[string]interface{}{"key": "status", "value": "done"})
+	c.nextResult(2)
+	c.send(3, "ctx.set", map[string]interface{}{"key": "count", "value": 3})
+	c.nextResult(3)
+
+	if result := c.nextResult(1); result["satisfied"] != true {
+		t.Fatalf("ctx.waitFor = %v, want satisfied", result)
+	}
+}
+
+func TestWaitForTimesOutAndCleansUp(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	c := newPipeClient(t, s)
+
+	c.send(1, "ctx.waitFor", map[string]interface{}{"expr": "never", "timeout_ms": 20})
+	if result := c.nextResult(1); result["satisfied"] != false {
+		t.Fatalf("ctx.waitFor = %v, want unsatisfied", result)
+	}
+	s.ctx.watchMu.Lock()
+	defer s.ctx.watchMu.Unlock()
+	if len(s.ctx.watchers) != 0 {
+		t.Fatalf("%d watchers left after timeout", len(s.ctx.watchers))
+	}
+}
+
+func TestWaitForWakesOnEveryMutation(t *testing.T) {
+	// Each mutation runs against a context holding "lock", with before being
+	// a snapshot taken while it was still unset.
+	mutations := []struct {
+		name   string
+		mutate func(ctx *Context, before string)
+	}{
+		{"Remove", func(ctx *Context, _ string) { ctx.Remove("lock") }},
+		{"Clear", func(ctx *Context, _ string) { ctx.Clear("lo*") }},
+		{"Rename", func(ctx *Context, _ string) { ctx.Rename("lock", "released") }},
+		{"Import", func(ctx *Context, _ string) { ctx.Import(ContextExport{Data: map[string]interface{}{}}) }},
+		{"Restore", func(ctx *Context, before string) { ctx.Restore(before) }},
+	}
+	for _, tt := range mutations {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := NewContext()
+			before := ctx.Snapshot(false)
+			ctx.Set("lock", "held")
+			node, err := parseExpr("lock == null")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan bool, 1)
+			go func() { done <- ctx.WaitFor(node, 2*time.Second) }()
+			time.Sleep(20 * time.Millisecond)
+			tt.mutate(ctx, before)
+
+			select {
+			case satisfied := <-done:
+				if !satisfied {
+					t.Fatal("WaitFor reported unsatisfied")
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s did not wake the waiter", tt.name)
+			}
+		})
+	}
+}
+
+func TestWatchFiresOnLaterMatchingSet(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	c := newPipeClient(t, s)
+
+	c.send(1, "ctx.watch", map[string]interface{}{"pattern": "result_*", "timeout_ms": 2000})
+	c.send(2, "ctx.set", map[string]interface{}{"key": "other", "value": 1})
+	c.nextResult(2)
+	c.send(3, "ctx.set", map[string]interface{}{"key": "result_42", "value": "ok"})
+	c.nextResult(3)
+
+	result := c.nextResult(1)
+	if result["fired"] != true || result["key"] != "result_42" {
+		t.Fatalf("ctx.watch = %v, want it fired by result_42", result)
+	}
+}
+
+func TestWatchTimesOutOnNonMatchingSet(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	c := newPipeClient(t, s)
+
+	c.send(1, "ctx.watch", map[string]interface{}{"pattern": "result_*", "timeout_ms": 50})
+	c.send(2, "ctx.set", map[string]interface{}{"key": "other", "value": 1})
+	c.nextResult(2)
+
+	result := c.nextResult(1)
+	if result["fired"] != false || result["key"] != nil {
+		t.Fatalf("ctx.watch = %v, want a timeout", result)
+	}
+	s.ctx.watchMu.Lock()
+	defer s.ctx.watchMu.Unlock()
+	if len(s.ctx.watchers) != 0 {
+		t.Fatalf("%d watchers left after timeout", len(s.ctx.watchers))
+	}
+}
+
+func TestWatchRequiresKeyOrPattern(t *testing.T) {
+	s := NewServer(NewBaseRegistry())
+	if _, err := s.handleCtxWatch(map[string]interface{}{"timeout_ms": 30.0}); errorCode(err) != CodeInvalidParams {
+		t.Fatalf("err = %v, want Invalid params", err)
+	}
+}